@@ -0,0 +1,5 @@
+cd ..
+docker run --rm --mount type=bind,src=${PWD},dst=/src --workdir /src golang:alpine sh -c "cd admin && go build -o=./zendo-admin -trimpath -mod=readonly -ldflags=-s -ldflags=-w ."
+cd admin
+docker build -t zendo-admin .
+rm zendo-admin
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+	"zendo/admin/services"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/server"
+	libServices "zendo/lib_zendo/services"
+	"zendo/lib_zendo/utils"
+
+	"github.com/joho/godotenv"
+)
+
+const usage string = `Usage: zendo-admin [flags] <command> [flags]
+
+Commands:
+  setup      create the database, api user and security object then migrate the design docs
+  migrate    upload any design docs that differ from the deployed copies
+  diff       show how the deployed design docs differ from the local copies, exits 1 if they differ
+  retention  write rollups then purge documents older than the RETENTION_* settings and compact the database
+  create-key create an api key with -name and -scopes, only the key is printed so it can be captured
+  list-keys  list the api keys and their scopes
+  revoke-key revoke the api key with -id
+
+Flags:
+`
+
+// STORAGE_COMMANDS work against the storage backend rather than setting up CouchDB
+var STORAGE_COMMANDS = []string{"retention", "create-key", "list-keys", "revoke-key"}
+
+func main() {
+	// load env
+	if err := godotenv.Load(); err != nil {
+		log.Fatalln("Failed to load env file")
+	}
+
+	if err := server.SetupLogger(); err != nil {
+		log.Fatalln("Failed to setup logger:", err)
+	}
+
+	dir := flag.String("dir", "couchdb", "directory holding the design doc json files")
+	wait := flag.Duration("wait", 60*time.Second, "how long to wait for CouchDB to come up")
+	storage := flag.String("storage", "", "storage backend for retention: couchdb, sqlite, postgres or memory (defaults to ZENDO_STORAGE)")
+	dryRun := flag.Bool("dry-run", false, "report what retention would write and purge without changing anything")
+	every := flag.Duration("every", 0, "repeat retention on this interval instead of running once")
+	name := flag.String("name", "", "name of the key to create, e.g. who or what uses it")
+	scopes := flag.String("scopes", "", "comma separated scopes of the key to create: "+strings.Join(model.SCOPES, ", "))
+	id := flag.String("id", "", "id of the key to revoke")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// flags can also follow the command, e.g. retention -every 24h
+	command := flag.Arg(0)
+	if flag.NArg() > 0 {
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+	if len(command) == 0 || flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// stop cleanly on ctrl-c or when the container is stopped
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// setup dependencies
+
+	httpClient := utils.HttpClient{}
+
+	adminService := services.CouchDBAdminService{
+		Http: &httpClient,
+	}
+
+	// the setup commands always need CouchDB, the others only when it is the storage backend
+	if !slices.Contains(STORAGE_COMMANDS, command) || libServices.ResolveStorage(*storage) == libServices.COUCHDB_STORAGE {
+		if err := adminService.WaitUntilUp(ctx, *wait); err != nil {
+			log.Fatalln("CouchDB is not reachable:", err)
+		}
+	}
+
+	switch command {
+	case "setup":
+		if err := adminService.CreateDatabase(ctx); err != nil {
+			log.Fatalln("Failed to create database:", err)
+		}
+		if err := adminService.CreateApiUser(ctx); err != nil {
+			log.Fatalln("Failed to create api user:", err)
+		}
+		if err := adminService.SetSecurity(ctx); err != nil {
+			log.Fatalln("Failed to set database security:", err)
+		}
+		if err := adminService.MigrateDesignDocs(ctx, *dir); err != nil {
+			log.Fatalln("Failed to migrate design docs:", err)
+		}
+	case "migrate":
+		if err := adminService.MigrateDesignDocs(ctx, *dir); err != nil {
+			log.Fatalln("Failed to migrate design docs:", err)
+		}
+	case "diff":
+		changes, err := adminService.DiffDesignDocs(ctx, *dir)
+		if err != nil {
+			log.Fatalln("Failed to diff design docs:", err)
+		}
+		for _, change := range changes {
+			fmt.Println(change)
+		}
+		if len(changes) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("Design docs are up to date")
+	case "retention":
+		retentionService := newRetentionService(*storage, &httpClient, &adminService)
+		for {
+			if err := runRetention(ctx, retentionService, *dryRun); err != nil {
+				log.Fatalln("Retention failed:", err)
+			}
+			if *every <= 0 {
+				break
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(*every):
+			}
+		}
+	case "create-key":
+		key, _, err := newApiKeyService(*storage, &httpClient).CreateApiKey(ctx, *name, splitScopes(*scopes))
+		if err != nil {
+			log.Fatalln("Failed to create api key:", err)
+		}
+		fmt.Println(key)
+	case "list-keys":
+		keys, err := newApiKeyService(*storage, &httpClient).GetApiKeys(ctx)
+		if err != nil {
+			log.Fatalln("Failed to list api keys:", err)
+		}
+		for _, key := range *keys {
+			status := "active"
+			if key.RevokedAt != nil {
+				status = "revoked " + key.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", key.Id, key.Name, strings.Join(key.Scopes, ","), status)
+		}
+	case "revoke-key":
+		found, err := newApiKeyService(*storage, &httpClient).RevokeApiKey(ctx, *id)
+		if err != nil {
+			log.Fatalln("Failed to revoke api key:", err)
+		}
+		if !found {
+			log.Fatalln("No api key with id", *id)
+		}
+		fmt.Println("Revoked", *id)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func newApiKeyService(storage string, http utils.IHttpClient) *libServices.ApiKeyService {
+	dataService, err := libServices.NewDataService(storage, http)
+	if err != nil {
+		log.Fatalln("Failed to setup data service:", err)
+	}
+
+	return &libServices.ApiKeyService{
+		Store: dataService,
+	}
+}
+
+func splitScopes(scopes string) []string {
+	split := []string{}
+	for _, scope := range strings.Split(scopes, ",") {
+		if scope = strings.TrimSpace(scope); len(scope) > 0 {
+			split = append(split, scope)
+		}
+	}
+	return split
+}
+
+func newRetentionService(storage string, http utils.IHttpClient, adminService *services.CouchDBAdminService) *libServices.RetentionService {
+	policy, err := libServices.RetentionPolicyFromEnv()
+	if err != nil {
+		log.Fatalln("Invalid retention policy:", err)
+	}
+
+	dataService, err := libServices.NewDataService(storage, http)
+	if err != nil {
+		log.Fatalln("Failed to setup data service:", err)
+	}
+
+	// CouchDB compaction needs the admin credentials, the other backends compact themselves
+	var compactor libServices.ICompactor
+	if libServices.ResolveStorage(storage) == libServices.COUCHDB_STORAGE {
+		compactor = adminService
+	} else if c, ok := dataService.(libServices.ICompactor); ok {
+		compactor = c
+	}
+
+	return &libServices.RetentionService{
+		DataService: dataService,
+		RollupService: &libServices.RollupService{
+			DataService: dataService,
+		},
+		Compactor: compactor,
+		Policy:    policy,
+	}
+}
+
+func runRetention(ctx context.Context, retentionService *libServices.RetentionService, dryRun bool) error {
+	report, err := retentionService.Run(ctx, dryRun)
+	if err != nil {
+		return err
+	}
+
+	verb := "Purged"
+	written := "Wrote"
+	if report.DryRun {
+		verb = "Would purge"
+		written = "Would write"
+	}
+
+	for resolution, count := range report.RollupsWritten {
+		fmt.Printf("%s %d %s rollups\n", written, count, resolution)
+	}
+	for _, purged := range report.Purged {
+		fmt.Printf("%s %d %s documents before %s\n", verb, purged.Count, purged.Target, purged.Cutoff.Format(time.RFC3339))
+	}
+	if report.Compacted {
+		fmt.Println("Started compaction")
+	}
+
+	return nil
+}
@@ -0,0 +1,455 @@
+package services
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"zendo/lib_zendo/errors"
+	"zendo/lib_zendo/utils"
+
+	"go.uber.org/zap"
+)
+
+// CouchDBAdminService provisions the database using the admin credentials.
+// Every step checks the current state first so it is safe to run on every boot.
+type CouchDBAdminService struct {
+	Http utils.IHttpClient
+}
+
+const (
+	DESIGN_DOC_ADDED   string = "added"
+	DESIGN_DOC_REMOVED string = "removed"
+	DESIGN_DOC_CHANGED string = "changed"
+
+	// fields the admin tool adds to deployed design docs to track versions
+	versionField string = "zendo_version"
+	hashField    string = "zendo_hash"
+)
+
+type DesignDocChange struct {
+	DocId  string
+	Path   string
+	Change string
+}
+
+type DesignDocument map[string]any
+
+func (s *CouchDBAdminService) WaitUntilUp(ctx context.Context, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		result, err := s.Http.Get(ctx, serverUrl("/_up"), nil)
+		if err == nil && result.StatusCode == 200 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			zap.L().Error("CouchDB did not come up in time", zap.Error(err))
+			return &errors.DatabaseError{}
+		}
+
+		zap.L().Info("Waiting for CouchDB...")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *CouchDBAdminService) CreateDatabase(ctx context.Context) error {
+	result, err := s.Http.Put(ctx, databaseUrl(""), nil, nil)
+	if err != nil {
+		zap.L().Error("Failed to create database", zap.Error(err))
+		return &errors.DatabaseError{}
+	}
+
+	switch result.StatusCode {
+	case 201, 202:
+		zap.L().Info("Created database", zap.String("db", os.Getenv("COUCHDB_DB")))
+	case 412:
+		zap.L().Info("Database already exists", zap.String("db", os.Getenv("COUCHDB_DB")))
+	default:
+		return &errors.HttpError{
+			StatusCode: result.StatusCode,
+		}
+	}
+
+	return nil
+}
+
+// CreateApiUser creates the api user, or updates its password when the deployed user no longer matches
+func (s *CouchDBAdminService) CreateApiUser(ctx context.Context) error {
+	name := os.Getenv("COUCHDB_USER")
+	password := os.Getenv("COUCHDB_PASSWORD")
+	userUrl := serverUrl("/_users/org.couchdb.user:" + name)
+
+	var existing map[string]any
+	result, err := s.Http.Get(ctx, userUrl, &existing)
+	if err != nil {
+		zap.L().Error("Failed to look up api user", zap.Error(err))
+		return &errors.DatabaseError{}
+	}
+
+	user := map[string]any{
+		"name":     name,
+		"password": password,
+		"roles":    []string{},
+		"type":     "user",
+	}
+	switch result.StatusCode {
+	case 200:
+		if passwordMatches(existing, password) {
+			zap.L().Info("Api user already exists", zap.String("user", name))
+			return nil
+		}
+		user["_rev"] = existing["_rev"]
+		if roles, ok := existing["roles"]; ok {
+			user["roles"] = roles
+		}
+	case 404:
+	default:
+		return &errors.HttpError{
+			StatusCode: result.StatusCode,
+		}
+	}
+
+	result, err = s.Http.Put(ctx, userUrl, user, nil)
+	if err != nil {
+		zap.L().Error("Failed to save api user", zap.Error(err))
+		return &errors.DatabaseError{}
+	}
+	if result.StatusCode > 299 {
+		return &errors.HttpError{
+			StatusCode: result.StatusCode,
+		}
+	}
+
+	if _, ok := user["_rev"]; ok {
+		zap.L().Info("Updated api user password", zap.String("user", name))
+	} else {
+		zap.L().Info("Created api user", zap.String("user", name))
+	}
+	return nil
+}
+
+// SetSecurity gives the api user read write access to the database
+func (s *CouchDBAdminService) SetSecurity(ctx context.Context) error {
+	security := map[string]any{
+		"admins": map[string][]string{
+			"names": {},
+			"roles": {},
+		},
+		"members": map[string][]string{
+			"names": {os.Getenv("COUCHDB_USER")},
+			"roles": {},
+		},
+	}
+
+	result, err := s.Http.Put(ctx, databaseUrl("/_security"), security, nil)
+	if err != nil {
+		zap.L().Error("Failed to set database security", zap.Error(err))
+		return &errors.DatabaseError{}
+	}
+	if result.StatusCode > 299 {
+		return &errors.HttpError{
+			StatusCode: result.StatusCode,
+		}
+	}
+
+	zap.L().Info("Set database security")
+	return nil
+}
+
+// MigrateDesignDocs uploads every design doc in dir whose content differs from the deployed copy.
+// Deployed docs carry a content hash and a version which is bumped on every upload.
+func (s *CouchDBAdminService) MigrateDesignDocs(ctx context.Context, dir string) error {
+	docs, err := LoadDesignDocs(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, local := range docs {
+		id := local.Id()
+		deployed, err := s.getDesignDoc(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		hash := local.Hash()
+		version := 1
+		if deployed != nil {
+			if deployed[hashField] == hash {
+				zap.L().Info("Design doc up to date", zap.String("id", id), zap.Any("version", deployed[versionField]))
+				continue
+			}
+
+			if v, ok := deployed[versionField].(float64); ok {
+				version = int(v) + 1
+			}
+		}
+
+		upload := local.content()
+		upload["_id"] = id
+		upload[versionField] = version
+		upload[hashField] = hash
+		if deployed != nil {
+			upload["_rev"] = deployed["_rev"]
+		}
+
+		result, err := s.Http.Put(ctx, databaseUrl("/"+id), upload, nil)
+		if err != nil {
+			zap.L().Error("Failed to upload design doc", zap.String("id", id), zap.Error(err))
+			return &errors.DatabaseError{}
+		}
+		if result.StatusCode > 299 {
+			zap.L().Error("Failed to upload design doc", zap.String("id", id), zap.Int("status", result.StatusCode))
+			return &errors.HttpError{
+				StatusCode: result.StatusCode,
+			}
+		}
+
+		zap.L().Info("Uploaded design doc", zap.String("id", id), zap.Int("version", version))
+	}
+
+	return nil
+}
+
+// DiffDesignDocs compares the deployed design docs against the local copies in dir.
+// Added means present locally but not deployed, removed means deployed but not present locally.
+func (s *CouchDBAdminService) DiffDesignDocs(ctx context.Context, dir string) ([]DesignDocChange, error) {
+	docs, err := LoadDesignDocs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []DesignDocChange{}
+	for _, local := range docs {
+		deployed, err := s.getDesignDoc(ctx, local.Id())
+		if err != nil {
+			return nil, err
+		}
+
+		if deployed == nil {
+			changes = append(changes, DesignDocChange{
+				DocId:  local.Id(),
+				Path:   "",
+				Change: DESIGN_DOC_ADDED,
+			})
+			continue
+		}
+
+		changes = append(changes, diffDocs(local.Id(), "", local.content(), deployed.content())...)
+	}
+
+	return changes, nil
+}
+
+// Compact starts database compaction and clears out index files for views that no longer exist.
+// CouchDB compacts in the background so this returns once compaction has been accepted.
+func (s *CouchDBAdminService) Compact(ctx context.Context) error {
+	for _, path := range []string{"/_compact", "/_view_cleanup"} {
+		result, err := s.Http.Post(ctx, databaseUrl(path), nil, nil)
+		if err != nil {
+			zap.L().Error("Failed to start compaction", zap.String("path", path), zap.Error(err))
+			return &errors.DatabaseError{}
+		}
+		if result.StatusCode > 299 {
+			zap.L().Error("Failed to start compaction", zap.String("path", path), zap.Int("status", result.StatusCode))
+			return &errors.HttpError{
+				StatusCode: result.StatusCode,
+			}
+		}
+	}
+
+	zap.L().Info("Started database compaction", zap.String("db", os.Getenv("COUCHDB_DB")))
+	return nil
+}
+
+func LoadDesignDocs(dir string) ([]DesignDocument, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	docs := []DesignDocument{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			zap.L().Error("Failed to read design doc", zap.String("file", file), zap.Error(err))
+			return nil, err
+		}
+
+		var doc DesignDocument
+		if err := json.Unmarshal(data, &doc); err != nil {
+			zap.L().Error("Failed to parse design doc", zap.String("file", file), zap.Error(err))
+			return nil, err
+		}
+
+		if !strings.HasPrefix(doc.Id(), "_design/") {
+			continue
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+func (d DesignDocument) Id() string {
+	id, _ := d["_id"].(string)
+	return id
+}
+
+// Hash identifies the content of the doc, ignoring CouchDB metadata and the version tracking fields
+func (d DesignDocument) Hash() string {
+	// json.Marshal sorts map keys so the encoding is stable
+	data, _ := json.Marshal(d.content())
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// private
+
+func (s *CouchDBAdminService) getDesignDoc(ctx context.Context, id string) (DesignDocument, error) {
+	var doc DesignDocument
+	result, err := s.Http.Get(ctx, databaseUrl("/"+id), &doc)
+	if err != nil {
+		zap.L().Error("Failed to get design doc", zap.String("id", id), zap.Error(err))
+		return nil, &errors.DatabaseError{}
+	}
+
+	switch result.StatusCode {
+	case 200:
+		return doc, nil
+	case 404:
+		return nil, nil
+	default:
+		return nil, &errors.HttpError{
+			StatusCode: result.StatusCode,
+		}
+	}
+}
+
+// passwordMatches checks password against the pbkdf2 key CouchDB derived for the user.
+// Any other scheme can't be checked so is reported as not matching, which resets the password.
+func passwordMatches(user map[string]any, password string) bool {
+	scheme, _ := user["password_scheme"].(string)
+	salt, _ := user["salt"].(string)
+	derivedKey, _ := user["derived_key"].(string)
+	iterations, _ := user["iterations"].(float64)
+	if scheme != "pbkdf2" || len(salt) == 0 || len(derivedKey) == 0 || iterations < 1 {
+		return false
+	}
+
+	expected, err := hex.DecodeString(derivedKey)
+	if err != nil {
+		return false
+	}
+
+	var key []byte
+	// older CouchDB versions derived keys with sha1 and didn't record the prf
+	switch prf, _ := user["pbkdf2_prf"].(string); prf {
+	case "", "sha":
+		key, err = pbkdf2.Key(sha1.New, password, []byte(salt), int(iterations), len(expected))
+	case "sha256":
+		key, err = pbkdf2.Key(sha256.New, password, []byte(salt), int(iterations), len(expected))
+	default:
+		return false
+	}
+
+	return err == nil && subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+func (d DesignDocument) content() map[string]any {
+	content := map[string]any{}
+	for key, value := range d {
+		switch key {
+		case "_id", "_rev", versionField, hashField:
+			continue
+		}
+		content[key] = value
+	}
+	return content
+}
+
+func diffDocs(id string, path string, local map[string]any, deployed map[string]any) []DesignDocChange {
+	keys := map[string]bool{}
+	for key := range local {
+		keys[key] = true
+	}
+	for key := range deployed {
+		keys[key] = true
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	changes := []DesignDocChange{}
+	for _, key := range sorted {
+		keyPath := key
+		if len(path) > 0 {
+			keyPath = path + "/" + key
+		}
+
+		localValue, inLocal := local[key]
+		deployedValue, inDeployed := deployed[key]
+
+		switch {
+		case !inDeployed:
+			changes = append(changes, DesignDocChange{DocId: id, Path: keyPath, Change: DESIGN_DOC_ADDED})
+		case !inLocal:
+			changes = append(changes, DesignDocChange{DocId: id, Path: keyPath, Change: DESIGN_DOC_REMOVED})
+		default:
+			localMap, localIsMap := localValue.(map[string]any)
+			deployedMap, deployedIsMap := deployedValue.(map[string]any)
+			if localIsMap && deployedIsMap {
+				changes = append(changes, diffDocs(id, keyPath, localMap, deployedMap)...)
+			} else if !reflect.DeepEqual(localValue, deployedValue) {
+				changes = append(changes, DesignDocChange{DocId: id, Path: keyPath, Change: DESIGN_DOC_CHANGED})
+			}
+		}
+	}
+
+	return changes
+}
+
+func (c DesignDocChange) String() string {
+	if len(c.Path) == 0 {
+		return fmt.Sprintf("%s: %s", c.DocId, c.Change)
+	}
+	return fmt.Sprintf("%s %s: %s", c.DocId, c.Path, c.Change)
+}
+
+func serverUrl(path string) string {
+	var builder strings.Builder
+	builder.WriteString("http://")
+	builder.WriteString(os.Getenv("COUCHDB_ADMIN_USER"))
+	builder.WriteString(":")
+	builder.WriteString(os.Getenv("COUCHDB_ADMIN_PASSWORD"))
+	builder.WriteString("@")
+	builder.WriteString(os.Getenv("COUCHDB_URL"))
+	builder.WriteString(path)
+	return builder.String()
+}
+
+func databaseUrl(path string) string {
+	var builder strings.Builder
+	builder.WriteString(serverUrl("/"))
+	builder.WriteString(os.Getenv("COUCHDB_DB"))
+	builder.WriteString(path)
+	return builder.String()
+}
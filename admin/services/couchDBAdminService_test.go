@@ -0,0 +1,234 @@
+package services
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"zendo/lib_zendo/utils"
+)
+
+func TestDiffDocs(t *testing.T) {
+	views := func(mapFunction string) map[string]any {
+		return map[string]any{
+			"language": "javascript",
+			"views": map[string]any{
+				"by_time": map[string]any{"map": mapFunction},
+			},
+		}
+	}
+
+	for _, test := range []struct {
+		name     string
+		local    map[string]any
+		deployed map[string]any
+		expected []DesignDocChange
+	}{
+		{
+			name:     "unchanged",
+			local:    views("function (doc) { emit(doc.timestamp) }"),
+			deployed: views("function (doc) { emit(doc.timestamp) }"),
+			expected: []DesignDocChange{},
+		},
+		{
+			name:     "changed function",
+			local:    views("function (doc) { emit(doc.timestamp, null) }"),
+			deployed: views("function (doc) { emit(doc.timestamp) }"),
+			expected: []DesignDocChange{{DocId: "_design/views", Path: "views/by_time/map", Change: DESIGN_DOC_CHANGED}},
+		},
+		{
+			name:     "added view",
+			local:    map[string]any{"views": map[string]any{"by_time": "a", "by_type": "b"}},
+			deployed: map[string]any{"views": map[string]any{"by_time": "a"}},
+			expected: []DesignDocChange{{DocId: "_design/views", Path: "views/by_type", Change: DESIGN_DOC_ADDED}},
+		},
+		{
+			name:     "removed filter",
+			local:    map[string]any{"language": "javascript"},
+			deployed: map[string]any{"language": "javascript", "filters": map[string]any{"only_energy": "f"}},
+			expected: []DesignDocChange{{DocId: "_design/views", Path: "filters", Change: DESIGN_DOC_REMOVED}},
+		},
+		{
+			name:     "value replaced by a map",
+			local:    map[string]any{"options": map[string]any{"partitioned": false}},
+			deployed: map[string]any{"options": "none"},
+			expected: []DesignDocChange{{DocId: "_design/views", Path: "options", Change: DESIGN_DOC_CHANGED}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			changes := diffDocs("_design/views", "", test.local, test.deployed)
+			if !reflect.DeepEqual(changes, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, changes)
+			}
+		})
+	}
+}
+
+func TestDiffDesignDocs(t *testing.T) {
+	dir := t.TempDir()
+	for _, doc := range []DesignDocument{
+		{"_id": "_design/filters", "filters": map[string]any{"only_energy": "f"}},
+		{"_id": "_design/views", "views": map[string]any{"by_time": "b"}},
+	} {
+		writeDesignDocForTest(t, dir, doc)
+	}
+
+	// the deployed copy carries metadata which isn't part of the content
+	deployed := DesignDocument{"_id": "_design/views", "_rev": "3-abc", versionField: 3.0, hashField: "old", "views": map[string]any{"by_time": "a"}}
+	s := adminForTest(t, func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/zendo/_design/views" {
+			writeJsonForTest(resp, deployed)
+			return
+		}
+		resp.WriteHeader(http.StatusNotFound)
+	})
+
+	changes, err := s.DiffDesignDocs(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []DesignDocChange{
+		{DocId: "_design/filters", Change: DESIGN_DOC_ADDED},
+		{DocId: "_design/views", Path: "views/by_time", Change: DESIGN_DOC_CHANGED},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("expected %v, got %v", expected, changes)
+	}
+}
+
+func TestCreateApiUser(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		existing map[string]any
+		expected map[string]any
+	}{
+		{
+			name:     "missing user",
+			existing: nil,
+			expected: map[string]any{"name": "zendo", "password": "secret", "roles": []any{}, "type": "user"},
+		},
+		{
+			name:     "same password",
+			existing: userForTest("secret", "sha256"),
+			expected: nil,
+		},
+		{
+			name:     "same password with sha1",
+			existing: userForTest("secret", "sha"),
+			expected: nil,
+		},
+		{
+			name:     "different password",
+			existing: userForTest("old secret", "sha256"),
+			expected: map[string]any{"_rev": "2-abc", "name": "zendo", "password": "secret", "roles": []any{"reader"}, "type": "user"},
+		},
+		{
+			name:     "password that can't be checked",
+			existing: map[string]any{"_rev": "2-abc", "name": "zendo", "password_scheme": "simple", "roles": []any{}},
+			expected: map[string]any{"_rev": "2-abc", "name": "zendo", "password": "secret", "roles": []any{}, "type": "user"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var saved map[string]any
+			s := adminForTest(t, func(resp http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/_users/org.couchdb.user:zendo" {
+					resp.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				switch req.Method {
+				case http.MethodGet:
+					if test.existing == nil {
+						resp.WriteHeader(http.StatusNotFound)
+						return
+					}
+					writeJsonForTest(resp, test.existing)
+				case http.MethodPut:
+					if err := json.NewDecoder(req.Body).Decode(&saved); err != nil {
+						t.Error(err)
+					}
+					resp.WriteHeader(http.StatusCreated)
+				}
+			})
+
+			if err := s.CreateApiUser(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(saved, test.expected) {
+				t.Fatalf("expected %v to be saved, got %v", test.expected, saved)
+			}
+		})
+	}
+}
+
+// private
+
+// adminForTest points the admin service at a CouchDB served by handle
+func adminForTest(t *testing.T, handle http.HandlerFunc) *CouchDBAdminService {
+	t.Helper()
+
+	server := httptest.NewServer(handle)
+	t.Cleanup(server.Close)
+
+	t.Setenv("COUCHDB_URL", strings.TrimPrefix(server.URL, "http://"))
+	t.Setenv("COUCHDB_DB", "zendo")
+	t.Setenv("COUCHDB_ADMIN_USER", "admin")
+	t.Setenv("COUCHDB_ADMIN_PASSWORD", "password")
+	t.Setenv("COUCHDB_USER", "zendo")
+	t.Setenv("COUCHDB_PASSWORD", "secret")
+	return &CouchDBAdminService{Http: &utils.HttpClient{}}
+}
+
+// userForTest is the user doc CouchDB stores once it has hashed password with prf
+func userForTest(password string, prf string) map[string]any {
+	salt := "0123456789abcdef0123456789abcdef"
+	user := map[string]any{
+		"_rev":            "2-abc",
+		"name":            "zendo",
+		"roles":           []any{"reader"},
+		"type":            "user",
+		"password_scheme": "pbkdf2",
+		"salt":            salt,
+		"iterations":      10,
+	}
+
+	if prf == "sha" {
+		// older CouchDB versions don't record the prf, derived_key is hashed with sha1
+		key, _ := pbkdf2.Key(sha1.New, password, []byte(salt), 10, 20)
+		user["derived_key"] = hex.EncodeToString(key)
+		return user
+	}
+
+	key, _ := pbkdf2.Key(sha256.New, password, []byte(salt), 10, 32)
+	user["pbkdf2_prf"] = prf
+	user["derived_key"] = hex.EncodeToString(key)
+	return user
+}
+
+func writeDesignDocForTest(t *testing.T, dir string, doc DesignDocument) {
+	t.Helper()
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := strings.TrimPrefix(doc.Id(), "_design/") + ".json"
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeJsonForTest(resp http.ResponseWriter, body any) {
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(body)
+}
@@ -1,62 +1,52 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"log"
 	"net/http"
 	"os"
-	"time"
+	"zendo/api/openapi"
+	"zendo/api/ratelimit"
 	"zendo/api/routes"
+	"zendo/lib_zendo/auth"
+	"zendo/lib_zendo/health"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/server"
 	"zendo/lib_zendo/services"
+	"zendo/lib_zendo/telemetry"
 	"zendo/lib_zendo/utils"
 
 	"github.com/joho/godotenv"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 )
 
-func setupLogger() {
-	var encoding string
-	var encoderCfg zapcore.EncoderConfig
-	// TODO: flip to json logging in prod
-	encoderCfg = zap.NewDevelopmentEncoderConfig()
-	encoding = "console"
-
-	encoderCfg.TimeKey = "timestamp"
-	encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
-
-	// TODO: Make this configurable via env var
-	zapLevel := zap.InfoLevel
-
-	config := zap.Config{
-		Level:             zap.NewAtomicLevelAt(zapLevel),
-		Development:       os.Getenv("ZENDO_ENV") == "dev",
-		DisableCaller:     false,
-		DisableStacktrace: false,
-		Sampling:          nil,
-		Encoding:          encoding,
-		EncoderConfig:     encoderCfg,
-		OutputPaths: []string{
-			"stderr",
-		},
-		ErrorOutputPaths: []string{
-			"stderr",
-		},
-		InitialFields: map[string]any{
-			"pid": os.Getpid(),
-		},
-	}
-	logger := zap.Must(config.Build())
-
-	zap.ReplaceGlobals(logger)
-}
+const API_VERSION string = "1.0.0"
 
 func main() {
+	storage := flag.String("storage", "", "storage backend: couchdb, sqlite, postgres or memory (defaults to ZENDO_STORAGE)")
+	printSpec := flag.Bool("openapi", false, "print the OpenAPI document and exit, for generating clients")
+	flag.Parse()
+
+	spec := openapi.Build(API_VERSION)
+	if *printSpec {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(spec); err != nil {
+			log.Fatalln("Failed to encode OpenAPI document:", err)
+		}
+		return
+	}
+
 	// load env
 	if err := godotenv.Load(); err != nil {
 		log.Fatalln("Failed to load env file")
 	}
 
-	setupLogger()
+	if err := server.SetupLogger(); err != nil {
+		log.Fatalln("Failed to setup logger:", err)
+	}
 
 	// setup router
 	mux := http.NewServeMux()
@@ -66,7 +56,8 @@ func main() {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Last-Event-ID, Authorization, X-API-Key, If-None-Match, If-Modified-Since, X-Request-ID")
+			w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count, X-Next-Cursor, Link, Content-Disposition, ETag, Last-Modified, RateLimit-Policy, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After, X-Request-ID")
 
 			if r.Method == "OPTIONS" {
 				w.WriteHeader(http.StatusOK)
@@ -80,30 +71,176 @@ func main() {
 
 	httpClient := utils.HttpClient{}
 
-	dataService := services.CouchDBDataService{
-		Http: &httpClient,
+	dataService, err := services.NewDataService(*storage, &httpClient)
+	if err != nil {
+		log.Fatalln("Failed to setup data service:", err)
+	}
+
+	apiKeyService := services.ApiKeyService{
+		Store: dataService,
+	}
+
+	// nothing else can reach memory storage, so the api makes up its own data and a key for the admin routes
+	demo := services.ResolveStorage(*storage) == services.MEMORY_STORAGE
+	if demo {
+		if err := services.CreateDemoKey(context.Background(), &apiKeyService, os.Stdout); err != nil {
+			log.Fatalln("Failed to create demo key:", err)
+		}
+	}
+
+	// tokens from SSO are accepted when JWT_JWKS is set
+	tokenVerifier, err := auth.TokenVerifierFromEnv(&httpClient)
+	if err != nil {
+		log.Fatalln("Failed to setup token verification:", err)
+	}
+
+	// without a key requests only get the anonymous scopes, read:metrics keeps the dashboard public
+	authenticator := auth.Authenticator{
+		ApiKeys:         &apiKeyService,
+		Tokens:          tokenVerifier,
+		AnonymousScopes: auth.AnonymousScopesFromEnv(),
+	}
+
+	// view queries and exports get a smaller budget than the cheap lookups
+	cheap, err := ratelimit.LimiterFromEnv("cheap", "RATE_LIMIT_CHEAP", "120/m")
+	if err != nil {
+		log.Fatalln("Failed to setup rate limit:", err)
+	}
+	expensive, err := ratelimit.LimiterFromEnv("expensive", "RATE_LIMIT_EXPENSIVE", "30/m")
+	if err != nil {
+		log.Fatalln("Failed to setup rate limit:", err)
+	}
+	// checking a key reads storage, so every IP also gets a budget that is spent before auth runs
+	perIp, err := ratelimit.LimiterFromEnv("ip", "RATE_LIMIT_IP", "600/m")
+	if err != nil {
+		log.Fatalln("Failed to setup rate limit:", err)
+	}
+	protect := func(scope string, limiter *ratelimit.Limiter, next http.HandlerFunc) http.HandlerFunc {
+		return perIp.Limit(authenticator.Require(scope, limiter.Limit(next)))
+	}
+
+	// streams and websockets hold their connection until the hub closes, so shutdown stops it to let them finish
+	streams, stopStreams := context.WithCancel(context.Background())
+
+	// one upstream subscription shared by every stream client, it reads storage directly so polling never sees the cache
+	hub := services.EventHub{
+		Source: services.NewEventSource(*storage, dataService, &httpClient),
+		AlertRules: []services.IAlertRule{
+			&services.BalanceAlertRule{},
+		},
+	}
+	go func() {
+		if err := hub.Run(streams); err != nil && streams.Err() == nil {
+			zap.L().Error("Event hub stopped", zap.Error(err))
+		}
+	}()
+
+	if demo {
+		demoFeed := services.DemoFeed{
+			DataService: dataService,
+		}
+		go func() {
+			if err := demoFeed.Run(streams); err != nil && streams.Err() == nil {
+				zap.L().Error("Demo feed stopped", zap.Error(err))
+			}
+		}()
+	}
+
+	// every poll of the dashboard wants the latest metric, keep it until the hub sees a new one
+	cachedDataService := services.CachingDataService{
+		IDataService: dataService,
 	}
+	go cachedDataService.InvalidateOn(streams, &hub)
 
 	// setup routes and inject dependencies
+	rollupService := services.RollupService{
+		DataService: &cachedDataService,
+	}
+
 	dataRoutes := routes.DataRoutes{
-		DataService: &dataService,
+		DataService:   &cachedDataService,
+		RollupService: &rollupService,
+	}
+
+	exportRoutes := routes.ExportRoutes{
+		DataService: &cachedDataService,
+	}
+
+	streamRoutes := routes.StreamRoutes{
+		DataService: &cachedDataService,
+		Hub:         &hub,
+	}
+
+	socketRoutes := routes.SocketRoutes{
+		DataService:    &cachedDataService,
+		Hub:            &hub,
+		AllowedOrigins: routes.AllowedOriginsFromEnv(),
+	}
+
+	gaugeRoutes := routes.GaugeRoutes{
+		DataService: &cachedDataService,
+	}
+
+	keyRoutes := routes.KeyRoutes{
+		ApiKeys: &apiKeyService,
+	}
+
+	// readiness reads storage directly rather than through the cache
+	maxDataAge, err := health.MaxDataAgeFromEnv()
+	if err != nil {
+		log.Fatalln("Failed to setup health checks:", err)
+	}
+	checker := health.Checker{
+		Checks: append(health.StorageChecks(dataService),
+			health.FreshnessCheck("aggregated-data", maxDataAge, health.LatestMetricTime(dataService)),
+		),
 	}
 
 	// register routes
-	mux.HandleFunc("/energy-summary", dataRoutes.GetLatestMetric)
-	mux.HandleFunc("/historical-data", dataRoutes.GetTimeSeriesMetrics)
+	mux.HandleFunc("/energy-summary", protect(model.READ_METRICS_SCOPE, cheap, dataRoutes.GetLatestMetric))
+	mux.HandleFunc("/historical-data", protect(model.READ_METRICS_SCOPE, expensive, dataRoutes.GetTimeSeriesMetrics))
+	mux.HandleFunc("/export", protect(model.READ_METRICS_SCOPE, expensive, exportRoutes.ExportMetrics))
+	mux.HandleFunc("/stream", protect(model.READ_METRICS_SCOPE, cheap, streamRoutes.StreamMetrics))
+	mux.HandleFunc("/ws", protect(model.READ_METRICS_SCOPE, cheap, socketRoutes.Subscribe))
+	mux.HandleFunc("/metrics/energy", protect(model.READ_METRICS_SCOPE, cheap, gaugeRoutes.GetEnergyGauges))
+	mux.HandleFunc("GET /admin/keys", protect(model.ADMIN_KEYS_SCOPE, cheap, keyRoutes.GetKeys))
+	mux.HandleFunc("POST /admin/keys", protect(model.ADMIN_KEYS_SCOPE, cheap, keyRoutes.CreateKey))
+	mux.HandleFunc("DELETE /admin/keys/{id}", protect(model.ADMIN_KEYS_SCOPE, cheap, keyRoutes.RevokeKey))
+	mux.Handle("/openapi.json", spec)
+	mux.HandleFunc("GET /healthz", health.Live)
+	mux.HandleFunc("GET /readyz", checker.Ready)
+
+	// probes and scrapes only show up in the access log when they fail
+	middlewares := []server.Middleware{
+		telemetry.AccessLog("/healthz", "/readyz", "/metrics/energy"),
+		corsHandler,
+	}
+	if os.Getenv("ZENDO_ENV") == "test" {
+		// catch responses drifting from the document while the tests run
+		middlewares = append(middlewares, openapi.ValidateResponses(spec))
+	}
 
 	// configure server
-	server := &http.Server{
-		Addr:         ":8081",
-		Handler:      corsHandler(mux),
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+	timeouts, err := server.TimeoutsFromEnv()
+	if err != nil {
+		log.Fatalln("Failed to setup server:", err)
+	}
+	// telemetry has its own port so it isn't published with the public routes
+	metricsServer := telemetry.MetricsServerFromEnv(":9081", timeouts)
+	go func() {
+		if err := metricsServer.Run(); err != nil {
+			zap.L().Error("Metrics server failed", zap.Error(err))
+		}
+	}()
+
+	apiServer := server.Server{
+		Addr:       ":8081",
+		Handler:    server.Chain(telemetry.Instrument(mux), middlewares...),
+		Timeouts:   timeouts,
+		OnShutdown: []func(){stopStreams},
 	}
 
-	zap.L().Info("Server starting", zap.String("addr", server.Addr))
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal("Server failed to start:", err)
+	if err := apiServer.Run(); err != nil {
+		log.Fatal("Server failed:", err)
 	}
 }
@@ -0,0 +1,116 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"zendo/api/routes"
+	"zendo/lib_zendo/telemetry"
+
+	"go.uber.org/zap"
+)
+
+// ValidateResponses checks every response from a JSON operation against the document.
+// A response that doesn't match is logged and replaced with a 500 listing the problems so tests fail loudly.
+// Whole responses are buffered so this is only meant for test runs, streaming operations are passed straight through.
+func ValidateResponses(doc *Document) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			operation := doc.Operation(req.Method, req.URL.Path)
+			if operation == nil || !operation.isJson() {
+				next.ServeHTTP(resp, req)
+				return
+			}
+
+			recorder := &responseRecorder{
+				header: resp.Header(),
+				status: http.StatusOK,
+			}
+			next.ServeHTTP(recorder, req)
+
+			problems := doc.validateResponse(operation, recorder)
+			if len(problems) == 0 {
+				resp.WriteHeader(recorder.status)
+				resp.Write(recorder.body.Bytes())
+				return
+			}
+
+			telemetry.Logger(req.Context()).Error("Response does not match the OpenAPI document",
+				zap.String("path", req.URL.Path),
+				zap.Int("status", recorder.status),
+				zap.Strings("problems", problems),
+			)
+			resp.Header().Del("Content-Length")
+			resp.Header().Set("Content-Type", "application/json")
+			resp.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(resp).Encode(routes.ErrorResponse{
+				Error: "response does not match the OpenAPI document: " + strings.Join(problems, "; "),
+			})
+		})
+	}
+}
+
+// private
+
+func (d *Document) validateResponse(operation *Operation, recorder *responseRecorder) []string {
+	response, ok := operation.Responses[strconv.Itoa(recorder.status)]
+	if !ok {
+		return []string{"status " + strconv.Itoa(recorder.status) + " is not documented"}
+	}
+
+	media, ok := response.Content["application/json"]
+	if !ok {
+		if recorder.body.Len() > 0 {
+			return []string{"status " + strconv.Itoa(recorder.status) + " should not have a body"}
+		}
+		return nil
+	}
+
+	if contentType := recorder.header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+		return []string{"content type " + contentType + " is not application/json"}
+	}
+
+	var body any
+	if err := json.Unmarshal(recorder.body.Bytes(), &body); err != nil {
+		return []string{"body is not valid JSON"}
+	}
+
+	return d.Components.Validate(media.Schema, body)
+}
+
+// isJson is true when the operation answers success with JSON, anything else may be streamed
+func (o *Operation) isJson() bool {
+	for _, status := range []string{"200", "201"} {
+		if response, ok := o.Responses[status]; ok {
+			_, ok = response.Content["application/json"]
+			return ok
+		}
+	}
+	return false
+}
+
+type responseRecorder struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	r.status = status
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.wroteHeader = true
+	return r.body.Write(data)
+}
@@ -0,0 +1,202 @@
+package openapi
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"zendo/api/ratelimit"
+	"zendo/api/routes"
+	"zendo/lib_zendo/auth"
+	"zendo/lib_zendo/health"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/services"
+)
+
+func TestDocumentedRoutesMatchTheDocument(t *testing.T) {
+	spec := Build("test")
+	server, keys := apiForTest(t, spec)
+
+	later := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	covered := map[*Operation]bool{}
+	for _, test := range []struct {
+		method string
+		path   string
+		key    string
+		header map[string]string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "/energy-summary", keys.reader, nil, "", http.StatusOK},
+		{http.MethodGet, "/energy-summary", keys.reader, map[string]string{"If-Modified-Since": later}, "", http.StatusNotModified},
+		{http.MethodGet, "/energy-summary", "", nil, "", http.StatusUnauthorized},
+		{http.MethodGet, "/historical-data", keys.reader, nil, "", http.StatusOK},
+		{http.MethodGet, "/historical-data?limit=2", keys.reader, nil, "", http.StatusOK},
+		{http.MethodGet, "/historical-data?resolution=1h", keys.reader, nil, "", http.StatusOK},
+		{http.MethodGet, "/historical-data?limit=none", keys.reader, nil, "", http.StatusBadRequest},
+		// the expensive budget runs out here
+		{http.MethodGet, "/historical-data", keys.reader, nil, "", http.StatusTooManyRequests},
+		{http.MethodGet, "/admin/keys", keys.reader, nil, "", http.StatusForbidden},
+		{http.MethodGet, "/admin/keys", keys.admin, nil, "", http.StatusOK},
+		{http.MethodPost, "/admin/keys", keys.admin, nil, `{"name":"dashboard","scopes":["read:metrics"]}`, http.StatusCreated},
+		{http.MethodPost, "/admin/keys", keys.admin, nil, `{"name":"dashboard","scopes":["write:everything"]}`, http.StatusBadRequest},
+		{http.MethodGet, "/healthz", "", nil, "", http.StatusOK},
+		{http.MethodGet, "/readyz", "", nil, "", http.StatusOK},
+		{http.MethodGet, "/openapi.json", "", nil, "", http.StatusOK},
+	} {
+		name := test.method + " " + test.path + " " + http.StatusText(test.status)
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, server.URL+test.path, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(test.key) > 0 {
+				req.Header.Set("X-API-Key", test.key)
+			}
+			for name, value := range test.header {
+				req.Header.Set(name, value)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, resp.StatusCode, body)
+			}
+		})
+
+		path, _, _ := strings.Cut(test.path, "?")
+		if operation := spec.Operation(test.method, path); operation != nil {
+			covered[operation] = true
+		}
+	}
+
+	// a new JSON operation needs a case above
+	for path, item := range spec.Paths {
+		for _, operation := range []*Operation{item.Get, item.Post, item.Delete} {
+			if operation != nil && operation.isJson() && !strings.Contains(path, "{") && !covered[operation] {
+				t.Errorf("%s %s is not covered", path, operation.OperationId)
+			}
+		}
+	}
+}
+
+func TestValidateResponsesRejectsUndocumentedResponses(t *testing.T) {
+	spec := Build("test")
+
+	for _, test := range []struct {
+		name    string
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"wrong type", "/energy-summary", func(resp http.ResponseWriter, req *http.Request) {
+			resp.Header().Set("Content-Type", "application/json")
+			resp.Write([]byte(`{"timestamp":5}`))
+		}},
+		{"missing required field", "/admin/keys", func(resp http.ResponseWriter, req *http.Request) {
+			resp.Header().Set("Content-Type", "application/json")
+			resp.Write([]byte(`[{"id":"abc","name":"dashboard"}]`))
+		}},
+		{"undocumented status", "/energy-summary", func(resp http.ResponseWriter, req *http.Request) {
+			resp.WriteHeader(http.StatusTeapot)
+		}},
+		{"not JSON", "/healthz", func(resp http.ResponseWriter, req *http.Request) {
+			resp.Header().Set("Content-Type", "text/plain")
+			resp.Write([]byte("ok"))
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			ValidateResponses(spec)(test.handler).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+			if recorder.Code != http.StatusInternalServerError {
+				t.Fatalf("expected the response to be replaced with a 500, got %d", recorder.Code)
+			}
+			var body routes.ErrorResponse
+			if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil || !strings.Contains(body.Error, "does not match the OpenAPI document") {
+				t.Fatalf("expected the problems in an error response, got %q", recorder.Body.String())
+			}
+		})
+	}
+
+	// streams aren't buffered so aren't checked
+	recorder := httptest.NewRecorder()
+	stream := func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/csv")
+		resp.Write([]byte("timestamp\n"))
+	}
+	ValidateResponses(spec)(http.HandlerFunc(stream)).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/export", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "timestamp\n" {
+		t.Fatalf("expected the export to pass through, got %d %q", recorder.Code, recorder.Body.String())
+	}
+}
+
+// private
+
+type keysForTest struct {
+	reader string
+	admin  string
+}
+
+// apiForTest serves the JSON routes as main wires them, over a day of demo data in memory, behind ValidateResponses
+func apiForTest(t *testing.T, spec *Document) (*httptest.Server, keysForTest) {
+	t.Helper()
+	ctx := context.Background()
+
+	dataService := services.NewMemoryDataService()
+	// a feed that is already stopped seeds its history and returns
+	stopped, stop := context.WithCancel(ctx)
+	stop()
+	if err := (&services.DemoFeed{DataService: dataService}).Run(stopped); err != nil {
+		t.Fatal(err)
+	}
+
+	apiKeys := &services.ApiKeyService{Store: dataService}
+	var keys keysForTest
+	var err error
+	if keys.reader, _, err = apiKeys.CreateApiKey(ctx, "reader", []string{model.READ_METRICS_SCOPE}); err != nil {
+		t.Fatal(err)
+	}
+	if keys.admin, _, err = apiKeys.CreateApiKey(ctx, "admin", model.SCOPES); err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator := auth.Authenticator{ApiKeys: apiKeys}
+	perIp := &ratelimit.Limiter{Name: "ip", Requests: 100, Window: time.Hour}
+	protect := func(scope string, limiter *ratelimit.Limiter, next http.HandlerFunc) http.HandlerFunc {
+		return perIp.Limit(authenticator.Require(scope, limiter.Limit(next)))
+	}
+	cheap := &ratelimit.Limiter{Name: "cheap", Requests: 100, Window: time.Hour}
+	expensive := &ratelimit.Limiter{Name: "expensive", Requests: 4, Window: time.Hour}
+	dataRoutes := routes.DataRoutes{
+		DataService:   dataService,
+		RollupService: &services.RollupService{DataService: dataService},
+	}
+	keyRoutes := routes.KeyRoutes{ApiKeys: apiKeys}
+	checker := health.Checker{
+		Checks: append(health.StorageChecks(dataService),
+			health.FreshnessCheck("aggregated-data", time.Hour, health.LatestMetricTime(dataService)),
+		),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/energy-summary", protect(model.READ_METRICS_SCOPE, cheap, dataRoutes.GetLatestMetric))
+	mux.HandleFunc("/historical-data", protect(model.READ_METRICS_SCOPE, expensive, dataRoutes.GetTimeSeriesMetrics))
+	mux.HandleFunc("GET /admin/keys", protect(model.ADMIN_KEYS_SCOPE, cheap, keyRoutes.GetKeys))
+	mux.HandleFunc("POST /admin/keys", protect(model.ADMIN_KEYS_SCOPE, cheap, keyRoutes.CreateKey))
+	mux.Handle("/openapi.json", spec)
+	mux.HandleFunc("GET /healthz", health.Live)
+	mux.HandleFunc("GET /readyz", checker.Ready)
+
+	server := httptest.NewServer(ValidateResponses(spec)(mux))
+	t.Cleanup(server.Close)
+	return server, keys
+}
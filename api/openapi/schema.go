@@ -0,0 +1,161 @@
+package openapi
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Schema is the subset of the OpenAPI 3 schema object the api needs
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+}
+
+// Components holds the named schemas and security schemes that the rest of the document refers to
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme,omitempty"`
+	Name        string `json:"name,omitempty"`
+	In          string `json:"in,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// SchemaOf returns the schema for the Go type of value, named structs are added to the components and referenced.
+// Fields follow their json tags the same way encoding/json does, fields without omitempty are required.
+func (c *Components) SchemaOf(value any) *Schema {
+	return c.schemaOf(reflect.TypeOf(value))
+}
+
+// Resolve follows a $ref to the named schema
+func (c *Components) Resolve(schema *Schema) *Schema {
+	for schema != nil && len(schema.Ref) > 0 {
+		schema = c.Schemas[strings.TrimPrefix(schema.Ref, refPrefix)]
+	}
+	return schema
+}
+
+// private
+
+const refPrefix string = "#/components/schemas/"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (c *Components) schemaOf(t reflect.Type) *Schema {
+	if t.Kind() == reflect.Pointer {
+		schema := c.schemaOf(t.Elem())
+		if len(schema.Ref) > 0 {
+			// siblings of $ref are ignored in OpenAPI 3.0 so wrap it to mark it nullable
+			return &Schema{AllOf: []*Schema{schema}, Nullable: true}
+		}
+		schema.Nullable = true
+		return schema
+	}
+
+	if t == timeType {
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int, reflect.Int64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Uint8:
+		return &Schema{Type: "integer", Format: "int32", Minimum: bound(0), Maximum: bound(255)}
+	case reflect.Uint16, reflect.Uint32, reflect.Uint, reflect.Uint64:
+		// uint32 overflows int32 so these are all int64 with a lower bound
+		return &Schema{Type: "integer", Format: "int64", Minimum: bound(0)}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: c.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: c.schemaOf(t.Elem())}
+	case reflect.Struct:
+		return c.structSchema(t)
+	}
+
+	// interfaces can hold anything
+	return &Schema{}
+}
+
+func (c *Components) structSchema(t reflect.Type) *Schema {
+	name := t.Name()
+	if len(name) > 0 {
+		if c.Schemas == nil {
+			c.Schemas = map[string]*Schema{}
+		}
+		if _, ok := c.Schemas[name]; !ok {
+			// reserve the name first so recursive types terminate
+			c.Schemas[name] = &Schema{}
+			*c.Schemas[name] = *c.objectSchema(t)
+		}
+		return &Schema{Ref: refPrefix + name}
+	}
+
+	return c.objectSchema(t)
+}
+
+func (c *Components) objectSchema(t reflect.Type) *Schema {
+	schema := &Schema{
+		Type:       "object",
+		Properties: map[string]*Schema{},
+	}
+	c.addFields(schema, t)
+	return schema
+}
+
+// addFields adds the json fields of t to schema, flattening embedded structs as encoding/json does
+func (c *Components) addFields(schema *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && len(name) == 0 && field.Type.Kind() == reflect.Struct {
+			c.addFields(schema, field.Type)
+			continue
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+
+		schema.Properties[name] = c.schemaOf(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+}
+
+func bound(value float64) *float64 {
+	return &value
+}
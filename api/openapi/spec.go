@@ -0,0 +1,406 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"zendo/api/routes"
+	"zendo/lib_zendo/health"
+	"zendo/lib_zendo/model"
+
+	"go.uber.org/zap"
+)
+
+const VERSION string = "3.0.3"
+
+type Document struct {
+	OpenApi    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type PathItem struct {
+	Get    *Operation `json:"get,omitempty"`
+	Post   *Operation `json:"post,omitempty"`
+	Delete *Operation `json:"delete,omitempty"`
+}
+
+type Operation struct {
+	OperationId string                `json:"operationId"`
+	Summary     string                `json:"summary"`
+	Description string                `json:"description,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+	Scope       string                `json:"x-required-scope,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required,omitempty"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Headers     map[string]*Header   `json:"headers,omitempty"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type Header struct {
+	Description string  `json:"description,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Build describes the api from the Go types it serves, so the document can't drift from the responses
+func Build(version string) *Document {
+	doc := &Document{
+		OpenApi: VERSION,
+		Info: Info{
+			Title:       "Zendo Energy Dashboard API",
+			Description: "Energy production and consumption metrics for the grid zone, combined with the local weather.",
+			Version:     version,
+		},
+		Paths: map[string]*PathItem{},
+	}
+	c := &doc.Components
+	c.SecuritySchemes = map[string]*SecurityScheme{
+		bearerScheme: {Type: "http", Scheme: "bearer", Description: "an api key, or a JWT from SSO when the api is configured for it"},
+		apiKeyScheme: {Type: "apiKey", Name: "X-API-Key", In: "header"},
+	}
+
+	metric := c.SchemaOf(model.Metric{})
+	errorResponse := jsonResponse("The request was invalid", c.SchemaOf(routes.ErrorResponse{}))
+	dependencyResponses := map[string]*Response{
+		"424": {Description: "Storage failed"},
+		"504": {Description: "Storage took too long to answer"},
+	}
+	rateLimited := jsonResponse("The client or its IP has used its budget for this kind of request", c.SchemaOf(routes.ErrorResponse{}))
+	rateLimited.Headers = map[string]*Header{
+		"Retry-After":         {Description: "seconds until the next request is allowed", Schema: &Schema{Type: "integer"}},
+		"RateLimit-Policy":    {Description: "the budget as limit;w=window seconds", Schema: &Schema{Type: "string"}},
+		"RateLimit-Limit":     {Description: "requests allowed in a burst", Schema: &Schema{Type: "integer"}},
+		"RateLimit-Remaining": {Description: "requests left", Schema: &Schema{Type: "integer"}},
+		"RateLimit-Reset":     {Description: "seconds until the whole budget is available again", Schema: &Schema{Type: "integer"}},
+	}
+	// every route spends the IP's rate limit, then checks the api key, which reads storage, then spends the client's rate limit
+	authResponses := with(dependencyResponses, map[string]*Response{
+		"401": jsonResponse("No credential, or the key or token is invalid, expired or revoked", c.SchemaOf(routes.ErrorResponse{})),
+		"403": jsonResponse("The key or token doesn't have the scope", c.SchemaOf(routes.ErrorResponse{})),
+		"429": rateLimited,
+	})
+
+	validators := map[string]*Header{
+		"ETag":          {Description: "changes when a newer metric arrives", Schema: &Schema{Type: "string"}},
+		"Last-Modified": {Description: "timestamp of the metric", Schema: &Schema{Type: "string"}},
+	}
+	latest := jsonResponse("The latest metric", metric)
+	latest.Headers = validators
+
+	doc.Paths["/energy-summary"] = &PathItem{
+		Get: &Operation{
+			OperationId: "getLatestMetric",
+			Security:    keyRequired,
+			Scope:       model.READ_METRICS_SCOPE,
+			Summary:     "The most recent metric",
+			Description: "Send the ETag back in If-None-Match to get a 304 until a newer metric arrives.",
+			Parameters: []Parameter{
+				{Name: "If-None-Match", In: "header", Description: "ETag of the metric already held", Schema: &Schema{Type: "string"}},
+				{Name: "If-Modified-Since", In: "header", Description: "ignored when If-None-Match is sent", Schema: &Schema{Type: "string"}},
+			},
+			Responses: with(authResponses, map[string]*Response{
+				"200": latest,
+				"304": {Description: "The client already has the latest metric", Headers: validators},
+				"404": {Description: "No metrics have been written yet"},
+			}),
+		},
+	}
+
+	doc.Paths["/historical-data"] = &PathItem{
+		Get: &Operation{
+			OperationId: "getHistoricalMetrics",
+			Security:    keyRequired,
+			Scope:       model.READ_METRICS_SCOPE,
+			Summary:     "Metrics in a time range",
+			Description: "Without any parameters this is the last 24 hours, newest first. " +
+				"With limit the results are paged, follow X-Next-Cursor or the Link header for the next page. " +
+				"With resolution the range is downsampled into buckets and the whole range is returned at once.",
+			Parameters: append(rangeParameters(),
+				Parameter{Name: "limit", In: "query", Description: "page size", Schema: &Schema{Type: "integer", Minimum: bound(1), Maximum: bound(10000)}},
+				Parameter{Name: "cursor", In: "query", Description: "opaque cursor from X-Next-Cursor, replaces every other parameter", Schema: &Schema{Type: "string"}},
+				Parameter{Name: "resolution", In: "query", Description: "downsample into buckets of this size, can't be combined with limit or cursor", Schema: &Schema{Type: "string", Enum: []string{"15m", "1h", "1d"}}},
+			),
+			Responses: with(authResponses, map[string]*Response{
+				"200": {
+					Description: "The metrics in the range, or one rollup per bucket when resolution is set",
+					Headers: map[string]*Header{
+						"X-Total-Count": {Description: "number of results in the whole range", Schema: &Schema{Type: "integer"}},
+						"X-Next-Cursor": {Description: "cursor for the next page, missing on the last page", Schema: &Schema{Type: "string"}},
+						"Link":          {Description: "link to the next page with rel=next", Schema: &Schema{Type: "string"}},
+					},
+					Content: map[string]MediaType{
+						"application/json": {Schema: &Schema{AnyOf: []*Schema{
+							{Type: "array", Items: metric},
+							{Type: "array", Items: c.SchemaOf(model.MetricRollup{})},
+						}}},
+					},
+				},
+				"400": errorResponse,
+			}),
+		},
+	}
+
+	doc.Paths["/export"] = &PathItem{
+		Get: &Operation{
+			OperationId: "exportMetrics",
+			Security:    keyRequired,
+			Scope:       model.READ_METRICS_SCOPE,
+			Summary:     "Stream the metrics in a range as CSV or NDJSON",
+			Description: "Oldest first unless order=desc, limit caps the whole export. " +
+				"The format comes from the format parameter, then the Accept header, then defaults to CSV.",
+			Parameters: append(rangeParameters(),
+				Parameter{Name: "limit", In: "query", Description: "maximum number of rows", Schema: &Schema{Type: "integer", Minimum: bound(1), Maximum: bound(10000)}},
+				Parameter{Name: "format", In: "query", Schema: &Schema{Type: "string", Enum: []string{"csv", "ndjson"}}},
+			),
+			Responses: with(authResponses, map[string]*Response{
+				"200": {
+					Description: "The metrics, one per line",
+					Content: map[string]MediaType{
+						"text/csv":             {Schema: &Schema{Type: "string"}},
+						"application/x-ndjson": {Schema: &Schema{Type: "string", Description: "one Metric per line"}},
+					},
+				},
+				"400": errorResponse,
+				"406": jsonResponse("The requested format isn't supported", c.SchemaOf(routes.ErrorResponse{})),
+			}),
+		},
+	}
+
+	doc.Paths["/stream"] = &PathItem{
+		Get: &Operation{
+			OperationId: "streamMetrics",
+			Security:    keyRequired,
+			Scope:       model.READ_METRICS_SCOPE,
+			Summary:     "Server-Sent Events stream of new metrics",
+			Description: "Each metric event has the metric timestamp as its id and a Metric as its data. " +
+				"Reconnecting with Last-Event-ID replays the metrics missed, a reset event means too many were missed to replay.",
+			Parameters: []Parameter{
+				{Name: "Last-Event-ID", In: "header", Description: "id of the last event received", Schema: &Schema{Type: "string", Format: "date-time"}},
+			},
+			Responses: with(authResponses, map[string]*Response{
+				"200": {
+					Description: "The event stream",
+					Content: map[string]MediaType{
+						"text/event-stream": {Schema: &Schema{Type: "string"}},
+					},
+				},
+			}),
+		},
+	}
+
+	doc.Paths["/ws"] = &PathItem{
+		Get: &Operation{
+			OperationId: "subscribe",
+			Security:    keyRequired,
+			Scope:       model.READ_METRICS_SCOPE,
+			Summary:     "WebSocket of live updates by topic",
+			Description: "Send subscribe or unsubscribe messages with the topics metrics, energy, weather or alerts. " +
+				"The server answers with subscribed and then an event message for each update on those topics.",
+			Responses: with(authResponses, map[string]*Response{
+				"101": {Description: "Switched to the WebSocket protocol"},
+			}),
+		},
+	}
+
+	// sent over the live endpoints rather than as a JSON response so add them explicitly
+	c.SchemaOf(routes.SocketMessage{})
+	c.SchemaOf(model.Alert{})
+	c.SchemaOf(model.LatestEnergeyResponse{})
+	c.SchemaOf(model.WeatherResponse{})
+
+	key := c.SchemaOf(routes.KeyResponse{})
+	doc.Paths["/admin/keys"] = &PathItem{
+		Get: &Operation{
+			OperationId: "getKeys",
+			Summary:     "Every api key, including revoked keys",
+			Security:    keyRequired,
+			Scope:       model.ADMIN_KEYS_SCOPE,
+			Responses: with(authResponses, map[string]*Response{
+				"200": jsonResponse("The keys, without their secrets", &Schema{Type: "array", Items: key}),
+			}),
+		},
+		Post: &Operation{
+			OperationId: "createKey",
+			Summary:     "Create an api key",
+			Description: "The response holds the only copy of the full key, only a hash of it is stored.",
+			Security:    keyRequired,
+			Scope:       model.ADMIN_KEYS_SCOPE,
+			RequestBody: &RequestBody{
+				Required: true,
+				Content: map[string]MediaType{
+					"application/json": {Schema: c.SchemaOf(routes.CreateKeyRequest{})},
+				},
+			},
+			Responses: with(authResponses, map[string]*Response{
+				"201": jsonResponse("The new key", c.SchemaOf(routes.CreatedKeyResponse{})),
+				"400": errorResponse,
+			}),
+		},
+	}
+	c.Schemas["CreateKeyRequest"].Properties["scopes"].Items.Enum = model.SCOPES
+
+	doc.Paths["/admin/keys/{id}"] = &PathItem{
+		Delete: &Operation{
+			OperationId: "revokeKey",
+			Summary:     "Revoke an api key",
+			Security:    keyRequired,
+			Scope:       model.ADMIN_KEYS_SCOPE,
+			Parameters: []Parameter{
+				{Name: "id", In: "path", Required: true, Schema: &Schema{Type: "string"}},
+			},
+			Responses: with(authResponses, map[string]*Response{
+				"204": {Description: "The key was revoked"},
+				"404": {Description: "There is no key with that id"},
+			}),
+		},
+	}
+
+	report := c.SchemaOf(health.Report{})
+	c.Schemas["Report"].Properties["status"].Enum = []string{health.OK_STATUS, health.DEGRADED_STATUS, health.FAILED_STATUS}
+	c.Schemas["CheckResult"].Properties["status"].Enum = []string{health.OK_STATUS, health.FAILED_STATUS}
+	doc.Paths["/healthz"] = &PathItem{
+		Get: &Operation{
+			OperationId: "getLiveness",
+			Summary:     "Whether the process is up, for liveness probes",
+			Responses: map[string]*Response{
+				"200": jsonResponse("The process is up", report),
+			},
+		},
+	}
+
+	doc.Paths["/readyz"] = &PathItem{
+		Get: &Operation{
+			OperationId: "getReadiness",
+			Summary:     "Whether the api can serve requests, for readiness probes",
+			Description: "Checks storage can be reached and is set up, and how old the latest aggregated metric is. " +
+				"Stale data only makes the status degraded, a failed critical check answers 503.",
+			Responses: map[string]*Response{
+				"200": jsonResponse("Every critical check passed", report),
+				"503": jsonResponse("A critical check failed", report),
+			},
+		},
+	}
+
+	doc.Paths["/metrics/energy"] = &PathItem{
+		Get: &Operation{
+			OperationId: "getEnergyGauges",
+			Security:    keyRequired,
+			Scope:       model.READ_METRICS_SCOPE,
+			Summary:     "The latest metric as Prometheus gauges",
+			Description: "Production and consumption by source, totals, net balance, weather and correlations from the latest aggregated metric, " +
+				"read from storage on each scrape. There are no series until the first metric is aggregated.",
+			Responses: with(authResponses, map[string]*Response{
+				"200": {
+					Description: "The latest metric as gauges",
+					Content: map[string]MediaType{
+						"text/plain": {Schema: &Schema{Type: "string"}},
+					},
+				},
+			}),
+		},
+	}
+
+	doc.Paths["/openapi.json"] = &PathItem{
+		Get: &Operation{
+			OperationId: "getOpenApi",
+			Summary:     "This document",
+			Responses: map[string]*Response{
+				"200": jsonResponse("The OpenAPI document", &Schema{Type: "object"}),
+			},
+		},
+	}
+
+	return doc
+}
+
+// Operation finds the operation for a method and path, templated paths aren't matched
+func (d *Document) Operation(method string, path string) *Operation {
+	item, ok := d.Paths[path]
+	if !ok {
+		return nil
+	}
+
+	switch method {
+	case http.MethodGet:
+		return item.Get
+	case http.MethodPost:
+		return item.Post
+	case http.MethodDelete:
+		return item.Delete
+	}
+	return nil
+}
+
+func (d *Document) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp).Encode(d); err != nil {
+		zap.L().DPanic("Failed to encode OpenAPI document", zap.Error(err))
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// private
+
+const bearerScheme string = "bearer"
+const apiKeyScheme string = "apiKey"
+
+// keyRequired accepts the key either way, OpenAPI 3.0 only has scopes for OAuth2 so the scope goes in x-required-scope
+var keyRequired = []map[string][]string{
+	{bearerScheme: {}},
+	{apiKeyScheme: {}},
+}
+
+func rangeParameters() []Parameter {
+	return []Parameter{
+		{Name: "from", In: "query", Description: "start of the range, defaults to 24 hours before to", Schema: &Schema{Type: "string", Format: "date-time"}},
+		{Name: "to", In: "query", Description: "end of the range, defaults to now", Schema: &Schema{Type: "string", Format: "date-time"}},
+		{Name: "order", In: "query", Schema: &Schema{Type: "string", Enum: []string{"asc", "desc"}}},
+	}
+}
+
+func jsonResponse(description string, schema *Schema) *Response {
+	return &Response{
+		Description: description,
+		Content: map[string]MediaType{
+			"application/json": {Schema: schema},
+		},
+	}
+}
+
+func with(base map[string]*Response, responses map[string]*Response) map[string]*Response {
+	for status, response := range base {
+		if _, ok := responses[status]; !ok {
+			responses[status] = response
+		}
+	}
+	return responses
+}
@@ -0,0 +1,138 @@
+package openapi
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Validate checks a decoded JSON value against schema, returning a description of every mismatch
+func (c *Components) Validate(schema *Schema, value any) []string {
+	return c.validate(schema, value, "$")
+}
+
+// private
+
+func (c *Components) validate(schema *Schema, value any, path string) []string {
+	schema = c.Resolve(schema)
+	if schema == nil {
+		return nil
+	}
+
+	if value == nil {
+		if schema.Nullable || isEmpty(schema) {
+			return nil
+		}
+		return []string{path + " is null"}
+	}
+
+	problems := []string{}
+	for _, sub := range schema.AllOf {
+		problems = append(problems, c.validate(sub, value, path)...)
+	}
+	if len(schema.AnyOf) > 0 {
+		matched := false
+		for _, sub := range schema.AnyOf {
+			if len(c.validate(sub, value, path)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			problems = append(problems, path+" matches none of the allowed schemas")
+		}
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return append(problems, path+" is not an object")
+		}
+		problems = append(problems, c.validateObject(schema, object, path)...)
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			return append(problems, path+" is not an array")
+		}
+		for i, item := range array {
+			problems = append(problems, c.validate(schema.Items, item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return append(problems, path+" is not a string")
+		}
+		if schema.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				problems = append(problems, path+" is not a date-time")
+			}
+		}
+		if len(schema.Enum) > 0 && !slices.Contains(schema.Enum, str) {
+			problems = append(problems, path+" is not one of the allowed values")
+		}
+	case "integer", "number":
+		number, ok := value.(float64)
+		if !ok {
+			return append(problems, path+" is not a number")
+		}
+		if schema.Type == "integer" && number != math.Trunc(number) {
+			problems = append(problems, path+" is not an integer")
+		}
+		if schema.Minimum != nil && number < *schema.Minimum {
+			problems = append(problems, fmt.Sprintf("%s is below the minimum of %v", path, *schema.Minimum))
+		}
+		if schema.Maximum != nil && number > *schema.Maximum {
+			problems = append(problems, fmt.Sprintf("%s is above the maximum of %v", path, *schema.Maximum))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return append(problems, path+" is not a boolean")
+		}
+	}
+
+	return problems
+}
+
+func (c *Components) validateObject(schema *Schema, object map[string]any, path string) []string {
+	problems := []string{}
+	if schema.Properties == nil && schema.AdditionalProperties == nil {
+		// a bare object allows any properties
+		return problems
+	}
+
+	for _, name := range schema.Required {
+		if _, ok := object[name]; !ok {
+			problems = append(problems, path+"."+name+" is missing")
+		}
+	}
+
+	// sort so the problems come out in a stable order
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		property, ok := schema.Properties[name]
+		if !ok {
+			property = schema.AdditionalProperties
+		}
+		if property == nil {
+			// anything not documented is drift just as much as a missing field
+			problems = append(problems, path+"."+name+" is not in the schema")
+			continue
+		}
+		problems = append(problems, c.validate(property, object[name], path+"."+name)...)
+	}
+
+	return problems
+}
+
+// isEmpty is true for the schema that allows any value
+func isEmpty(schema *Schema) bool {
+	return len(schema.Type) == 0 && len(schema.AllOf) == 0 && len(schema.AnyOf) == 0
+}
@@ -0,0 +1,182 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"zendo/api/routes"
+	"zendo/lib_zendo/auth"
+	"zendo/lib_zendo/telemetry"
+
+	"go.uber.org/zap"
+)
+
+// Limiter is a token bucket per client. Each bucket holds Requests tokens and refills completely over Window,
+// so a client can burst that many requests and is then held to a steady Requests per Window.
+// Clients are the authenticated key or token subject, anonymous requests are keyed by IP.
+type Limiter struct {
+	Name     string
+	Requests int
+	Window   time.Duration
+	// TrustProxy takes the client IP from the last X-Forwarded-For hop, only set it behind a proxy that appends it
+	TrustProxy bool
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	sweptAt time.Time
+}
+
+// LimiterFromEnv reads a limit like 30/m from variable, falling back to fallback when it is unset.
+// The units are s, m and h, "off" returns nil which doesn't limit.
+func LimiterFromEnv(name string, variable string, fallback string) (*Limiter, error) {
+	setting := os.Getenv(variable)
+	if len(setting) == 0 {
+		setting = fallback
+	}
+	if setting == "off" {
+		return nil, nil
+	}
+
+	count, unit, ok := strings.Cut(setting, "/")
+	limit, err := strconv.Atoi(count)
+	window, known := units[unit]
+	if !ok || err != nil || limit < 1 || !known {
+		return nil, fmt.Errorf("invalid %s: %s, expected a limit like 30/m", variable, setting)
+	}
+
+	return &Limiter{
+		Name:       name,
+		Requests:   limit,
+		Window:     window,
+		TrustProxy: os.Getenv("RATE_LIMIT_TRUST_PROXY") == "true",
+	}, nil
+}
+
+// Limit answers 429 once the client's bucket is empty. Inside auth.Require it counts the principal, outside it counts
+// the IP before the credential is checked. A nil limiter passes every request through.
+func (l *Limiter) Limit(next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+
+	return func(resp http.ResponseWriter, req *http.Request) {
+		client := l.client(req)
+		allowed, remaining, reset, retryAfter := l.take(client, time.Now())
+
+		header := resp.Header()
+		header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", l.Requests, int(l.Window.Seconds())))
+		header.Set("RateLimit-Limit", strconv.Itoa(l.Requests))
+		header.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		header.Set("RateLimit-Reset", strconv.Itoa(seconds(reset)))
+
+		if !allowed {
+			telemetry.Logger(req.Context()).Info("Rate limited", zap.String("limiter", l.Name), zap.String("client", client), zap.String("path", req.URL.Path))
+			header.Set("Retry-After", strconv.Itoa(seconds(retryAfter)))
+			header.Set("Content-Type", "application/json")
+			resp.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(resp).Encode(routes.ErrorResponse{
+				Error: "rate limit exceeded, retry after " + strconv.Itoa(seconds(retryAfter)) + "s",
+			})
+			return
+		}
+
+		next(resp, req)
+	}
+}
+
+// private
+
+var units = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take spends a token from the client's bucket. It returns the whole requests left, how long until the bucket is full
+// again and, when the request isn't allowed, how long until the next token.
+func (l *Limiter) take(client string, now time.Time) (bool, int, time.Duration, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: float64(l.Requests), updated: now}
+		l.buckets[client] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.updated = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+
+	perToken := l.Window / time.Duration(l.Requests)
+	reset := time.Duration((float64(l.Requests) - b.tokens) * float64(perToken))
+	retryAfter := time.Duration(0)
+	if !allowed {
+		retryAfter = time.Duration((1 - b.tokens) * float64(perToken))
+	}
+
+	return allowed, int(b.tokens), reset, retryAfter
+}
+
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	refilled := b.tokens + float64(l.Requests)*now.Sub(b.updated).Seconds()/l.Window.Seconds()
+	return math.Min(refilled, float64(l.Requests))
+}
+
+// sweep drops the buckets that have refilled, they are the same as a new bucket, so idle clients don't pile up
+func (l *Limiter) sweep(now time.Time) {
+	if l.buckets == nil {
+		l.buckets = map[string]*bucket{}
+	}
+	if now.Sub(l.sweptAt) < l.Window {
+		return
+	}
+	l.sweptAt = now
+
+	for client, b := range l.buckets {
+		if l.refill(b, now) >= float64(l.Requests) {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+func (l *Limiter) client(req *http.Request) string {
+	if principal := auth.PrincipalFrom(req.Context()); principal != nil && principal.Id != auth.ANONYMOUS_PRINCIPAL {
+		return "principal:" + principal.Id
+	}
+
+	if l.TrustProxy {
+		hops := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+		if hop := strings.TrimSpace(hops[len(hops)-1]); len(hop) > 0 {
+			return "ip:" + hop
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return "ip:" + req.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// seconds rounds up so a client waiting that long will find a token
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
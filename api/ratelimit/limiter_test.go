@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"zendo/lib_zendo/auth"
+)
+
+func TestLimitBeforeAuthCountsTheIp(t *testing.T) {
+	perIp := &Limiter{Name: "ip", Requests: 2, Window: time.Hour}
+	authenticated := 0
+	// stands in for auth.Require, which reads storage to check the key
+	handler := perIp.Limit(func(resp http.ResponseWriter, req *http.Request) {
+		authenticated++
+	})
+
+	statuses := []int{}
+	for _, key := range []string{"bad-1", "bad-2", "bad-3"} {
+		statuses = append(statuses, serveForTest(handler, "203.0.113.7:1234", key, nil))
+	}
+	if statuses[2] != http.StatusTooManyRequests {
+		t.Fatalf("expected the third request from the IP to be limited whatever its key, got %v", statuses)
+	}
+	if authenticated != 2 {
+		t.Fatalf("expected the limited request not to reach auth, it was reached %d times", authenticated)
+	}
+
+	if status := serveForTest(handler, "198.51.100.1:1234", "bad-4", nil); status != http.StatusOK {
+		t.Fatalf("expected another IP to have its own budget, got %d", status)
+	}
+}
+
+func TestLimitAfterAuthCountsThePrincipal(t *testing.T) {
+	limiter := &Limiter{Name: "cheap", Requests: 1, Window: time.Hour}
+	handler := limiter.Limit(func(resp http.ResponseWriter, req *http.Request) {})
+	first := &auth.Principal{Id: "key-1"}
+	second := &auth.Principal{Id: "key-2"}
+	anonymous := &auth.Principal{Id: auth.ANONYMOUS_PRINCIPAL}
+
+	for _, test := range []struct {
+		name      string
+		principal *auth.Principal
+		addr      string
+		status    int
+	}{
+		{"first key", first, "203.0.113.7:1234", http.StatusOK},
+		{"first key from another IP", first, "198.51.100.1:1234", http.StatusTooManyRequests},
+		{"second key from the same IP", second, "203.0.113.7:1234", http.StatusOK},
+		{"anonymous", anonymous, "203.0.113.7:1234", http.StatusOK},
+		{"anonymous from the same IP", anonymous, "203.0.113.7:5678", http.StatusTooManyRequests},
+	} {
+		if status := serveForTest(handler, test.addr, "", test.principal); status != test.status {
+			t.Fatalf("%s: expected %d, got %d", test.name, test.status, status)
+		}
+	}
+}
+
+func TestLimitTrustsTheLastProxyHop(t *testing.T) {
+	limiter := &Limiter{Name: "ip", Requests: 1, Window: time.Hour, TrustProxy: true}
+	req := httptest.NewRequest(http.MethodGet, "/energy-summary", nil)
+	req.Header.Set("X-Forwarded-For", "10.0.0.1, 203.0.113.7")
+
+	if client := limiter.client(req); client != "ip:203.0.113.7" {
+		t.Fatalf("expected the hop the proxy appended, got %s", client)
+	}
+}
+
+// private
+
+func serveForTest(handler http.HandlerFunc, addr string, key string, principal *auth.Principal) int {
+	req := httptest.NewRequest(http.MethodGet, "/energy-summary", nil)
+	req.RemoteAddr = addr
+	if len(key) > 0 {
+		req.Header.Set("X-API-Key", key)
+	}
+	if principal != nil {
+		req = req.WithContext(auth.WithPrincipal(req.Context(), principal))
+	}
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, req)
+	return recorder.Code
+}
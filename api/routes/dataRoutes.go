@@ -1,22 +1,30 @@
 package routes
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 	"zendo/lib_zendo/services"
+	"zendo/lib_zendo/telemetry"
 
 	"go.uber.org/zap"
 )
 
 type DataRoutes struct {
-	DataService services.IDataService
+	DataService   services.IDataService
+	RollupService services.IRollupService
 }
 
 func (r *DataRoutes) GetLatestMetric(resp http.ResponseWriter, req *http.Request) {
-	metric, err := r.DataService.GetLatestMetric()
+	metric, err := r.DataService.GetLatestMetric(req.Context())
 	if err != nil {
-		zap.L().DPanic("Failed to get latest metric", zap.Error(err))
-		resp.WriteHeader(http.StatusFailedDependency)
+		writeDependencyError(resp, req, "Failed to get latest metric", err)
 		return
 	}
 
@@ -25,27 +33,256 @@ func (r *DataRoutes) GetLatestMetric(resp http.ResponseWriter, req *http.Request
 		return
 	}
 
+	// a metric is never rewritten once aggregated so its timestamp identifies it
+	if metric.Timestamp != nil && notModified(resp, req, *metric.Timestamp) {
+		return
+	}
+
 	resp.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(resp).Encode(metric); err != nil {
-		zap.L().DPanic("Failed to encode metric", zap.Error(err))
+		telemetry.Logger(req.Context()).DPanic("Failed to encode metric", zap.Error(err))
 		resp.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
 
 func (r *DataRoutes) GetTimeSeriesMetrics(resp http.ResponseWriter, req *http.Request) {
-	// TODO: Really want pagination here
-	metrics, err := r.DataService.Get24HoursOfMetrics()
+	if resolution := req.URL.Query().Get("resolution"); len(resolution) > 0 {
+		r.getDownsampledMetrics(resp, req, resolution)
+		return
+	}
+
+	var query services.MetricsRangeQuery
+	var err error
+	if cursor := req.URL.Query().Get("cursor"); len(cursor) > 0 {
+		// the cursor carries the original range so the other params are not needed
+		query, err = decodeCursor(cursor)
+	} else {
+		query, err = parseRangeQuery(req)
+	}
 	if err != nil {
-		zap.L().DPanic("Failed to get time serires metrics", zap.Error(err))
-		resp.WriteHeader(http.StatusFailedDependency)
+		writeBadRequest(resp, err)
+		return
+	}
+
+	page, err := r.DataService.GetMetricsInRange(req.Context(), query)
+	if err != nil {
+		writeDependencyError(resp, req, "Failed to get time serires metrics", err)
 		return
 	}
 
+	// page metadata goes in headers so the body stays a plain array of metrics
+	resp.Header().Set("X-Total-Count", strconv.Itoa(page.TotalCount))
+	if page.NextCursor != nil {
+		query.StartAt = page.NextCursor
+		cursor := encodeCursor(query)
+		resp.Header().Set("X-Next-Cursor", cursor)
+		resp.Header().Set("Link", "<"+req.URL.Path+"?cursor="+cursor+">; rel=\"next\"")
+	}
+
 	resp.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(resp).Encode(metrics); err != nil {
-		zap.L().DPanic("Failed to encode metrics", zap.Error(err))
+	if err := json.NewEncoder(resp).Encode(page.Metrics); err != nil {
+		telemetry.Logger(req.Context()).DPanic("Failed to encode metrics", zap.Error(err))
 		resp.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// private
+
+const (
+	defaultRange time.Duration = 24 * time.Hour
+	maxLimit     int           = 10000
+)
+
+// getDownsampledMetrics answers with one rollup per bucket instead of the raw metrics, the whole range is returned at once
+func (r *DataRoutes) getDownsampledMetrics(resp http.ResponseWriter, req *http.Request, resolution string) {
+	size, ok := services.RollupResolutions[resolution]
+	if !ok {
+		writeBadRequest(resp, fmt.Errorf("resolution must be 15m, 1h or 1d"))
+		return
+	}
+
+	params := req.URL.Query()
+	if len(params.Get("cursor")) > 0 || len(params.Get("limit")) > 0 {
+		writeBadRequest(resp, fmt.Errorf("cursor and limit can not be used with resolution"))
+		return
+	}
+
+	query, err := parseRangeQuery(req)
+	if err != nil {
+		writeBadRequest(resp, err)
+		return
+	}
+	if int(query.To.Sub(query.From)/size) > maxLimit {
+		writeBadRequest(resp, fmt.Errorf("range covers more than %d buckets, use a coarser resolution", maxLimit))
+		return
+	}
+
+	rollups, err := r.RollupService.GetRollups(req.Context(), resolution, query)
+	if err != nil {
+		writeDependencyError(resp, req, "Failed to get downsampled metrics", err)
+		return
+	}
+
+	resp.Header().Set("X-Total-Count", strconv.Itoa(len(*rollups)))
+	resp.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp).Encode(rollups); err != nil {
+		telemetry.Logger(req.Context()).DPanic("Failed to encode rollups", zap.Error(err))
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// parseRangeQuery reads from, to, order and limit from the query string.
+// Without any of them this is the last 24 hours, newest first.
+func parseRangeQuery(req *http.Request) (services.MetricsRangeQuery, error) {
+	params := req.URL.Query()
+	query := services.MetricsRangeQuery{
+		To:         time.Now(),
+		Descending: true,
+	}
+
+	if to := params.Get("to"); len(to) > 0 {
+		parsed, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return query, fmt.Errorf("to must be an RFC3339 timestamp")
+		}
+		query.To = parsed
+	}
+
+	query.From = query.To.Add(-defaultRange)
+	if from := params.Get("from"); len(from) > 0 {
+		parsed, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return query, fmt.Errorf("from must be an RFC3339 timestamp")
+		}
+		query.From = parsed
+	}
+
+	if !query.From.Before(query.To) {
+		return query, fmt.Errorf("from must be before to")
+	}
+
+	switch params.Get("order") {
+	case "", "desc":
+		query.Descending = true
+	case "asc":
+		query.Descending = false
+	default:
+		return query, fmt.Errorf("order must be asc or desc")
+	}
+
+	if limit := params.Get("limit"); len(limit) > 0 {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 || parsed > maxLimit {
+			return query, fmt.Errorf("limit must be between 1 and %d", maxLimit)
+		}
+		query.Limit = parsed
+	}
+
+	return query, nil
+}
+
+// pageCursor is everything needed to fetch the next page, clients treat the encoded form as opaque
+type pageCursor struct {
+	From       time.Time              `json:"from"`
+	To         time.Time              `json:"to"`
+	Descending bool                   `json:"desc"`
+	Limit      int                    `json:"limit"`
+	StartAt    services.MetricsCursor `json:"at"`
+}
+
+func encodeCursor(query services.MetricsRangeQuery) string {
+	data, _ := json.Marshal(pageCursor{
+		From:       query.From,
+		To:         query.To,
+		Descending: query.Descending,
+		Limit:      query.Limit,
+		StartAt:    *query.StartAt,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string) (services.MetricsRangeQuery, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return services.MetricsRangeQuery{}, fmt.Errorf("invalid cursor")
+	}
+
+	var decoded pageCursor
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded.Limit < 1 || decoded.Limit > maxLimit {
+		return services.MetricsRangeQuery{}, fmt.Errorf("invalid cursor")
+	}
+
+	return services.MetricsRangeQuery{
+		From:       decoded.From,
+		To:         decoded.To,
+		Descending: decoded.Descending,
+		Limit:      decoded.Limit,
+		StartAt:    &decoded.StartAt,
+	}, nil
+}
+
+// notModified sets ETag and Last-Modified from modified, then answers 304 when the client already has that version.
+// If-None-Match wins over If-Modified-Since as in RFC 9110.
+func notModified(resp http.ResponseWriter, req *http.Request, modified time.Time) bool {
+	etag := `"` + strconv.FormatInt(modified.UnixNano(), 36) + `"`
+	resp.Header().Set("ETag", etag)
+	resp.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	// the data changes every few minutes so clients should check each time rather than guess a max-age
+	resp.Header().Set("Cache-Control", "no-cache")
+
+	if match := req.Header.Get("If-None-Match"); len(match) > 0 {
+		if !etagMatches(match, etag) {
+			return false
+		}
+	} else if since, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err != nil || modified.Truncate(time.Second).After(since) {
+		return false
+	}
+
+	resp.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches compares weakly, a W/ prefix is ignored as If-None-Match allows
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func writeBadRequest(resp http.ResponseWriter, err error) {
+	writeError(resp, http.StatusBadRequest, err)
+}
+
+func writeError(resp http.ResponseWriter, status int, err error) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	if err := json.NewEncoder(resp).Encode(ErrorResponse{Error: err.Error()}); err != nil {
+		zap.L().Error("Failed to encode error", zap.Error(err))
+	}
+}
+
+// writeDependencyError reports a failed call to storage.
+// A call that ran out of time is a 504, a request the client has already abandoned gets no response.
+func writeDependencyError(resp http.ResponseWriter, req *http.Request, msg string, err error) {
+	switch {
+	case req.Context().Err() != nil:
+		telemetry.Logger(req.Context()).Info("Request cancelled", zap.String("path", req.URL.Path), zap.Error(err))
+	case errors.Is(err, context.DeadlineExceeded):
+		telemetry.Logger(req.Context()).Warn(msg, zap.Error(err))
+		resp.WriteHeader(http.StatusGatewayTimeout)
+	default:
+		telemetry.Logger(req.Context()).DPanic(msg, zap.Error(err))
+		resp.WriteHeader(http.StatusFailedDependency)
+	}
+}
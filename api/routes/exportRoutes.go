@@ -0,0 +1,254 @@
+package routes
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/services"
+	"zendo/lib_zendo/telemetry"
+
+	"go.uber.org/zap"
+)
+
+const (
+	CSV_FORMAT    string = "csv"
+	NDJSON_FORMAT string = "ndjson"
+
+	exportPageSize int = 500
+	// exportWriteTimeout is given to each page so a long export isn't cut off by the server write timeout
+	exportWriteTimeout time.Duration = 30 * time.Second
+)
+
+type ExportRoutes struct {
+	DataService services.IDataService
+}
+
+// ExportMetrics streams the metrics in a range as CSV or NDJSON, oldest first unless order=desc.
+// The format comes from the format param, falling back to the Accept header and then CSV.
+// Metrics are read a page at a time and each page is flushed before the next is fetched so large ranges never sit in memory.
+func (r *ExportRoutes) ExportMetrics(resp http.ResponseWriter, req *http.Request) {
+	format, err := exportFormat(req)
+	if err != nil {
+		writeError(resp, http.StatusNotAcceptable, err)
+		return
+	}
+
+	query, err := parseRangeQuery(req)
+	if err != nil {
+		writeBadRequest(resp, err)
+		return
+	}
+	if len(req.URL.Query().Get("order")) == 0 {
+		query.Descending = false
+	}
+
+	// limit caps the whole export, the pages underneath stay small
+	maxRows := query.Limit
+	query.Limit = exportPageSize
+
+	page, err := r.DataService.GetMetricsInRange(req.Context(), query)
+	if err != nil {
+		writeDependencyError(resp, req, "Failed to get metrics to export", err)
+		return
+	}
+
+	controller := http.NewResponseController(resp)
+	writer := newMetricWriter(format, resp)
+
+	resp.Header().Set("Content-Type", writer.contentType())
+	resp.Header().Set("Content-Disposition", "attachment; filename=\"metrics."+format+"\"")
+	resp.Header().Set("X-Total-Count", strconv.Itoa(page.TotalCount))
+	resp.WriteHeader(http.StatusOK)
+
+	if err := writer.writeHeader(); err != nil {
+		telemetry.Logger(req.Context()).Warn("Failed to write export header", zap.Error(err))
+		return
+	}
+
+	written := 0
+	for {
+		controller.SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+
+		for i := range page.Metrics {
+			if maxRows > 0 && written == maxRows {
+				break
+			}
+			if err := writer.writeMetric(&page.Metrics[i]); err != nil {
+				// the client has most likely gone away
+				telemetry.Logger(req.Context()).Warn("Failed to write export row", zap.Error(err))
+				return
+			}
+			written++
+		}
+
+		if err := writer.flush(); err != nil {
+			telemetry.Logger(req.Context()).Warn("Failed to flush export", zap.Error(err))
+			return
+		}
+		controller.Flush()
+
+		if page.NextCursor == nil || (maxRows > 0 && written == maxRows) {
+			break
+		}
+
+		query.StartAt = page.NextCursor
+		page, err = r.DataService.GetMetricsInRange(req.Context(), query)
+		if err != nil {
+			telemetry.Logger(req.Context()).Error("Failed to get metrics to export, aborting", zap.Int("written", written), zap.Error(err))
+			// the status has already gone out, abort the connection so the client can't mistake a partial export for a whole one
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	telemetry.Logger(req.Context()).Info("Exported metrics", zap.String("format", format), zap.Int("rows", written))
+}
+
+// private
+
+// exportFormat picks the format param, or the first supported type in the Accept header
+func exportFormat(req *http.Request) (string, error) {
+	switch format := req.URL.Query().Get("format"); format {
+	case CSV_FORMAT, NDJSON_FORMAT:
+		return format, nil
+	case "":
+	default:
+		return "", fmt.Errorf("format must be csv or ndjson")
+	}
+
+	accept := req.Header.Get("Accept")
+	if len(accept) == 0 {
+		return CSV_FORMAT, nil
+	}
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		switch mediaType {
+		case "text/csv", "text/*", "*/*":
+			return CSV_FORMAT, nil
+		case "application/x-ndjson", "application/ndjson", "application/*":
+			return NDJSON_FORMAT, nil
+		}
+	}
+
+	return "", fmt.Errorf("accept must allow text/csv or application/x-ndjson")
+}
+
+type metricWriter interface {
+	contentType() string
+	writeHeader() error
+	writeMetric(metric *model.Metric) error
+	flush() error
+}
+
+func newMetricWriter(format string, w io.Writer) metricWriter {
+	if format == NDJSON_FORMAT {
+		return &ndjsonMetricWriter{
+			encoder: json.NewEncoder(w),
+		}
+	}
+
+	return &csvMetricWriter{
+		writer: csv.NewWriter(w),
+	}
+}
+
+type ndjsonMetricWriter struct {
+	encoder *json.Encoder
+}
+
+func (w *ndjsonMetricWriter) contentType() string {
+	return "application/x-ndjson"
+}
+
+func (w *ndjsonMetricWriter) writeHeader() error {
+	return nil
+}
+
+func (w *ndjsonMetricWriter) writeMetric(metric *model.Metric) error {
+	// Encode ends every value with a newline
+	return w.encoder.Encode(metric)
+}
+
+func (w *ndjsonMetricWriter) flush() error {
+	return nil
+}
+
+// csvMetricWriter flattens each metric into one row, sources missing from a metric are left blank
+type csvMetricWriter struct {
+	writer *csv.Writer
+}
+
+func (w *csvMetricWriter) contentType() string {
+	return "text/csv; charset=utf-8"
+}
+
+func (w *csvMetricWriter) writeHeader() error {
+	header := []string{"timestamp", "historical_seed", "total_production", "total_consumption", "net_balance"}
+	for _, source := range model.SOURCE_NAMES {
+		header = append(header, "production_"+strings.ReplaceAll(source, " ", "_"))
+	}
+	for _, source := range model.SOURCE_NAMES {
+		header = append(header, "consumption_"+strings.ReplaceAll(source, " ", "_"))
+	}
+	header = append(header, model.WEATHER_FIELDS...)
+	header = append(header, "solar_irradiance_vs_solar_production_correlation", "temperature_vs_consumption_correlation")
+
+	return w.writer.Write(header)
+}
+
+func (w *csvMetricWriter) writeMetric(metric *model.Metric) error {
+	timestamp := ""
+	if metric.Timestamp != nil {
+		timestamp = metric.Timestamp.UTC().Format(time.RFC3339)
+	}
+
+	row := []string{
+		timestamp,
+		strconv.FormatBool(metric.HistoricalSeed),
+		strconv.FormatUint(uint64(metric.TotalProduction), 10),
+		strconv.FormatUint(uint64(metric.TotalConsumption), 10),
+		strconv.FormatInt(int64(metric.NetBalance), 10),
+	}
+
+	production := metric.PowerProductionData.Sources()
+	for _, source := range model.SOURCE_NAMES {
+		row = append(row, formatSource(production[source]))
+	}
+	consumption := metric.PowerConsumptionData.Sources()
+	for _, source := range model.SOURCE_NAMES {
+		row = append(row, formatSource(consumption[source]))
+	}
+	weather := metric.WeatherData.Fields()
+	for _, field := range model.WEATHER_FIELDS {
+		row = append(row, strconv.FormatFloat(weather[field], 'f', -1, 32))
+	}
+	row = append(row,
+		strconv.FormatFloat(float64(metric.CorrelationData.SolarIrradianceVsSolarProductionCorrelation), 'f', -1, 32),
+		strconv.FormatFloat(float64(metric.CorrelationData.TemperatureVsConsumptionCorrelation), 'f', -1, 32),
+	)
+
+	return w.writer.Write(row)
+}
+
+func (w *csvMetricWriter) flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+func formatSource(value *uint32) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatUint(uint64(*value), 10)
+}
@@ -0,0 +1,119 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/services"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// GaugeRoutes publishes the grid data itself for Prometheus, apart from the service telemetry on /metrics
+type GaugeRoutes struct {
+	DataService services.IDataService
+}
+
+// GetEnergyGauges reads the latest metric on every scrape and serves it as gauges.
+// Sources missing from the breakdown are left out rather than reported as zero, and there are no series until
+// the first metric is aggregated. A storage failure fails the scrape so it shows up as the target being down.
+func (r *GaugeRoutes) GetEnergyGauges(resp http.ResponseWriter, req *http.Request) {
+	metric, err := r.DataService.GetLatestMetric(req.Context())
+	if err != nil {
+		writeDependencyError(resp, req, "Failed to get latest metric for gauges", err)
+		return
+	}
+
+	// a registry per scrape, the gauges only ever hold the metric that was just read
+	registry := prometheus.NewRegistry()
+	if metric != nil {
+		registry.MustRegister(&metricCollector{metric: metric})
+	}
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(resp, req)
+}
+
+// private
+
+var (
+	productionDesc = prometheus.NewDesc("zendo_grid_production_megawatts",
+		"Power produced by source in the latest metric.", []string{"source"}, nil)
+	consumptionDesc = prometheus.NewDesc("zendo_grid_consumption_megawatts",
+		"Power consumed by source in the latest metric.", []string{"source"}, nil)
+	totalProductionDesc = prometheus.NewDesc("zendo_grid_total_production_megawatts",
+		"Power produced across every source in the latest metric.", nil, nil)
+	totalConsumptionDesc = prometheus.NewDesc("zendo_grid_total_consumption_megawatts",
+		"Power consumed across every source in the latest metric.", nil, nil)
+	netBalanceDesc = prometheus.NewDesc("zendo_grid_net_balance_megawatts",
+		"Production less consumption in the latest metric, negative when the grid imports.", nil, nil)
+	temperatureDesc = prometheus.NewDesc("zendo_weather_temperature_celsius",
+		"Temperature at 2m in the latest metric.", nil, nil)
+	radiationDesc = prometheus.NewDesc("zendo_weather_direct_radiation_watts_per_square_meter",
+		"Direct solar radiation in the latest metric.", nil, nil)
+	cloudCoverDesc = prometheus.NewDesc("zendo_weather_cloud_cover_percent",
+		"Cloud cover in the latest metric.", nil, nil)
+	windSpeedDesc = prometheus.NewDesc("zendo_weather_wind_speed_kilometers_per_hour",
+		"Wind speed at 10m in the latest metric.", nil, nil)
+	correlationDesc = prometheus.NewDesc("zendo_correlation_coefficient",
+		"Correlations worked out over the 24 hours before the latest metric.", []string{"pair"}, nil)
+	timestampDesc = prometheus.NewDesc("zendo_latest_metric_timestamp_seconds",
+		"When the latest metric was taken, to tell how old the other gauges are.", nil, nil)
+)
+
+// metricCollector turns one metric into gauges
+type metricCollector struct {
+	metric *model.Metric
+}
+
+func (c *metricCollector) Describe(descs chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		productionDesc, consumptionDesc, totalProductionDesc, totalConsumptionDesc, netBalanceDesc,
+		temperatureDesc, radiationDesc, cloudCoverDesc, windSpeedDesc, correlationDesc, timestampDesc,
+	} {
+		descs <- desc
+	}
+}
+
+func (c *metricCollector) Collect(metrics chan<- prometheus.Metric) {
+	metric := c.metric
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		metrics <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+	}
+
+	// labels follow the export columns
+	production := metric.PowerProductionData.Sources()
+	consumption := metric.PowerConsumptionData.Sources()
+	for _, source := range model.SOURCE_NAMES {
+		label := strings.ReplaceAll(source, " ", "_")
+		if value := production[source]; value != nil {
+			gauge(productionDesc, float64(*value), label)
+		}
+		if value := consumption[source]; value != nil {
+			gauge(consumptionDesc, float64(*value), label)
+		}
+	}
+
+	gauge(totalProductionDesc, float64(metric.TotalProduction))
+	gauge(totalConsumptionDesc, float64(metric.TotalConsumption))
+	gauge(netBalanceDesc, float64(metric.NetBalance))
+
+	gauge(temperatureDesc, fromFloat32(metric.WeatherData.Temperature))
+	gauge(radiationDesc, fromFloat32(metric.WeatherData.DirectRadiation))
+	gauge(cloudCoverDesc, float64(metric.WeatherData.CloudCoverPercent))
+	gauge(windSpeedDesc, fromFloat32(metric.WeatherData.WindSpeedKmPHr))
+
+	gauge(correlationDesc, fromFloat32(metric.CorrelationData.SolarIrradianceVsSolarProductionCorrelation), "solar_irradiance_vs_solar_production")
+	gauge(correlationDesc, fromFloat32(metric.CorrelationData.TemperatureVsConsumptionCorrelation), "temperature_vs_consumption")
+
+	if metric.Timestamp != nil {
+		gauge(timestampDesc, float64(metric.Timestamp.UnixNano())/1e9)
+	}
+}
+
+// fromFloat32 keeps the value as written, float64(0.8) of a float32 would be 0.800000011920929
+func fromFloat32(value float32) float64 {
+	converted, _ := strconv.ParseFloat(strconv.FormatFloat(float64(value), 'g', -1, 32), 64)
+	return converted
+}
@@ -0,0 +1,41 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/services"
+)
+
+func TestEnergyGaugesLabelSourcesLikeTheExport(t *testing.T) {
+	dataService := services.NewMemoryDataService()
+	at := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	discharge := uint32(40)
+	wind := uint32(300)
+	dataService.PostMetric(model.Metric{
+		BaseDocument:         model.BaseDocument{Timestamp: &at},
+		PowerProductionData:  model.PowerProductionBreakdown{Wind: &wind, HydroDischarge: &discharge},
+		PowerConsumptionData: model.PowerConsumptionBreakdown{BatteryDischarge: &discharge},
+	})
+
+	recorder := httptest.NewRecorder()
+	(&GaugeRoutes{DataService: dataService}).GetEnergyGauges(recorder, httptest.NewRequest(http.MethodGet, "/metrics/energy", nil))
+	body := recorder.Body.String()
+
+	for _, series := range []string{
+		`zendo_grid_production_megawatts{source="wind"} 300`,
+		`zendo_grid_production_megawatts{source="hydro_discharge"} 40`,
+		`zendo_grid_consumption_megawatts{source="battery_discharge"} 40`,
+	} {
+		if !strings.Contains(body, series) {
+			t.Fatalf("expected %s in\n%s", series, body)
+		}
+	}
+	// missing sources are left out rather than reported as zero
+	if strings.Contains(body, `source="solar"`) {
+		t.Fatalf("expected no solar series, got\n%s", body)
+	}
+}
@@ -0,0 +1,110 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+	libErrors "zendo/lib_zendo/errors"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/services"
+
+	"go.uber.org/zap"
+)
+
+type KeyRoutes struct {
+	ApiKeys *services.ApiKeyService
+}
+
+type CreateKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// KeyResponse describes a stored key, the hash is never sent
+type KeyResponse struct {
+	Id        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// CreatedKeyResponse carries the full key, it can't be fetched again
+type CreatedKeyResponse struct {
+	KeyResponse
+	Key string `json:"key"`
+}
+
+func (r *KeyRoutes) GetKeys(resp http.ResponseWriter, req *http.Request) {
+	keys, err := r.ApiKeys.GetApiKeys(req.Context())
+	if err != nil {
+		writeDependencyError(resp, req, "Failed to get api keys", err)
+		return
+	}
+
+	body := make([]KeyResponse, len(*keys))
+	for i := range *keys {
+		body[i] = keyResponse(&(*keys)[i])
+	}
+
+	writeJson(resp, http.StatusOK, body)
+}
+
+func (r *KeyRoutes) CreateKey(resp http.ResponseWriter, req *http.Request) {
+	var body CreateKeyRequest
+	if err := json.NewDecoder(http.MaxBytesReader(resp, req.Body, 4096)).Decode(&body); err != nil {
+		writeBadRequest(resp, err)
+		return
+	}
+
+	secret, key, err := r.ApiKeys.CreateApiKey(req.Context(), body.Name, body.Scopes)
+	var validationErr *libErrors.ValidationError
+	if errors.As(err, &validationErr) {
+		writeBadRequest(resp, err)
+		return
+	}
+	if err != nil {
+		writeDependencyError(resp, req, "Failed to create api key", err)
+		return
+	}
+
+	writeJson(resp, http.StatusCreated, CreatedKeyResponse{
+		KeyResponse: keyResponse(key),
+		Key:         secret,
+	})
+}
+
+func (r *KeyRoutes) RevokeKey(resp http.ResponseWriter, req *http.Request) {
+	found, err := r.ApiKeys.RevokeApiKey(req.Context(), req.PathValue("id"))
+	if err != nil {
+		writeDependencyError(resp, req, "Failed to revoke api key", err)
+		return
+	}
+	if !found {
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// private
+
+func keyResponse(key *model.ApiKey) KeyResponse {
+	return KeyResponse{
+		Id:        key.Id,
+		Name:      key.Name,
+		Scopes:    key.Scopes,
+		CreatedAt: key.CreatedAt,
+		RevokedAt: key.RevokedAt,
+	}
+}
+
+func writeJson(resp http.ResponseWriter, status int, body any) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	if err := json.NewEncoder(resp).Encode(body); err != nil {
+		zap.L().Error("Failed to encode response", zap.Error(err))
+	}
+}
@@ -0,0 +1,257 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"zendo/lib_zendo/errors"
+	"zendo/lib_zendo/services"
+	"zendo/lib_zendo/telemetry"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	SUBSCRIBE_MESSAGE   string = "subscribe"
+	UNSUBSCRIBE_MESSAGE string = "unsubscribe"
+	SUBSCRIBED_MESSAGE  string = "subscribed"
+	EVENT_MESSAGE       string = "event"
+	ERROR_MESSAGE       string = "error"
+
+	socketWriteWait time.Duration = 10 * time.Second
+	// a client that doesn't answer a ping within socketPongWait is treated as gone
+	socketPongWait   time.Duration = 60 * time.Second
+	socketPingPeriod time.Duration = socketPongWait * 9 / 10
+	socketMaxMessage int64         = 4096
+	// events queued for one connection before it is dropped for not keeping up
+	socketBufferSize int = 64
+)
+
+type SocketRoutes struct {
+	DataService services.IDataService
+	Hub         *services.EventHub
+	// AllowedOrigins are the other origins whose pages may open a socket, see checkOrigin
+	AllowedOrigins []string
+}
+
+// AllowedOriginsFromEnv reads the comma separated WS_ALLOWED_ORIGINS, e.g. https://dashboard.example.com
+func AllowedOriginsFromEnv() []string {
+	origins := []string{}
+	for _, origin := range strings.Split(os.Getenv("WS_ALLOWED_ORIGINS"), ",") {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if len(origin) > 0 {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// SocketMessage is the envelope for every message in both directions.
+// Clients send subscribe and unsubscribe with the topics to change, the server acknowledges with subscribed
+// and the full set of topics, then sends an event for every update on those topics.
+type SocketMessage struct {
+	Type   string   `json:"type"`
+	Topics []string `json:"topics,omitempty"`
+	Topic  string   `json:"topic,omitempty"`
+	Data   any      `json:"data,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// Subscribe upgrades to a WebSocket that pushes live updates for the topics the client subscribes to
+func (r *SocketRoutes) Subscribe(resp http.ResponseWriter, req *http.Request) {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     r.checkOrigin,
+	}
+	conn, err := upgrader.Upgrade(resp, req, nil)
+	if err != nil {
+		// the upgrader has already written the error response
+		telemetry.Logger(req.Context()).Warn("Failed to upgrade websocket", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	// the handler holds the connection so the request context lasts as long as the socket
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	socket := socketConnection{
+		conn:     conn,
+		requests: make(chan SocketMessage),
+		topics:   map[string]bool{},
+	}
+
+	// only the read loop reads and only this goroutine writes, as the connection allows one of each
+	go socket.readLoop(ctx, cancel)
+
+	events, unsubscribe := r.Hub.SubscribeBuffered(socketBufferSize)
+	defer unsubscribe()
+
+	ping := time.NewTicker(socketPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case request := <-socket.requests:
+			if err := r.handleRequest(ctx, &socket, request); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				if r.Hub.Stopped() {
+					socket.close(websocket.CloseGoingAway, "server shutting down, reconnect to resume")
+				} else {
+					socket.close(websocket.CloseTryAgainLater, "too slow, reconnect to resume")
+				}
+				return
+			}
+			if !socket.topics[event.Topic] {
+				continue
+			}
+			if err := socket.send(SocketMessage{Type: EVENT_MESSAGE, Topic: event.Topic, Data: event.Data()}); err != nil {
+				return
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// private
+
+type socketConnection struct {
+	conn     *websocket.Conn
+	requests chan SocketMessage
+	// topics is only touched by the writing goroutine
+	topics map[string]bool
+}
+
+// checkOrigin lets through pages from the api's own host and AllowedOrigins. A socket isn't covered by CORS, so without
+// this any page could open one. Clients without an Origin header aren't browsers and are let through.
+func (r *SocketRoutes) checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(parsed.Host, req.Host) {
+		return true
+	}
+
+	return slices.ContainsFunc(r.AllowedOrigins, func(allowed string) bool {
+		return strings.EqualFold(allowed, origin)
+	})
+}
+
+func (r *SocketRoutes) handleRequest(ctx context.Context, socket *socketConnection, request SocketMessage) error {
+	if request.Type == ERROR_MESSAGE {
+		return socket.send(request)
+	}
+
+	for _, topic := range request.Topics {
+		if !slices.Contains(services.LIVE_TOPICS, topic) {
+			return socket.send(SocketMessage{Type: ERROR_MESSAGE, Error: "unknown topic " + topic})
+		}
+	}
+
+	added := []string{}
+	switch request.Type {
+	case SUBSCRIBE_MESSAGE:
+		for _, topic := range request.Topics {
+			if !socket.topics[topic] {
+				added = append(added, topic)
+			}
+			socket.topics[topic] = true
+		}
+	case UNSUBSCRIBE_MESSAGE:
+		for _, topic := range request.Topics {
+			delete(socket.topics, topic)
+		}
+	default:
+		return socket.send(SocketMessage{Type: ERROR_MESSAGE, Error: "unknown message type " + request.Type})
+	}
+
+	topics := []string{}
+	for _, topic := range services.LIVE_TOPICS {
+		if socket.topics[topic] {
+			topics = append(topics, topic)
+		}
+	}
+	if err := socket.send(SocketMessage{Type: SUBSCRIBED_MESSAGE, Topics: topics}); err != nil {
+		return err
+	}
+
+	// new metrics subscribers get the current metric straight away rather than waiting for the next one
+	if slices.Contains(added, services.METRICS_TOPIC) {
+		metric, err := r.DataService.GetLatestMetric(ctx)
+		if err != nil {
+			if !errors.IsCancelled(err) {
+				telemetry.Logger(ctx).Warn("Failed to get latest metric for new subscriber", zap.Error(err))
+			}
+			return nil
+		}
+		if metric != nil {
+			return socket.send(SocketMessage{Type: EVENT_MESSAGE, Topic: services.METRICS_TOPIC, Data: metric})
+		}
+	}
+
+	return nil
+}
+
+// readLoop hands client messages to the writing goroutine and answers pongs, cancelling once the client goes away
+func (s *socketConnection) readLoop(ctx context.Context, cancel context.CancelFunc) {
+	defer cancel()
+
+	s.conn.SetReadLimit(socketMaxMessage)
+	s.conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				telemetry.Logger(ctx).Info("Websocket closed", zap.Error(err))
+			}
+			return
+		}
+
+		var message SocketMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			// pass it on so the writer can tell the client, the connection stays open
+			message = SocketMessage{Type: ERROR_MESSAGE, Error: "invalid message"}
+		}
+
+		select {
+		case s.requests <- message:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *socketConnection) send(message SocketMessage) error {
+	s.conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+	return s.conn.WriteJSON(message)
+}
+
+func (s *socketConnection) close(code int, reason string) {
+	s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(socketWriteWait))
+}
@@ -0,0 +1,107 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"zendo/lib_zendo/services"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSocketChecksTheOrigin(t *testing.T) {
+	r := SocketRoutes{AllowedOrigins: []string{"https://dashboard.example.com"}}
+
+	for _, test := range []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{"https://api.example.com", true},
+		{"https://dashboard.example.com", true},
+		{"HTTPS://Dashboard.Example.com", true},
+		{"https://evil.example.com", false},
+		{"https://dashboard.example.com.evil.example.com", false},
+		{"null", false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "https://api.example.com/ws", nil)
+		if len(test.origin) > 0 {
+			req.Header.Set("Origin", test.origin)
+		}
+		if allowed := r.checkOrigin(req); allowed != test.allowed {
+			t.Fatalf("origin %q: expected allowed %v, got %v", test.origin, test.allowed, allowed)
+		}
+	}
+}
+
+func TestSocketRejectsOtherOrigins(t *testing.T) {
+	server, _ := socketForTest(t)
+
+	header := http.Header{"Origin": []string{"https://evil.example.com"}}
+	_, resp, err := websocket.DefaultDialer.Dial(socketUrlForTest(server), header)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a 403 for another origin, got %v", err)
+	}
+}
+
+func TestSocketClosesGoingAwayWhenTheHubStops(t *testing.T) {
+	server, stop := socketForTest(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial(socketUrlForTest(server), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the socket has subscribed to the hub once it answers
+	if err := conn.WriteJSON(SocketMessage{Type: SUBSCRIBE_MESSAGE, Topics: []string{services.ALERTS_TOPIC}}); err != nil {
+		t.Fatal(err)
+	}
+	var reply SocketMessage
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != SUBSCRIBED_MESSAGE {
+		t.Fatalf("expected a subscribed reply, got %+v and %v", reply, err)
+	}
+
+	stop()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected the socket to be closed going away, got %v", err)
+	}
+}
+
+// private
+
+// socketForTest serves Subscribe with a running hub, stop stops the hub as shutdown does
+func socketForTest(t *testing.T) (*httptest.Server, func()) {
+	t.Helper()
+
+	dataService := services.NewMemoryDataService()
+	hub := &services.EventHub{Source: &services.PollingEventSource{DataService: dataService, Interval: time.Hour}}
+	ctx, stop := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		hub.Run(ctx)
+	}()
+
+	r := SocketRoutes{DataService: dataService, Hub: hub}
+	server := httptest.NewServer(http.HandlerFunc(r.Subscribe))
+	t.Cleanup(func() {
+		stop()
+		<-stopped
+		server.Close()
+	})
+
+	return server, func() {
+		stop()
+		<-stopped
+	}
+}
+
+func socketUrlForTest(server *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
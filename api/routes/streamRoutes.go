@@ -0,0 +1,152 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/services"
+	"zendo/lib_zendo/telemetry"
+
+	"go.uber.org/zap"
+)
+
+const (
+	sseKeepAlive time.Duration = 15 * time.Second
+	// sseRetry tells EventSource how long to wait before reconnecting, in milliseconds
+	sseRetry string = "5000"
+	// sseMaxReplay bounds how many missed metrics are replayed, a client that missed more is told to refetch
+	sseMaxReplay int = 1000
+)
+
+type StreamRoutes struct {
+	DataService services.IDataService
+	Hub         *services.EventHub
+}
+
+// StreamMetrics sends every new metric as a server sent event with the metric timestamp as its id.
+// A client reconnecting with Last-Event-ID first gets the metrics it missed replayed from storage.
+func (r *StreamRoutes) StreamMetrics(resp http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	controller := http.NewResponseController(resp)
+
+	// subscribe before replaying so nothing written in between is lost, anything replayed twice is skipped below
+	events, unsubscribe := r.Hub.Subscribe()
+	defer unsubscribe()
+
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("Connection", "keep-alive")
+	// stop proxies such as nginx buffering the stream
+	resp.Header().Set("X-Accel-Buffering", "no")
+	resp.WriteHeader(http.StatusOK)
+
+	stream := sseWriter{
+		resp:       resp,
+		controller: controller,
+	}
+	if err := stream.write("retry: " + sseRetry + "\n\n"); err != nil {
+		return
+	}
+
+	var lastSent time.Time
+	if lastEventId := req.Header.Get("Last-Event-ID"); len(lastEventId) > 0 {
+		since, err := time.Parse(time.RFC3339Nano, lastEventId)
+		if err != nil {
+			telemetry.Logger(ctx).Warn("Ignoring invalid Last-Event-ID", zap.String("id", lastEventId))
+		} else {
+			lastSent = since
+			if err := r.replay(ctx, &stream, since, &lastSent); err != nil {
+				return
+			}
+		}
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				// dropped for falling behind or the server is stopping, the client reconnects and replays
+				return
+			}
+			metric := event.Metric
+			if metric == nil || metric.Timestamp == nil || !metric.Timestamp.After(lastSent) {
+				continue
+			}
+			if err := stream.writeMetric(metric); err != nil {
+				return
+			}
+			lastSent = *metric.Timestamp
+		case <-keepAlive.C:
+			if err := stream.write(": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// private
+
+func (r *StreamRoutes) replay(ctx context.Context, stream *sseWriter, since time.Time, lastSent *time.Time) error {
+	page, err := r.DataService.GetMetricsInRange(ctx, services.MetricsRangeQuery{
+		From:  since.Add(time.Nanosecond),
+		To:    time.Now(),
+		Limit: sseMaxReplay,
+	})
+	if err != nil {
+		// carry on live, the client can still fill the gap from /historical-data
+		telemetry.Logger(ctx).Warn("Failed to replay missed metrics", zap.Error(err))
+		return nil
+	}
+
+	for i := range page.Metrics {
+		if err := stream.writeMetric(&page.Metrics[i]); err != nil {
+			return err
+		}
+		*lastSent = *page.Metrics[i].Timestamp
+	}
+
+	if page.NextCursor != nil {
+		// too much was missed to replay, ask the client to reload instead
+		return stream.write("event: reset\ndata: {}\n\n")
+	}
+
+	return nil
+}
+
+type sseWriter struct {
+	resp       http.ResponseWriter
+	controller *http.ResponseController
+}
+
+func (w *sseWriter) writeMetric(metric *model.Metric) error {
+	data, err := json.Marshal(metric)
+	if err != nil {
+		zap.L().DPanic("Failed to encode metric", zap.Error(err))
+		return err
+	}
+
+	var builder strings.Builder
+	builder.WriteString("id: ")
+	builder.WriteString(metric.Timestamp.UTC().Format(time.RFC3339Nano))
+	builder.WriteString("\nevent: metric\ndata: ")
+	builder.Write(data)
+	builder.WriteString("\n\n")
+	return w.write(builder.String())
+}
+
+// write sends an event straight away, each write gets its own deadline so the server write timeout doesn't end the stream
+func (w *sseWriter) write(event string) error {
+	w.controller.SetWriteDeadline(time.Now().Add(2 * sseKeepAlive))
+	if _, err := w.resp.Write([]byte(event)); err != nil {
+		return err
+	}
+	return w.controller.Flush()
+}
@@ -1,63 +1,37 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"net/http"
 	"os"
-	"time"
 	"zendo/data_fetcher/routes"
 	"zendo/data_fetcher/services"
+	"zendo/lib_zendo/auth"
+	"zendo/lib_zendo/health"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/server"
 	libServices "zendo/lib_zendo/services"
+	"zendo/lib_zendo/telemetry"
 	"zendo/lib_zendo/utils"
 
 	"github.com/joho/godotenv"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 )
 
-func setupLogger() {
-	var encoding string
-	var encoderCfg zapcore.EncoderConfig
-	// TODO: flip to json logging in prod
-	encoderCfg = zap.NewDevelopmentEncoderConfig()
-	encoding = "console"
-
-	encoderCfg.TimeKey = "timestamp"
-	encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
-
-	// TODO: Make this configurable via env var
-	zapLevel := zap.InfoLevel
-
-	config := zap.Config{
-		Level:             zap.NewAtomicLevelAt(zapLevel),
-		Development:       os.Getenv("ZENDO_ENV") == "dev",
-		DisableCaller:     false,
-		DisableStacktrace: false,
-		Sampling:          nil,
-		Encoding:          encoding,
-		EncoderConfig:     encoderCfg,
-		OutputPaths: []string{
-			"stderr",
-		},
-		ErrorOutputPaths: []string{
-			"stderr",
-		},
-		InitialFields: map[string]any{
-			"pid": os.Getpid(),
-		},
-	}
-	logger := zap.Must(config.Build())
-
-	zap.ReplaceGlobals(logger)
-}
-
 func main() {
 	// load env
 	if err := godotenv.Load(); err != nil {
 		log.Fatalln("Failed to load env file")
 	}
 
-	setupLogger()
+	if err := server.SetupLogger(); err != nil {
+		log.Fatalln("Failed to setup logger:", err)
+	}
+
+	storage := flag.String("storage", "", "storage backend: couchdb, sqlite, postgres or memory (defaults to ZENDO_STORAGE)")
+	flag.Parse()
 
 	// setup router
 	mux := http.NewServeMux()
@@ -75,32 +49,76 @@ func main() {
 		Http: &httpClient,
 	}
 
-	dataService := libServices.CouchDBDataService{
-		Http: &httpClient,
+	dataService, err := libServices.NewDataService(*storage, &httpClient)
+	if err != nil {
+		log.Fatalln("Failed to setup data service:", err)
+	}
+
+	apiKeyService := libServices.ApiKeyService{
+		Store: dataService,
+	}
+
+	// zendo-admin can't reach memory storage, so create a key for /update and /seed here
+	if libServices.ResolveStorage(*storage) == libServices.MEMORY_STORAGE {
+		if err := libServices.CreateDemoKey(context.Background(), &apiKeyService, os.Stdout); err != nil {
+			log.Fatalln("Failed to create demo key:", err)
+		}
+	}
+
+	// the fetcher only has admin routes so there are no anonymous scopes
+	authenticator := auth.Authenticator{
+		ApiKeys: &apiKeyService,
 	}
 
 	// setup routes and inject dependencies
 	dataRoutes := routes.DataRoutes{
 		ElectricService: &electricSerice,
 		WeatherService:  &weatherService,
-		DataService:     &dataService,
+		DataService:     dataService,
+	}
+
+	maxDataAge, err := health.MaxDataAgeFromEnv()
+	if err != nil {
+		log.Fatalln("Failed to setup health checks:", err)
+	}
+	checker := health.Checker{
+		Checks: append(health.StorageChecks(dataService),
+			health.FreshnessCheck("energy-data", maxDataAge, dataService.GetLatestEnergyDate),
+		),
 	}
 
 	// register routes
-	mux.HandleFunc("/update", dataRoutes.GetLatest)
-	mux.HandleFunc("/seed", dataRoutes.Seed24Hrs)
+	mux.HandleFunc("/update", authenticator.Require(model.ADMIN_INGEST_SCOPE, dataRoutes.GetLatest))
+	mux.HandleFunc("/seed", authenticator.Require(model.ADMIN_SEED_SCOPE, dataRoutes.Seed24Hrs))
+	mux.HandleFunc("GET /healthz", health.Live)
+	mux.HandleFunc("GET /readyz", checker.Ready)
+
+	// a fetcher that stops storing new data shows up as a growing age
+	telemetry.TrackUpdates(telemetry.ENERGY_UPDATES, telemetry.WEATHER_UPDATES)
+
+	// probes and scrapes only show up in the access log when they fail
+	accessLog := telemetry.AccessLog("/healthz", "/readyz")
 
 	// configure server
-	server := &http.Server{
-		Addr:         ":8080",
-		Handler:      mux,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+	timeouts, err := server.TimeoutsFromEnv()
+	if err != nil {
+		log.Fatalln("Failed to setup server:", err)
+	}
+	// telemetry has its own port so it isn't published with the public routes
+	metricsServer := telemetry.MetricsServerFromEnv(":9080", timeouts)
+	go func() {
+		if err := metricsServer.Run(); err != nil {
+			zap.L().Error("Metrics server failed", zap.Error(err))
+		}
+	}()
+
+	fetcherServer := server.Server{
+		Addr:     ":8080",
+		Handler:  server.Chain(telemetry.Instrument(mux), accessLog),
+		Timeouts: timeouts,
 	}
 
-	zap.L().Info("Server starting", zap.String("addr", server.Addr))
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal("Server failed to start:", err)
+	if err := fetcherServer.Run(); err != nil {
+		log.Fatal("Server failed:", err)
 	}
 }
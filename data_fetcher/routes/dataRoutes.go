@@ -1,9 +1,14 @@
 package routes
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"zendo/data_fetcher/services"
+	libErrors "zendo/lib_zendo/errors"
 	libServices "zendo/lib_zendo/services"
+	"zendo/lib_zendo/telemetry"
 
 	"go.uber.org/zap"
 )
@@ -15,64 +20,119 @@ type DataRoutes struct {
 }
 
 func (r *DataRoutes) GetLatest(resp http.ResponseWriter, req *http.Request) {
-	zap.L().Info("Running data update...")
+	telemetry.Logger(req.Context()).Info("Running data update...")
 
-	latestWeatherUpdate, err := r.DataService.GetLatestWeatherDate()
+	ctx := req.Context()
+
+	latestWeatherUpdate, err := r.DataService.GetLatestWeatherDate(ctx)
 	if err != nil {
-		zap.L().DPanic("Failed to get latest weather update time")
-		resp.WriteHeader(http.StatusFailedDependency)
+		writeDependencyError(resp, req, "Failed to get latest weather update time", err)
 		return
 	}
-	latestEnergyUpdate, err := r.DataService.GetLatestEnergyDate()
+	latestEnergyUpdate, err := r.DataService.GetLatestEnergyDate(ctx)
 	if err != nil {
-		zap.L().DPanic("Failed to get latest weather update time")
-		resp.WriteHeader(http.StatusFailedDependency)
+		writeDependencyError(resp, req, "Failed to get latest energy update time", err)
 		return
 	}
 
-	latestEnergy, err := r.ElectricService.GetDataSince(latestEnergyUpdate)
+	latestEnergy, err := r.ElectricService.GetDataSince(ctx, latestEnergyUpdate)
 	if err != nil {
-		zap.L().Warn("Failed to get latest energy data, continuing anyway", zap.Error(err))
+		telemetry.Logger(ctx).Warn("Failed to get latest energy data, continuing anyway", zap.Error(err))
 	}
 
-	latestWeather, err := r.WeatherService.GetDataSince(latestWeatherUpdate)
+	latestWeather, err := r.WeatherService.GetDataSince(ctx, latestWeatherUpdate)
 	if err != nil {
-		zap.L().Warn("Failed to get latest weather data, continuing anyway", zap.Error(err))
+		telemetry.Logger(ctx).Warn("Failed to get latest weather data, continuing anyway", zap.Error(err))
 	}
 
 	if latestEnergy == nil && latestWeather == nil {
-		zap.L().Info("No data updates.")
+		telemetry.Logger(ctx).Info("No data updates.")
 		resp.WriteHeader(204)
 		return
 	}
 
-	if err := r.DataService.PostLatestData(latestEnergy, latestWeather); err != nil {
-		resp.WriteHeader(http.StatusFailedDependency)
+	if err := r.DataService.PostLatestData(ctx, latestEnergy, latestWeather); err != nil {
+		writeStorageError(resp, req, err)
 		return
 	}
 
+	if latestEnergy != nil {
+		telemetry.Updated(telemetry.ENERGY_UPDATES)
+	}
+	if latestWeather != nil {
+		telemetry.Updated(telemetry.WEATHER_UPDATES)
+	}
+
 	resp.WriteHeader(204)
 }
 
 func (r *DataRoutes) Seed24Hrs(resp http.ResponseWriter, req *http.Request) {
-	historicalEnergy, err := r.ElectricService.Get24HrsOfData()
+	ctx := req.Context()
+
+	historicalEnergy, err := r.ElectricService.Get24HrsOfData(ctx)
 	if err != nil {
-		zap.L().DPanic("Failed to get historical energy data", zap.Error(err))
-		resp.WriteHeader(http.StatusFailedDependency)
+		writeDependencyError(resp, req, "Failed to get historical energy data", err)
 		return
 	}
 
-	historicalWeather, err := r.WeatherService.Get24HrsOfData()
+	historicalWeather, err := r.WeatherService.Get24HrsOfData(ctx)
 	if err != nil {
-		zap.L().DPanic("Failed to get historical weather data", zap.Error(err))
-		resp.WriteHeader(http.StatusFailedDependency)
+		writeDependencyError(resp, req, "Failed to get historical weather data", err)
 		return
 	}
 
-	if err := r.DataService.SeedHistoricalData(historicalEnergy, historicalWeather); err != nil {
-		zap.L().DPanic("Failed to add historical data to the database", zap.Error(err))
-		resp.WriteHeader(http.StatusFailedDependency)
+	if err := r.DataService.SeedHistoricalData(ctx, historicalEnergy, historicalWeather); err != nil {
+		writeStorageError(resp, req, err)
+		return
 	}
 
+	telemetry.Updated(telemetry.ENERGY_UPDATES)
+	telemetry.Updated(telemetry.WEATHER_UPDATES)
+
 	resp.WriteHeader(204)
 }
+
+type StorageErrorResponse struct {
+	Error    string                          `json:"error"`
+	Failures []libErrors.BulkDocumentFailure `json:"failures,omitempty"`
+}
+
+// private
+
+// writeDependencyError reports a failed call to storage or an upstream api.
+// A call that ran out of time is a 504, a request the client has already abandoned gets no response.
+func writeDependencyError(resp http.ResponseWriter, req *http.Request, msg string, err error) {
+	switch {
+	case req.Context().Err() != nil:
+		telemetry.Logger(req.Context()).Info("Request cancelled", zap.String("path", req.URL.Path), zap.Error(err))
+	case errors.Is(err, context.DeadlineExceeded):
+		telemetry.Logger(req.Context()).Warn(msg, zap.Error(err))
+		resp.WriteHeader(http.StatusGatewayTimeout)
+	default:
+		telemetry.Logger(req.Context()).DPanic(msg, zap.Error(err))
+		resp.WriteHeader(http.StatusFailedDependency)
+	}
+}
+
+// writeStorageError reports a failed write to the caller, including which documents were rejected and why
+func writeStorageError(resp http.ResponseWriter, req *http.Request, err error) {
+	if libErrors.IsCancelled(err) {
+		writeDependencyError(resp, req, "Failed to write data", err)
+		return
+	}
+
+	body := StorageErrorResponse{
+		Error: err.Error(),
+	}
+
+	var bulkErr *libErrors.BulkWriteError
+	if errors.As(err, &bulkErr) {
+		body.Failures = bulkErr.Failures
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusFailedDependency)
+	if err := json.NewEncoder(resp).Encode(body); err != nil {
+		telemetry.Logger(req.Context()).Error("Failed to encode storage error", zap.Error(err))
+	}
+}
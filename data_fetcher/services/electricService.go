@@ -1,20 +1,25 @@
 package services
 
 import (
+	"context"
 	"os"
 	"time"
 	"zendo/lib_zendo/errors"
 	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/telemetry"
 	"zendo/lib_zendo/utils"
 
 	"go.uber.org/zap"
 )
 
 type IElectricService interface {
-	GetDataSince(date *time.Time) (*model.LatestEnergeyResponse, error)
-	Get24HrsOfData() (*[]model.LatestEnergeyResponse, error)
+	GetDataSince(ctx context.Context, date *time.Time) (*model.LatestEnergeyResponse, error)
+	Get24HrsOfData(ctx context.Context) (*[]model.LatestEnergeyResponse, error)
 }
 
+// ELECTRICITY_MAPS_PROVIDER labels fetch metrics for Electricity Maps
+const ELECTRICITY_MAPS_PROVIDER string = "electricitymaps"
+
 type ElectricitymapService struct {
 	Http utils.IHttpClient
 }
@@ -22,18 +27,26 @@ type ElectricitymapService struct {
 const (
 	latestElectricEndpoint     string = "https://api.electricitymap.org/v3/power-breakdown/latest?zone=GB&disableEstimations=true"
 	historicalElectricEndpoint string = "https://api.electricitymap.org/v3/power-breakdown/history?zone=GB&disableEstimations=true" // NOTE: This always returns 24 hrs
+
+	// externalApiTimeout is shorter than the http client default so a slow upstream can't hold up an update
+	externalApiTimeout time.Duration = 10 * time.Second
 )
 
-func (s *ElectricitymapService) GetDataSince(date *time.Time) (*model.LatestEnergeyResponse, error) {
+func (s *ElectricitymapService) GetDataSince(ctx context.Context, date *time.Time) (latest *model.LatestEnergeyResponse, err error) {
+	defer func() { countFetch(ELECTRICITY_MAPS_PROVIDER, latest != nil, err) }()
+
 	var body model.LatestEnergeyResponse
-	result, err := s.Http.Get(latestElectricEndpoint, &body, &utils.HttpOptions{
+	result, err := s.Http.Get(ctx, latestElectricEndpoint, &body, &utils.HttpOptions{
+		Timeout: externalApiTimeout,
 		Headers: &map[string]string{
 			"auth-token": os.Getenv("ELECTRICITY_MAPS_API_KEY"),
 		},
 	})
 
 	if err != nil {
-		zap.L().DPanic("Failed to get latest energy usage", zap.Error(err))
+		return nil, requestError(ctx, "Failed to get latest energy usage", err)
+	}
+	if result.StatusCode > 299 {
 		return nil, &errors.HttpError{
 			StatusCode: result.StatusCode,
 		}
@@ -54,16 +67,21 @@ type HistoricalPowerResponse struct {
 	History []model.LatestEnergeyResponse `json:"history"`
 }
 
-func (s *ElectricitymapService) Get24HrsOfData() (*[]model.LatestEnergeyResponse, error) {
+func (s *ElectricitymapService) Get24HrsOfData(ctx context.Context) (history *[]model.LatestEnergeyResponse, err error) {
+	defer func() { countFetch(ELECTRICITY_MAPS_PROVIDER, history != nil, err) }()
+
 	var body HistoricalPowerResponse
-	result, err := s.Http.Get(historicalElectricEndpoint, &body, &utils.HttpOptions{
+	result, err := s.Http.Get(ctx, historicalElectricEndpoint, &body, &utils.HttpOptions{
+		Timeout: externalApiTimeout,
 		Headers: &map[string]string{
 			"auth-token": os.Getenv("ELECTRICITY_MAPS_API_KEY"),
 		},
 	})
 
 	if err != nil {
-		zap.L().DPanic("Failed to get historical energy usage", zap.Error(err))
+		return nil, requestError(ctx, "Failed to get historical energy usage", err)
+	}
+	if result.StatusCode > 299 {
 		return nil, &errors.HttpError{
 			StatusCode: result.StatusCode,
 		}
@@ -76,3 +94,28 @@ func (s *ElectricitymapService) Get24HrsOfData() (*[]model.LatestEnergeyResponse
 
 	return &body.History, nil
 }
+
+// private
+
+// countFetch counts a call to provider, a call without error that found nothing new is unchanged
+func countFetch(provider string, updated bool, err error) {
+	switch {
+	case err != nil:
+		telemetry.CountFetch(provider, telemetry.FETCH_FAILED)
+	case updated:
+		telemetry.CountFetch(provider, telemetry.FETCH_UPDATED)
+	default:
+		telemetry.CountFetch(provider, telemetry.FETCH_UNCHANGED)
+	}
+}
+
+// requestError passes a cancelled or timed out call through so callers can tell it apart from a failing upstream
+func requestError(ctx context.Context, msg string, err error) error {
+	if errors.IsCancelled(err) {
+		telemetry.Logger(ctx).Warn(msg, zap.Error(err))
+		return err
+	}
+
+	telemetry.Logger(ctx).DPanic(msg, zap.Error(err))
+	return &errors.HttpError{}
+}
@@ -1,19 +1,24 @@
 package services
 
 import (
+	"context"
 	"time"
 	"zendo/lib_zendo/errors"
 	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/telemetry"
 	"zendo/lib_zendo/utils"
 
 	"go.uber.org/zap"
 )
 
 type IWeatherService interface {
-	GetDataSince(date *time.Time) (*model.WeatherResponse, error)
-	Get24HrsOfData() (*[]model.WeatherResponse, error)
+	GetDataSince(ctx context.Context, date *time.Time) (*model.WeatherResponse, error)
+	Get24HrsOfData(ctx context.Context) (*[]model.WeatherResponse, error)
 }
 
+// OPEN_METEO_PROVIDER labels fetch metrics for Open-Meteo
+const OPEN_METEO_PROVIDER string = "open-meteo"
+
 type OpenMeteoWeatherService struct {
 	Http utils.IHttpClient
 }
@@ -23,13 +28,20 @@ const (
 	latestWeatherEndpoint     string = "https://api.open-meteo.com/v1/forecast?latitude=53.9324727&longitude=-1.1204176&current=temperature_2m&current=direct_radiation&current=cloud_cover&current=wind_speed_10m"
 	historicalWeatherEndpoint string = "https://api.open-meteo.com/v1/forecast?latitude=53.9324727&longitude=-1.1204176&hourly=temperature_2m&hourly=direct_radiation&hourly=cloud_cover&hourly=wind_speed_10m&past_days=1&forecast_days=1"
 	weatherTimeLayout         string = "2006-01-02T15:04"
+	weatherLocation           string = "york"
 )
 
-func (s *OpenMeteoWeatherService) GetDataSince(date *time.Time) (*model.WeatherResponse, error) {
+func (s *OpenMeteoWeatherService) GetDataSince(ctx context.Context, date *time.Time) (latest *model.WeatherResponse, err error) {
+	defer func() { countFetch(OPEN_METEO_PROVIDER, latest != nil, err) }()
+
 	var body model.WeatherResponse
-	result, err := s.Http.Get(latestWeatherEndpoint, &body)
+	result, err := s.Http.Get(ctx, latestWeatherEndpoint, &body, &utils.HttpOptions{
+		Timeout: externalApiTimeout,
+	})
 	if err != nil {
-		zap.L().DPanic("Failed to get latest energy usage", zap.Error(err))
+		return nil, requestError(ctx, "Failed to get latest energy usage", err)
+	}
+	if result.StatusCode > 299 {
 		return nil, &errors.HttpError{
 			StatusCode: result.StatusCode,
 		}
@@ -37,11 +49,12 @@ func (s *OpenMeteoWeatherService) GetDataSince(date *time.Time) (*model.WeatherR
 
 	parsedTime, err := time.Parse(weatherTimeLayout, *body.WeatherData.TimeString)
 	if err != nil {
-		zap.L().DPanic("Failed to parse weather time", zap.Error(err))
+		telemetry.Logger(ctx).DPanic("Failed to parse weather time", zap.Error(err))
 		return nil, &errors.DatabaseError{}
 	}
 
 	body.Timestamp = &parsedTime
+	body.Location = weatherLocation
 	body.WeatherData.TimeString = nil
 
 	if date != nil && (date.UTC().After(parsedTime.UTC()) || date.UTC().Equal(parsedTime.UTC())) {
@@ -64,14 +77,20 @@ type HistoricalWeatherResponse struct {
 	HourlyData HourlyData `json:"hourly"`
 }
 
-func (s *OpenMeteoWeatherService) Get24HrsOfData() (*[]model.WeatherResponse, error) {
+func (s *OpenMeteoWeatherService) Get24HrsOfData(ctx context.Context) (history *[]model.WeatherResponse, err error) {
+	defer func() { countFetch(OPEN_METEO_PROVIDER, history != nil, err) }()
+
 	// NOTE: The weather api is a bit clunky and filtering by time is a pain
 	// Need to filter through and remove weather in the future
 
 	var body HistoricalWeatherResponse
-	result, err := s.Http.Get(historicalWeatherEndpoint, &body)
+	result, err := s.Http.Get(ctx, historicalWeatherEndpoint, &body, &utils.HttpOptions{
+		Timeout: externalApiTimeout,
+	})
 	if err != nil {
-		zap.L().DPanic("Failed to get historical weather data", zap.Error(err))
+		return nil, requestError(ctx, "Failed to get historical weather data", err)
+	}
+	if result.StatusCode > 299 {
 		return nil, &errors.HttpError{
 			StatusCode: result.StatusCode,
 		}
@@ -84,7 +103,7 @@ func (s *OpenMeteoWeatherService) Get24HrsOfData() (*[]model.WeatherResponse, er
 		// parse time
 		parsedTime, err := time.Parse(weatherTimeLayout, body.HourlyData.TimeStrings[i])
 		if err != nil {
-			zap.L().DPanic("Failed to parse weather time", zap.Error(err))
+			telemetry.Logger(ctx).DPanic("Failed to parse weather time", zap.Error(err))
 			return nil, &errors.DatabaseError{}
 		}
 
@@ -97,6 +116,7 @@ func (s *OpenMeteoWeatherService) Get24HrsOfData() (*[]model.WeatherResponse, er
 			BaseDocument: model.BaseDocument{
 				Timestamp: &parsedTime,
 			},
+			Location: weatherLocation,
 			WeatherData: model.WeatherData{
 				Temperature:       body.HourlyData.Temperatures[i],
 				DirectRadiation:   body.HourlyData.Radiation[i],
@@ -67,7 +67,7 @@ async def process_historical():
     # create docs so have something to work with
     success = await data_service.post_new_data_points(data_points=data_points)
     if not success:
-        logger.error("Failed to create new data points, inspect return code")
+        logger.error("Failed to create new data points, see the failures logged above")
 
 
 if __name__ == "__main__":
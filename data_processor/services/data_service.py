@@ -1,5 +1,6 @@
 import os
 import json
+import asyncio
 import aiohttp
 import logging
 
@@ -7,6 +8,18 @@ from datetime import datetime, timedelta, timezone
 
 logger = logging.getLogger(__name__)
 
+COUCHDB_CONFLICT = "conflict"
+BULK_DOCS_MAX_ATTEMPTS = 3
+BULK_DOCS_RETRY_DELAY = 0.5
+
+# these will fail again on retry, any other per document error is treated as transient
+PERMANENT_BULK_DOC_ERRORS = {
+    "forbidden",
+    "unauthorized",
+    "bad_request",
+    "doc_validation",
+}
+
 
 class DataService:
     async def get_latest_weather(self) -> list[dict]:
@@ -34,17 +47,77 @@ class DataService:
     async def post_new_data_point(self, data_point) -> bool:
         async with aiohttp.ClientSession() as session:
             async with session.post(DataService._base_url(), json=data_point) as resp:
+                if resp.status == 409:
+                    logger.info(f"Data point {data_point['_id']} already stored")
+                    return True
                 return resp.status == 201
 
+    # a conflict means the data point is already stored, transient failures are retried
+    # with a growing delay and any data point that is finally rejected fails the write
     async def post_new_data_points(self, data_points) -> bool:
+        stored, already_stored, failed = 0, 0, []
+        pending = data_points
         async with aiohttp.ClientSession() as session:
-            async with session.post(
-                DataService.bulk_upload_url(), json={"docs": data_points}
-            ) as resp:
-                if resp.status != 201:
-                    content = await resp.content.read()
-                    logger.error(f"Failed to create data points: {content=}")
-                return resp.status == 201
+            for attempt in range(1, BULK_DOCS_MAX_ATTEMPTS + 1):
+                if not pending:
+                    break
+                if attempt > 1:
+                    logger.warning(
+                        f"Retrying bulk write, {attempt=} documents={len(pending)}"
+                    )
+                    await asyncio.sleep(BULK_DOCS_RETRY_DELAY * (attempt - 1))
+                can_retry = attempt < BULK_DOCS_MAX_ATTEMPTS
+
+                try:
+                    async with session.post(
+                        DataService.bulk_upload_url(), json={"docs": pending}
+                    ) as resp:
+                        status = resp.status
+                        content = await resp.content.read()
+                except aiohttp.ClientError as e:
+                    if can_retry:
+                        logger.warning(f"Bulk write request failed: {e}")
+                        continue
+                    logger.error(f"Failed to create data points: {e}")
+                    return False
+                if status >= 500 and can_retry:
+                    logger.warning(f"Bulk write request failed: {status=}")
+                    continue
+                if status > 299:
+                    logger.error(f"Failed to create data points: {status=} {content=}")
+                    return False
+
+                # NOTE: CouchDB returns the results in the same order as the request docs
+                results = json.loads(content)
+                if len(results) != len(pending):
+                    logger.error(
+                        f"Bulk write returned an unexpected number of results, expected={len(pending)} got={len(results)}"
+                    )
+                    return False
+
+                retry = []
+                for data_point, result in zip(pending, results):
+                    error = result.get("error")
+                    if error is None:
+                        stored += 1
+                    elif error == COUCHDB_CONFLICT:
+                        logger.info(f"Data point {result.get('id')} already stored")
+                        already_stored += 1
+                    elif error not in PERMANENT_BULK_DOC_ERRORS and can_retry:
+                        retry.append(data_point)
+                    else:
+                        logger.warning(
+                            f"Failed to store data point {result.get('id')}: {error=} reason={result.get('reason')}"
+                        )
+                        failed.append(result)
+                pending = retry
+
+        logger.info(
+            f"Bulk write complete, {stored=} {already_stored=} failed={len(failed)}"
+        )
+        if failed:
+            logger.error(f"Failed to create data points: {failed=}")
+        return not failed
 
     @staticmethod
     def energy_change_feed_url() -> str:
@@ -2,6 +2,8 @@ def create_data_point(
     latest_weather, latest_energy, sol_vs_prod, temp_vs_consumption
 ) -> dict:
     return {
+        # deterministic id so re-processing the same energy point doesn't duplicate it
+        "_id": f"AGGREGATED_DATA:{latest_energy['timestamp']}",
         "type": "AGGREGATED_DATA",
         "timestamp": latest_energy["timestamp"],
         "totalProduction": latest_energy["powerProductionTotal"],
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"zendo/lib_zendo/errors"
+	"zendo/lib_zendo/services"
+	"zendo/lib_zendo/telemetry"
+
+	"go.uber.org/zap"
+)
+
+// Principal is whoever made the request, as established by the authenticator
+type Principal struct {
+	Id     string
+	Name   string
+	Scopes []string
+}
+
+// ANONYMOUS_PRINCIPAL is the id given to requests that didn't present a credential
+const ANONYMOUS_PRINCIPAL string = "anonymous"
+
+// Authenticator checks the api key or token on each request against the scope the route needs.
+// Credentials are read from the Authorization header as a bearer token or from X-API-Key.
+// A credential shaped like a JWT is checked by Tokens when it is set, anything else is an api key.
+// Requests without a credential get AnonymousScopes, which lets a public dashboard read without a key.
+type Authenticator struct {
+	ApiKeys         *services.ApiKeyService
+	Tokens          *TokenVerifier
+	AnonymousScopes []string
+}
+
+// AnonymousScopesFromEnv reads the comma separated AUTH_ANONYMOUS_SCOPES
+func AnonymousScopesFromEnv() []string {
+	return splitList(os.Getenv("AUTH_ANONYMOUS_SCOPES"))
+}
+
+// Require only lets a request through to next when it holds scope, the principal is added to the request context
+func (a *Authenticator) Require(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		principal, err := a.authenticate(req)
+		if err != nil {
+			switch {
+			case req.Context().Err() != nil:
+				telemetry.Logger(req.Context()).Info("Request cancelled", zap.String("path", req.URL.Path), zap.Error(err))
+			case errors.IsCancelled(err):
+				telemetry.Logger(req.Context()).Warn("Timed out checking credential", zap.Error(err))
+				resp.WriteHeader(http.StatusGatewayTimeout)
+			default:
+				telemetry.Logger(req.Context()).Warn("Failed to check credential", zap.Error(err))
+				resp.WriteHeader(http.StatusFailedDependency)
+			}
+			return
+		}
+
+		if principal == nil {
+			resp.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(resp, http.StatusUnauthorized, "invalid credential")
+			return
+		}
+
+		if !principal.HasScope(scope) {
+			if principal.Id == ANONYMOUS_PRINCIPAL {
+				resp.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(resp, http.StatusUnauthorized, "an api key or token with "+scope+" is required")
+				return
+			}
+			telemetry.Logger(req.Context()).Warn("Credential is missing scope", zap.String("id", principal.Id), zap.String("scope", scope), zap.String("path", req.URL.Path))
+			writeError(resp, http.StatusForbidden, "the credential does not have "+scope)
+			return
+		}
+
+		next(resp, req.WithContext(WithPrincipal(req.Context(), principal)))
+	}
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope)
+}
+
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFrom returns the principal of an authenticated request, nil when the route wasn't behind Require
+func PrincipalFrom(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// private
+
+type principalKey struct{}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// authenticate returns nil without an error when a credential was presented but isn't valid
+func (a *Authenticator) authenticate(req *http.Request) (*Principal, error) {
+	credential := bearerToken(req)
+	if len(credential) == 0 {
+		return &Principal{
+			Id:     ANONYMOUS_PRINCIPAL,
+			Scopes: a.AnonymousScopes,
+		}, nil
+	}
+
+	if a.Tokens != nil && strings.Count(credential, ".") == 2 {
+		return a.Tokens.Verify(req.Context(), credential)
+	}
+
+	key, err := a.ApiKeys.Authenticate(req.Context(), credential)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		telemetry.Logger(req.Context()).Info("Rejected api key", zap.String("path", req.URL.Path))
+		return nil, nil
+	}
+
+	return &Principal{
+		Id:     key.Id,
+		Name:   key.Name,
+		Scopes: key.Scopes,
+	}, nil
+}
+
+func bearerToken(req *http.Request) string {
+	if key := req.Header.Get("X-API-Key"); len(key) > 0 {
+		return key
+	}
+
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// splitList splits a comma separated setting, dropping blanks
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func writeError(resp http.ResponseWriter, status int, message string) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	if err := json.NewEncoder(resp).Encode(errorResponse{Error: message}); err != nil {
+		zap.L().Error("Failed to encode error", zap.Error(err))
+	}
+}
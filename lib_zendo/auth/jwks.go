@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+	"zendo/lib_zendo/errors"
+	"zendo/lib_zendo/telemetry"
+	"zendo/lib_zendo/utils"
+
+	"go.uber.org/zap"
+)
+
+// IKeySource finds the public key a token was signed with
+type IKeySource interface {
+	// Key returns nil without an error when there is no key with that id
+	Key(ctx context.Context, kid string) (crypto.PublicKey, error)
+}
+
+// FileKeySource reads a JWKS file once, e.g. a key set generated locally for tests
+type FileKeySource struct {
+	Path string
+
+	once sync.Once
+	keys keySet
+	err  error
+}
+
+func (s *FileKeySource) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.once.Do(func() {
+		data, err := os.ReadFile(s.Path)
+		if err != nil {
+			s.err = err
+			return
+		}
+		s.keys, s.err = parseKeySet(data)
+	})
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.keys.find(kid), nil
+}
+
+// UrlKeySource fetches a JWKS from the identity provider, e.g. the jwks_uri of its OIDC discovery document.
+// The set is refetched every JWKS_REFRESH_INTERVAL, and sooner when a token names a key it hasn't seen so rotated keys
+// are picked up, but no more than once every JWKS_MIN_REFRESH_INTERVAL.
+type UrlKeySource struct {
+	Url  string
+	Http utils.IHttpClient
+
+	mu          sync.Mutex
+	keys        keySet
+	err         error
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+const JWKS_REFRESH_INTERVAL time.Duration = time.Hour
+const JWKS_MIN_REFRESH_INTERVAL time.Duration = time.Minute
+
+func (s *UrlKeySource) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := s.keys.find(kid)
+	fresh := time.Since(s.fetchedAt) < JWKS_REFRESH_INTERVAL
+	if (key != nil && fresh) || time.Since(s.attemptedAt) < JWKS_MIN_REFRESH_INTERVAL {
+		if s.keys == nil {
+			return nil, s.err
+		}
+		return key, nil
+	}
+
+	err := s.fetch(ctx)
+	if err != nil && ctx.Err() != nil {
+		// the request went away, that says nothing about the provider
+		return nil, err
+	}
+	s.attemptedAt = time.Now()
+	s.err = err
+	if err != nil {
+		if s.keys == nil {
+			return nil, err
+		}
+		// keep using the keys we have, the provider may only be briefly unavailable
+		telemetry.Logger(ctx).Warn("Failed to refresh JWKS", zap.String("url", s.Url), zap.Error(err))
+		return key, nil
+	}
+
+	return s.keys.find(kid), nil
+}
+
+// private
+
+type keySet map[string]crypto.PublicKey
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (s *UrlKeySource) fetch(ctx context.Context) error {
+	// providers serve application/jwk-set+json as often as application/json so parse the raw body
+	var body json.RawMessage
+	result, err := s.Http.Get(ctx, s.Url, &body)
+	if err != nil {
+		return err
+	}
+	if result.StatusCode > 299 {
+		return &errors.HttpError{
+			StatusCode: result.StatusCode,
+		}
+	}
+	if result.Body == nil {
+		return fmt.Errorf("JWKS response was empty")
+	}
+
+	keys, err := parseKeySet(*result.Body)
+	if err != nil {
+		return err
+	}
+
+	s.keys = keys
+	s.fetchedAt = time.Now()
+	telemetry.Logger(ctx).Info("Fetched JWKS", zap.String("url", s.Url), zap.Int("keys", len(keys)))
+	return nil
+}
+
+// find returns the key with kid, a token without a kid can only use a set with one key
+func (k keySet) find(kid string) crypto.PublicKey {
+	if len(kid) == 0 && len(k) == 1 {
+		for _, key := range k {
+			return key
+		}
+	}
+	return k[kid]
+}
+
+// parseKeySet keeps the RSA and P-256 signing keys, anything else can't verify RS256 or ES256 so it is skipped
+func parseKeySet(data []byte) (keySet, error) {
+	var set jsonWebKeySet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := keySet{}
+	for _, jwk := range set.Keys {
+		if len(jwk.Use) > 0 && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			zap.L().Warn("Skipping JWKS key", zap.String("kid", jwk.Kid), zap.Error(err))
+			continue
+		}
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS has no usable RSA or P-256 signing keys")
+	}
+	return keys, nil
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if n.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key is shorter than 2048 bits")
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("invalid P-256 coordinates")
+		}
+		// ecdh checks the point is on the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+
+	return nil, nil
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+	"zendo/lib_zendo/utils"
+)
+
+func TestUrlKeySourceRefetchesUnknownKeys(t *testing.T) {
+	first := newRsaKeyForTest(t, "first")
+	second := newEcKeyForTest(t, "second")
+	provider := newProviderForTest(t, first)
+	source := UrlKeySource{Url: provider.server.URL, Http: &utils.HttpClient{}}
+	ctx := context.Background()
+
+	key, err := source.Key(ctx, "first")
+	if err != nil || key == nil {
+		t.Fatalf("expected the first key, got %v and %v", key, err)
+	}
+
+	// the provider rotates to a new key
+	provider.serve(second)
+	if key, err := source.Key(ctx, "first"); err != nil || key == nil {
+		t.Fatalf("expected the known key to come from the cached set, got %v and %v", key, err)
+	}
+	if key, _ := source.Key(ctx, "second"); key != nil {
+		t.Fatal("expected no refetch within a minute of the last one")
+	}
+	if fetches := provider.fetchCount(); fetches != 1 {
+		t.Fatalf("expected 1 fetch so far, got %d", fetches)
+	}
+
+	// a minute later an unknown kid fetches the set again
+	source.attemptedAt = time.Now().Add(-JWKS_MIN_REFRESH_INTERVAL)
+	key, err = source.Key(ctx, "second")
+	if err != nil || key == nil {
+		t.Fatalf("expected the rotated key after a refetch, got %v and %v", key, err)
+	}
+	if _, ok := key.(*ecdsa.PublicKey); !ok {
+		t.Fatalf("expected an EC key, got %T", key)
+	}
+	if fetches := provider.fetchCount(); fetches != 2 {
+		t.Fatalf("expected 2 fetches, got %d", fetches)
+	}
+
+	// the keys already fetched keep working while the provider is down
+	provider.fail()
+	source.attemptedAt = time.Now().Add(-JWKS_MIN_REFRESH_INTERVAL)
+	if key, err := source.Key(ctx, "second"); err != nil || key == nil {
+		t.Fatalf("expected the cached key while the provider fails, got %v and %v", key, err)
+	}
+}
+
+func TestUrlKeySourceFailsWithoutKeys(t *testing.T) {
+	provider := newProviderForTest(t)
+	provider.fail()
+	source := UrlKeySource{Url: provider.server.URL, Http: &utils.HttpClient{}}
+
+	if _, err := source.Key(context.Background(), "any"); err == nil {
+		t.Fatal("expected an error when the set has never been fetched")
+	}
+}
+
+func TestParseKeySetSkipsUnusableKeys(t *testing.T) {
+	usable := newEcKeyForTest(t, "usable")
+	set := map[string]any{"keys": []any{
+		usable.jwk(),
+		map[string]string{"kty": "RSA", "kid": "short", "n": base64.RawURLEncoding.EncodeToString(big.NewInt(65537).Bytes()), "e": "AQAB"},
+		map[string]string{"kty": "oct", "kid": "secret", "k": "c2VjcmV0"},
+		map[string]string{"kty": "EC", "kid": "encryption", "use": "enc", "crv": "P-256"},
+	}}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := parseKeySet(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys["usable"] == nil {
+		t.Fatalf("expected only the usable key, got %v", keys)
+	}
+}
+
+// private
+
+type keyForTest struct {
+	kid     string
+	alg     string
+	private crypto.Signer
+}
+
+func newRsaKeyForTest(t *testing.T, kid string) *keyForTest {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &keyForTest{kid: kid, alg: RS256, private: key}
+}
+
+func newEcKeyForTest(t *testing.T, kid string) *keyForTest {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &keyForTest{kid: kid, alg: ES256, private: key}
+}
+
+// jwk is the public half as a provider publishes it
+func (k *keyForTest) jwk() map[string]string {
+	switch public := k.private.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA",
+			"kid": k.kid,
+			"use": "sig",
+			"alg": RS256,
+			"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		return map[string]string{
+			"kty": "EC",
+			"kid": k.kid,
+			"use": "sig",
+			"alg": ES256,
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, 32))),
+		}
+	}
+	return nil
+}
+
+// providerForTest serves a JWKS and counts how often it is fetched
+type providerForTest struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	keys    []*keyForTest
+	failing bool
+	fetches int
+}
+
+func newProviderForTest(t *testing.T, keys ...*keyForTest) *providerForTest {
+	t.Helper()
+	provider := &providerForTest{keys: keys}
+	provider.server = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		provider.mu.Lock()
+		defer provider.mu.Unlock()
+
+		provider.fetches++
+		if provider.failing {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		set := map[string][]map[string]string{"keys": {}}
+		for _, key := range provider.keys {
+			set["keys"] = append(set["keys"], key.jwk())
+		}
+		resp.Header().Set("Content-Type", "application/jwk-set+json")
+		json.NewEncoder(resp).Encode(set)
+	}))
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+func (p *providerForTest) serve(keys ...*keyForTest) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+	p.failing = false
+}
+
+func (p *providerForTest) fail() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failing = true
+}
+
+func (p *providerForTest) fetchCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fetches
+}
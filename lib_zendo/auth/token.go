@@ -0,0 +1,268 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"zendo/lib_zendo/telemetry"
+	"zendo/lib_zendo/utils"
+
+	"go.uber.org/zap"
+)
+
+// the algorithms accepted on tokens
+const RS256 string = "RS256"
+const ES256 string = "ES256"
+
+// DEFAULT_ROLES_CLAIM is where roles are read from when JWT_ROLES_CLAIM isn't set
+const DEFAULT_ROLES_CLAIM string = "roles"
+
+// DEFAULT_TOKEN_LEEWAY allows for clock skew between us and the identity provider
+const DEFAULT_TOKEN_LEEWAY time.Duration = time.Minute
+
+// TokenVerifier checks RS256 and ES256 JWTs from an OIDC provider, e.g. company SSO.
+// A token must be signed by a key in Keys, be issued by Issuer for Audience and not have expired.
+// The roles in RolesClaim are mapped to scopes through RoleScopes, roles without a mapping give no scopes.
+type TokenVerifier struct {
+	Keys       IKeySource
+	Issuer     string
+	Audience   string
+	RolesClaim string
+	RoleScopes map[string][]string
+	Leeway     time.Duration
+}
+
+// TokenVerifierFromEnv reads the JWT_* settings, it returns nil when JWT_JWKS isn't set so tokens aren't accepted.
+// JWT_JWKS is a file path or an http(s) url, JWT_ROLE_SCOPES maps roles to scopes like
+// "dashboard-viewer=read:metrics;dashboard-admin=read:metrics,admin:keys".
+func TokenVerifierFromEnv(http utils.IHttpClient) (*TokenVerifier, error) {
+	jwks := os.Getenv("JWT_JWKS")
+	if len(jwks) == 0 {
+		return nil, nil
+	}
+
+	verifier := TokenVerifier{
+		Issuer:     os.Getenv("JWT_ISSUER"),
+		Audience:   os.Getenv("JWT_AUDIENCE"),
+		RolesClaim: os.Getenv("JWT_ROLES_CLAIM"),
+		RoleScopes: map[string][]string{},
+	}
+	if len(verifier.Issuer) == 0 || len(verifier.Audience) == 0 {
+		return nil, fmt.Errorf("JWT_ISSUER and JWT_AUDIENCE must be set with JWT_JWKS")
+	}
+
+	if strings.HasPrefix(jwks, "http://") || strings.HasPrefix(jwks, "https://") {
+		verifier.Keys = &UrlKeySource{Url: jwks, Http: http}
+	} else {
+		verifier.Keys = &FileKeySource{Path: jwks}
+	}
+
+	for _, mapping := range strings.Split(os.Getenv("JWT_ROLE_SCOPES"), ";") {
+		if len(strings.TrimSpace(mapping)) == 0 {
+			continue
+		}
+		role, scopes, ok := strings.Cut(mapping, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid JWT_ROLE_SCOPES entry: %s", mapping)
+		}
+		verifier.RoleScopes[strings.TrimSpace(role)] = splitList(scopes)
+	}
+
+	return &verifier, nil
+}
+
+// Verify returns the principal for a valid token, nil without an error when the token isn't valid.
+// An error means the keys couldn't be loaded.
+func (v *TokenVerifier) Verify(ctx context.Context, token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return rejectToken(ctx, "malformed")
+	}
+
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return rejectToken(ctx, "malformed header")
+	}
+	if header.Alg != RS256 && header.Alg != ES256 {
+		// never none or an HMAC, the public key would work as the secret
+		return rejectToken(ctx, "unsupported alg "+header.Alg)
+	}
+
+	key, err := v.Keys.Key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return rejectToken(ctx, "unknown key "+header.Kid)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature) {
+		return rejectToken(ctx, "bad signature")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return rejectToken(ctx, "malformed claims")
+	}
+	if reason := v.checkClaims(claims); len(reason) > 0 {
+		return rejectToken(ctx, reason)
+	}
+
+	principal := Principal{
+		Id:     stringClaim(claims, "sub"),
+		Name:   stringClaim(claims, "name"),
+		Scopes: []string{},
+	}
+	if len(principal.Name) == 0 {
+		principal.Name = stringClaim(claims, "preferred_username")
+	}
+	for _, role := range rolesClaim(claims, v.rolesClaim()) {
+		for _, scope := range v.RoleScopes[role] {
+			if !slices.Contains(principal.Scopes, scope) {
+				principal.Scopes = append(principal.Scopes, scope)
+			}
+		}
+	}
+
+	return &principal, nil
+}
+
+// private
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (v *TokenVerifier) checkClaims(claims map[string]any) string {
+	if stringClaim(claims, "iss") != v.Issuer {
+		return "wrong issuer"
+	}
+	if !audienceContains(claims["aud"], v.Audience) {
+		return "wrong audience"
+	}
+	if len(stringClaim(claims, "sub")) == 0 {
+		return "no subject"
+	}
+
+	leeway := v.Leeway
+	if leeway == 0 {
+		leeway = DEFAULT_TOKEN_LEEWAY
+	}
+	now := time.Now()
+
+	expires, ok := timeClaim(claims, "exp")
+	if !ok {
+		return "no expiry"
+	}
+	if now.After(expires.Add(leeway)) {
+		return "expired"
+	}
+	if notBefore, ok := timeClaim(claims, "nbf"); ok && now.Before(notBefore.Add(-leeway)) {
+		return "not valid yet"
+	}
+
+	return ""
+}
+
+func (v *TokenVerifier) rolesClaim() string {
+	if len(v.RolesClaim) == 0 {
+		return DEFAULT_ROLES_CLAIM
+	}
+	return v.RolesClaim
+}
+
+func rejectToken(ctx context.Context, reason string) (*Principal, error) {
+	telemetry.Logger(ctx).Info("Rejected token", zap.String("reason", reason))
+	return nil, nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) bool {
+	digest := sha256.Sum256([]byte(signed))
+
+	switch alg {
+	case RS256:
+		rsaKey, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) == nil
+	case ES256:
+		// JWS signatures are r and s concatenated, not ASN.1
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(ecKey, digest[:], r, s)
+	}
+
+	return false
+}
+
+func decodeSegment(segment string, value any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+func stringClaim(claims map[string]any, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+func timeClaim(claims map[string]any, name string) (time.Time, bool) {
+	seconds, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// audienceContains handles aud as a single string or a list
+func audienceContains(aud any, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		return slices.Contains(aud, any(audience))
+	}
+	return false
+}
+
+// rolesClaim follows a dotted path such as realm_access.roles, the roles can be a list or a space separated string
+func rolesClaim(claims map[string]any, path string) []string {
+	var value any = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+
+	switch value := value.(type) {
+	case string:
+		return strings.Fields(value)
+	case []any:
+		roles := []string{}
+		for _, role := range value {
+			if role, ok := role.(string); ok {
+				roles = append(roles, role)
+			}
+		}
+		return roles
+	}
+	return nil
+}
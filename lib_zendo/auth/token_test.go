@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/utils"
+)
+
+const (
+	issuerForTest   string = "https://sso.example.com"
+	audienceForTest string = "zendo-api"
+)
+
+func TestVerifyAcceptsRS256AndES256(t *testing.T) {
+	rsaKey := newRsaKeyForTest(t, "rsa")
+	ecKey := newEcKeyForTest(t, "ec")
+	verifier := verifierForTest(t, rsaKey, ecKey)
+
+	for _, key := range []*keyForTest{rsaKey, ecKey} {
+		principal, err := verifier.Verify(context.Background(), key.sign(t, nil, claimsForTest(nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if principal == nil {
+			t.Fatalf("expected a %s token to be accepted", key.alg)
+		}
+		if principal.Id != "user-1" || principal.Name != "Ada" {
+			t.Fatalf("expected the subject and name from the token, got %+v", principal)
+		}
+	}
+}
+
+func TestVerifyRejectsBadClaims(t *testing.T) {
+	key := newRsaKeyForTest(t, "rsa")
+	verifier := verifierForTest(t, key)
+	now := time.Now()
+
+	for _, test := range []struct {
+		name     string
+		claims   map[string]any
+		accepted bool
+	}{
+		{"expired", map[string]any{"exp": now.Add(-2 * time.Minute).Unix()}, false},
+		{"expired within the leeway", map[string]any{"exp": now.Add(-30 * time.Second).Unix()}, true},
+		{"no expiry", map[string]any{"exp": nil}, false},
+		{"not valid yet", map[string]any{"nbf": now.Add(5 * time.Minute).Unix()}, false},
+		{"not valid yet within the leeway", map[string]any{"nbf": now.Add(30 * time.Second).Unix()}, true},
+		{"wrong issuer", map[string]any{"iss": "https://evil.example.com"}, false},
+		{"wrong audience", map[string]any{"aud": "another-api"}, false},
+		{"audience in a list", map[string]any{"aud": []string{"another-api", audienceForTest}}, true},
+		{"wrong audience in a list", map[string]any{"aud": []string{"another-api"}}, false},
+		{"no subject", map[string]any{"sub": nil}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			principal, err := verifier.Verify(context.Background(), key.sign(t, nil, claimsForTest(test.claims)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accepted := principal != nil; accepted != test.accepted {
+				t.Fatalf("expected accepted to be %v, got %v", test.accepted, accepted)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsUnsafeTokens(t *testing.T) {
+	key := newRsaKeyForTest(t, "rsa")
+	other := newRsaKeyForTest(t, "rsa")
+	verifier := verifierForTest(t, key)
+	claims := claimsForTest(nil)
+
+	// HS256 keyed with the public key, which anyone can fetch from the JWKS
+	publicKey, err := x509.MarshalPKIXPublicKey(key.private.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacHeader := encodeSegmentForTest(t, map[string]any{"alg": "HS256", "kid": "rsa"})
+	hmacPayload := encodeSegmentForTest(t, claims)
+	mac := hmac.New(sha256.New, publicKey)
+	mac.Write([]byte(hmacHeader + "." + hmacPayload))
+
+	for _, test := range []struct {
+		name  string
+		token string
+	}{
+		{"alg none", encodeSegmentForTest(t, map[string]any{"alg": "none", "kid": "rsa"}) + "." + encodeSegmentForTest(t, claims) + "."},
+		{"HS256 with the public key", hmacHeader + "." + hmacPayload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))},
+		{"signed by another key", other.sign(t, nil, claims)},
+		{"ES256 header on an RSA key", key.sign(t, map[string]any{"alg": ES256}, claims)},
+		{"unknown kid", key.sign(t, map[string]any{"kid": "missing"}, claims)},
+		{"tampered claims", tamperForTest(t, key.sign(t, nil, claims), claimsForTest(map[string]any{"sub": "admin"}))},
+		{"malformed", "not-a-token"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			principal, err := verifier.Verify(context.Background(), test.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if principal != nil {
+				t.Fatalf("expected the token to be rejected, got %+v", principal)
+			}
+		})
+	}
+}
+
+func TestVerifyMapsRolesToScopes(t *testing.T) {
+	key := newEcKeyForTest(t, "ec")
+	verifier := verifierForTest(t, key)
+	verifier.RoleScopes = map[string][]string{
+		"dashboard-viewer": {model.READ_METRICS_SCOPE},
+		"dashboard-admin":  {model.READ_METRICS_SCOPE, model.ADMIN_KEYS_SCOPE},
+	}
+
+	for _, test := range []struct {
+		name       string
+		rolesClaim string
+		claims     map[string]any
+		scopes     []string
+	}{
+		{"list of roles", "", map[string]any{"roles": []string{"dashboard-viewer", "dashboard-admin"}}, []string{model.READ_METRICS_SCOPE, model.ADMIN_KEYS_SCOPE}},
+		{"space separated roles", "", map[string]any{"roles": "dashboard-viewer other"}, []string{model.READ_METRICS_SCOPE}},
+		{"nested claim", "realm_access.roles", map[string]any{"realm_access": map[string]any{"roles": []string{"dashboard-admin"}}}, []string{model.READ_METRICS_SCOPE, model.ADMIN_KEYS_SCOPE}},
+		{"unmapped role", "", map[string]any{"roles": []string{"someone-else"}}, []string{}},
+		{"no roles", "", map[string]any{}, []string{}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			verifier.RolesClaim = test.rolesClaim
+			principal, err := verifier.Verify(context.Background(), key.sign(t, nil, claimsForTest(test.claims)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if principal == nil {
+				t.Fatal("expected the token to be accepted")
+			}
+			if !slices.Equal(principal.Scopes, test.scopes) {
+				t.Fatalf("expected scopes %v, got %v", test.scopes, principal.Scopes)
+			}
+		})
+	}
+}
+
+func TestVerifyPicksUpRotatedKeys(t *testing.T) {
+	first := newRsaKeyForTest(t, "first")
+	second := newEcKeyForTest(t, "second")
+	provider := newProviderForTest(t, first)
+	source := &UrlKeySource{Url: provider.server.URL, Http: &utils.HttpClient{}}
+	verifier := TokenVerifier{Keys: source, Issuer: issuerForTest, Audience: audienceForTest}
+	ctx := context.Background()
+
+	if principal, err := verifier.Verify(ctx, first.sign(t, nil, claimsForTest(nil))); err != nil || principal == nil {
+		t.Fatalf("expected the token to be accepted, got %v and %v", principal, err)
+	}
+
+	provider.serve(first, second)
+	source.attemptedAt = time.Now().Add(-JWKS_MIN_REFRESH_INTERVAL)
+	if principal, err := verifier.Verify(ctx, second.sign(t, nil, claimsForTest(nil))); err != nil || principal == nil {
+		t.Fatalf("expected a token from the new key to be accepted after a refetch, got %v and %v", principal, err)
+	}
+	if fetches := provider.fetchCount(); fetches != 2 {
+		t.Fatalf("expected the unknown kid to fetch the set again, got %d fetches", fetches)
+	}
+}
+
+// private
+
+// verifierForTest trusts the given keys, served from a JWKS over http as a provider would
+func verifierForTest(t *testing.T, keys ...*keyForTest) *TokenVerifier {
+	t.Helper()
+	provider := newProviderForTest(t, keys...)
+	return &TokenVerifier{
+		Keys:     &UrlKeySource{Url: provider.server.URL, Http: &utils.HttpClient{}},
+		Issuer:   issuerForTest,
+		Audience: audienceForTest,
+	}
+}
+
+// claimsForTest are valid claims with the overrides applied, a nil override removes the claim
+func claimsForTest(overrides map[string]any) map[string]any {
+	now := time.Now()
+	claims := map[string]any{
+		"iss":  issuerForTest,
+		"aud":  audienceForTest,
+		"sub":  "user-1",
+		"name": "Ada",
+		"iat":  now.Unix(),
+		"exp":  now.Add(time.Hour).Unix(),
+	}
+	for name, value := range overrides {
+		if value == nil {
+			delete(claims, name)
+			continue
+		}
+		claims[name] = value
+	}
+	return claims
+}
+
+// sign makes a token with the key's alg and kid unless the header overrides them
+func (k *keyForTest) sign(t *testing.T, header map[string]any, claims map[string]any) string {
+	t.Helper()
+
+	fullHeader := map[string]any{"typ": "JWT", "alg": k.alg, "kid": k.kid}
+	for name, value := range header {
+		fullHeader[name] = value
+	}
+	signed := encodeSegmentForTest(t, fullHeader) + "." + encodeSegmentForTest(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch private := k.private.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, private, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, private, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// tamperForTest swaps the claims of a signed token, keeping the original signature
+func tamperForTest(t *testing.T, token string, claims map[string]any) string {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	return parts[0] + "." + encodeSegmentForTest(t, claims) + "." + parts[2]
+}
+
+func encodeSegmentForTest(t *testing.T, value any) string {
+	t.Helper()
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
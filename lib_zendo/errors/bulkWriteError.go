@@ -0,0 +1,18 @@
+package errors
+
+import "fmt"
+
+type BulkDocumentFailure struct {
+	Id     string `json:"id"`
+	Error  string `json:"error"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// BulkWriteError is returned when some documents in a bulk write were rejected, the rest of the batch was stored
+type BulkWriteError struct {
+	Failures []BulkDocumentFailure
+}
+
+func (e *BulkWriteError) Error() string {
+	return fmt.Sprintf("Bulk write failed for %d documents", len(e.Failures))
+}
@@ -0,0 +1,11 @@
+package errors
+
+import (
+	"context"
+	stdErrors "errors"
+)
+
+// IsCancelled reports whether err came from a cancelled context or a missed deadline rather than a failing dependency
+func IsCancelled(err error) bool {
+	return stdErrors.Is(err, context.Canceled) || stdErrors.Is(err, context.DeadlineExceeded)
+}
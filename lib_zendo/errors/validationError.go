@@ -0,0 +1,10 @@
+package errors
+
+// ValidationError is returned when the caller asked for something invalid, as opposed to a dependency failing
+type ValidationError struct {
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Reason
+}
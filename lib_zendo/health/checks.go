@@ -0,0 +1,75 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+	"zendo/lib_zendo/services"
+)
+
+// DEFAULT_MAX_DATA_AGE allows for the hour energy readings lag behind plus a missed fetch or two
+const DEFAULT_MAX_DATA_AGE time.Duration = 2 * time.Hour
+
+// MaxDataAgeFromEnv reads HEALTH_MAX_DATA_AGE as a Go duration like 90m
+func MaxDataAgeFromEnv() (time.Duration, error) {
+	setting := os.Getenv("HEALTH_MAX_DATA_AGE")
+	if len(setting) == 0 {
+		return DEFAULT_MAX_DATA_AGE, nil
+	}
+
+	age, err := time.ParseDuration(setting)
+	if err != nil || age <= 0 {
+		return 0, fmt.Errorf("invalid HEALTH_MAX_DATA_AGE: %s", setting)
+	}
+	return age, nil
+}
+
+// StorageChecks check storage can be reached and has been set up, both are critical
+func StorageChecks(storage services.IStorageHealth) []Check {
+	return []Check{
+		{
+			Name:     "storage",
+			Critical: true,
+			Run:      storage.Ping,
+		},
+		{
+			Name:     "storage-setup",
+			Critical: true,
+			Run:      storage.CheckSetup,
+		},
+	}
+}
+
+// FreshnessCheck fails when the newest document from latest is older than maxAge or there isn't one yet.
+// It isn't critical, old data can still be served and a fresh install has none.
+func FreshnessCheck(name string, maxAge time.Duration, latest func(ctx context.Context) (*time.Time, error)) Check {
+	return Check{
+		Name: name,
+		Run: func(ctx context.Context) error {
+			timestamp, err := latest(ctx)
+			if err != nil {
+				return err
+			}
+			if timestamp == nil {
+				return fmt.Errorf("no data yet")
+			}
+
+			if age := time.Since(*timestamp); age > maxAge {
+				return fmt.Errorf("latest is from %s, %s ago", timestamp.UTC().Format(time.RFC3339), age.Round(time.Minute))
+			}
+			return nil
+		},
+	}
+}
+
+// LatestMetricTime adapts GetLatestMetric for FreshnessCheck
+func LatestMetricTime(dataService services.IDataService) func(ctx context.Context) (*time.Time, error) {
+	return func(ctx context.Context) (*time.Time, error) {
+		metric, err := dataService.GetLatestMetric(ctx)
+		if err != nil || metric == nil {
+			return nil, err
+		}
+		return metric.Timestamp, nil
+	}
+}
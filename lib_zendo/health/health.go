@@ -0,0 +1,174 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	OK_STATUS       string = "ok"
+	DEGRADED_STATUS string = "degraded"
+	FAILED_STATUS   string = "failed"
+)
+
+// DEFAULT_CHECK_TIMEOUT stops a hung dependency from hanging the probe
+const DEFAULT_CHECK_TIMEOUT time.Duration = 5 * time.Second
+
+// Check is one thing a service depends on. A Critical check failing makes the service unready,
+// any other check failing only marks it degraded, e.g. stale data is worth knowing about but the service still works.
+type Check struct {
+	Name     string
+	Critical bool
+	Run      func(ctx context.Context) error
+}
+
+// Checker runs the checks behind /readyz, all at once with Timeout each
+type Checker struct {
+	Checks  []Check
+	Timeout time.Duration
+
+	mu         sync.Mutex
+	lastStatus string
+}
+
+type Report struct {
+	Status     string        `json:"status"`
+	DurationMs float64       `json:"durationMs"`
+	Checks     []CheckResult `json:"checks"`
+}
+
+type CheckResult struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	Critical   bool    `json:"critical"`
+	DurationMs float64 `json:"durationMs"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Live answers /healthz, the process is up if it can answer at all so nothing else is checked
+func Live(resp http.ResponseWriter, req *http.Request) {
+	writeReport(resp, http.StatusOK, Report{Status: OK_STATUS, Checks: []CheckResult{}})
+}
+
+// Ready answers /readyz with every check, 503 when a critical check failed
+func (c *Checker) Ready(resp http.ResponseWriter, req *http.Request) {
+	report := c.Run(req.Context())
+
+	status := http.StatusOK
+	if report.Status == FAILED_STATUS {
+		status = http.StatusServiceUnavailable
+	}
+	writeReport(resp, status, report)
+}
+
+// Run runs every check and works out the overall status
+func (c *Checker) Run(ctx context.Context) Report {
+	start := time.Now()
+	results := make([]CheckResult, len(c.Checks))
+
+	var wg sync.WaitGroup
+	for i, check := range c.Checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = c.run(ctx, check)
+		}()
+	}
+	wg.Wait()
+
+	report := Report{
+		Status:     OK_STATUS,
+		DurationMs: milliseconds(time.Since(start)),
+		Checks:     results,
+	}
+	for _, result := range results {
+		switch {
+		case result.Status == OK_STATUS:
+		case result.Critical:
+			report.Status = FAILED_STATUS
+		case report.Status == OK_STATUS:
+			report.Status = DEGRADED_STATUS
+		}
+	}
+
+	c.logChange(report)
+	return report
+}
+
+// private
+
+func (c *Checker) run(ctx context.Context, check Check) (result CheckResult) {
+	result = CheckResult{
+		Name:     check.Name,
+		Status:   OK_STATUS,
+		Critical: check.Critical,
+	}
+	start := time.Now()
+
+	// storage logs failures with DPanic, which panics in development, and checks run outside the request goroutine
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			result.Status = FAILED_STATUS
+			result.Error = fmt.Sprint(recovered)
+		}
+		result.DurationMs = milliseconds(time.Since(start))
+	}()
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_CHECK_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := check.Run(ctx); err != nil {
+		result.Status = FAILED_STATUS
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// logChange only logs when the status changes, probes run every few seconds
+func (c *Checker) logChange(report Report) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if report.Status == c.lastStatus {
+		return
+	}
+	c.lastStatus = report.Status
+
+	failed := []string{}
+	for _, result := range report.Checks {
+		if result.Status != OK_STATUS {
+			failed = append(failed, result.Name+": "+result.Error)
+		}
+	}
+	switch report.Status {
+	case OK_STATUS:
+		zap.L().Info("Service is ready")
+	case DEGRADED_STATUS:
+		zap.L().Warn("Service is degraded", zap.Strings("checks", failed))
+	default:
+		zap.L().Warn("Service is not ready", zap.Strings("checks", failed))
+	}
+}
+
+func writeReport(resp http.ResponseWriter, status int, report Report) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.WriteHeader(status)
+	if err := json.NewEncoder(resp).Encode(report); err != nil {
+		zap.L().Error("Failed to encode health report", zap.Error(err))
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
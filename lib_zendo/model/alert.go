@@ -0,0 +1,16 @@
+package model
+
+import "time"
+
+const (
+	DEFICIT_ALERT string = "DEFICIT"
+	SURPLUS_ALERT string = "SURPLUS"
+)
+
+// Alert flags a notable change in the latest metrics, it is only ever pushed to live clients and never stored
+type Alert struct {
+	Kind       string    `json:"kind"`
+	Message    string    `json:"message"`
+	Timestamp  time.Time `json:"timestamp"`
+	NetBalance int32     `json:"netBalance"`
+}
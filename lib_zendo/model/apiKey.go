@@ -0,0 +1,42 @@
+package model
+
+import (
+	"slices"
+	"time"
+)
+
+const API_KEY_TYPE string = "API_KEY"
+
+const (
+	READ_METRICS_SCOPE string = "read:metrics"
+	ADMIN_INGEST_SCOPE string = "admin:ingest"
+	ADMIN_SEED_SCOPE   string = "admin:seed"
+	ADMIN_KEYS_SCOPE   string = "admin:keys"
+)
+
+// SCOPES lists every scope a key can hold
+var SCOPES = []string{
+	READ_METRICS_SCOPE,
+	ADMIN_INGEST_SCOPE,
+	ADMIN_SEED_SCOPE,
+	ADMIN_KEYS_SCOPE,
+}
+
+// ApiKey is a stored key. Only a hash of the secret is kept so a key can't be recovered from storage,
+// revoked keys are kept so the list shows who had access.
+type ApiKey struct {
+	Id        string     `json:"id"`
+	Name      string     `json:"name"`
+	Hash      string     `json:"hash"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+func (k *ApiKey) DocumentId() string {
+	return API_KEY_TYPE + ":" + k.Id
+}
+
+func (k *ApiKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
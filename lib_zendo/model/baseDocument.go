@@ -3,8 +3,9 @@ package model
 import "time"
 
 const (
-	ENERGY_TYPE  string = "ENERGY_DATA"
-	WEATHER_TYPE string = "WEATHER_DATA"
+	ENERGY_TYPE     string = "ENERGY_DATA"
+	WEATHER_TYPE    string = "WEATHER_DATA"
+	AGGREGATED_TYPE string = "AGGREGATED_DATA"
 )
 
 type BaseDocument struct {
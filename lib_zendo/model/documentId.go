@@ -0,0 +1,44 @@
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+// DocumentId builds a deterministic id from the document type, its source (zone or location) and timestamp.
+// Writing the same data point twice therefore resolves to the same document rather than a duplicate.
+func DocumentId(docType string, source string, timestamp time.Time) string {
+	var builder strings.Builder
+	builder.WriteString(docType)
+	builder.WriteString(":")
+	if len(source) > 0 {
+		builder.WriteString(source)
+		builder.WriteString(":")
+	}
+	builder.WriteString(timestamp.UTC().Format(time.RFC3339))
+	return builder.String()
+}
+
+func (e *LatestEnergeyResponse) DocumentId() string {
+	timestamp := e.SourceTime
+	if e.Timestamp != nil {
+		timestamp = *e.Timestamp
+	}
+	return DocumentId(ENERGY_TYPE, e.Zone, timestamp)
+}
+
+func (w *WeatherResponse) DocumentId() string {
+	var timestamp time.Time
+	if w.Timestamp != nil {
+		timestamp = *w.Timestamp
+	}
+	return DocumentId(WEATHER_TYPE, w.Location, timestamp)
+}
+
+func (m *Metric) DocumentId() string {
+	var timestamp time.Time
+	if m.Timestamp != nil {
+		timestamp = *m.Timestamp
+	}
+	return DocumentId(AGGREGATED_TYPE, "", timestamp)
+}
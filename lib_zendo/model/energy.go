@@ -34,6 +34,7 @@ type PowerConsumptionBreakdown struct {
 
 type LatestEnergeyResponse struct {
 	BaseDocument
+	Zone                      string                    `json:"zone,omitempty"`
 	SourceTime                time.Time                 `json:"datetime"`
 	PowerProductionBreakdown  PowerProductionBreakdown  `json:"powerProductionBreakdown"`
 	PowerConsumptionBreakdown PowerConsumptionBreakdown `json:"powerConsumptionBreakdown"`
@@ -0,0 +1,103 @@
+package model
+
+import "time"
+
+const ROLLUP_TYPE string = "ROLLUP_DATA"
+
+type Stats struct {
+	Mean  float64 `json:"mean"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int     `json:"count"`
+}
+
+// MetricRollup summarises the metrics in one bucket, Timestamp is the start of the bucket.
+// Production and consumption are keyed by source and weather by field, using the same names as Metric.
+type MetricRollup struct {
+	BaseDocument
+
+	Resolution       string           `json:"resolution"`
+	Count            int              `json:"count"`
+	TotalProduction  Stats            `json:"totalProduction"`
+	TotalConsumption Stats            `json:"totalConsumption"`
+	NetBalance       Stats            `json:"netBalance"`
+	Production       map[string]Stats `json:"production"`
+	Consumption      map[string]Stats `json:"consumption"`
+	Weather          map[string]Stats `json:"weather"`
+}
+
+func (s *Stats) Add(value float64) {
+	if s.Count == 0 || value < s.Min {
+		s.Min = value
+	}
+	if s.Count == 0 || value > s.Max {
+		s.Max = value
+	}
+	s.Count++
+	s.Mean += (value - s.Mean) / float64(s.Count)
+}
+
+func (r *MetricRollup) DocumentId() string {
+	var timestamp time.Time
+	if r.Timestamp != nil {
+		timestamp = *r.Timestamp
+	}
+	return DocumentId(ROLLUP_TYPE, r.Resolution, timestamp)
+}
+
+// SOURCE_NAMES are the keys of Sources in a stable order, for output that needs fixed columns
+var SOURCE_NAMES = []string{
+	"nuclear",
+	"geothermal",
+	"biomass",
+	"coal",
+	"wind",
+	"solar",
+	"hydro",
+	"gas",
+	"oil",
+	"unknown",
+	"hydro discharge",
+	"battery discharge",
+}
+
+// WEATHER_FIELDS are the keys of Fields in a stable order
+var WEATHER_FIELDS = []string{
+	"temperature_2m",
+	"direct_radiation",
+	"cloud_cover",
+	"wind_speed_10m",
+}
+
+// Sources lists the breakdown by source name, sources missing from the data are nil
+func (b *PowerProductionBreakdown) Sources() map[string]*uint32 {
+	return map[string]*uint32{
+		"nuclear":           b.Nuclear,
+		"geothermal":        b.Geothermal,
+		"biomass":           b.Biomass,
+		"coal":              b.Coal,
+		"wind":              b.Wind,
+		"solar":             b.Solar,
+		"hydro":             b.Hydro,
+		"gas":               b.Gas,
+		"oil":               b.Oil,
+		"unknown":           b.Unknown,
+		"hydro discharge":   b.HydroDischarge,
+		"battery discharge": b.BatteryDischarge,
+	}
+}
+
+func (b *PowerConsumptionBreakdown) Sources() map[string]*uint32 {
+	production := PowerProductionBreakdown(*b)
+	return production.Sources()
+}
+
+// Fields lists the weather values by field name
+func (w *WeatherData) Fields() map[string]float64 {
+	return map[string]float64{
+		"temperature_2m":   float64(w.Temperature),
+		"direct_radiation": float64(w.DirectRadiation),
+		"cloud_cover":      float64(w.CloudCoverPercent),
+		"wind_speed_10m":   float64(w.WindSpeedKmPHr),
+	}
+}
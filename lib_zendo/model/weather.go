@@ -10,5 +10,6 @@ type WeatherData struct {
 
 type WeatherResponse struct {
 	BaseDocument
+	Location    string      `json:"location,omitempty"`
 	WeatherData WeatherData `json:"current"`
 }
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"os"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	CONSOLE_ENCODING string = "console"
+	JSON_ENCODING    string = "json"
+)
+
+// SetupLogger replaces the global logger. LOG_LEVEL is debug, info, warn or error and defaults to info,
+// LOG_ENCODING is console or json and defaults to console, use json wherever the logs are collected.
+// With ZENDO_ENV=dev DPanic panics so mistakes show up straight away.
+func SetupLogger() error {
+	level := zapcore.InfoLevel
+	if setting := os.Getenv("LOG_LEVEL"); len(setting) > 0 {
+		parsed, err := zapcore.ParseLevel(setting)
+		if err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL: %s", setting)
+		}
+		level = parsed
+	}
+
+	encoding := os.Getenv("LOG_ENCODING")
+	var encoderCfg zapcore.EncoderConfig
+	switch encoding {
+	case "", CONSOLE_ENCODING:
+		encoding = CONSOLE_ENCODING
+		encoderCfg = zap.NewDevelopmentEncoderConfig()
+	case JSON_ENCODING:
+		encoderCfg = zap.NewProductionEncoderConfig()
+	default:
+		return fmt.Errorf("invalid LOG_ENCODING: %s, expected console or json", encoding)
+	}
+
+	encoderCfg.TimeKey = "timestamp"
+	encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	config := zap.Config{
+		Level:             zap.NewAtomicLevelAt(level),
+		Development:       os.Getenv("ZENDO_ENV") == "dev",
+		DisableCaller:     false,
+		DisableStacktrace: false,
+		Sampling:          nil,
+		Encoding:          encoding,
+		EncoderConfig:     encoderCfg,
+		OutputPaths: []string{
+			"stderr",
+		},
+		ErrorOutputPaths: []string{
+			"stderr",
+		},
+		InitialFields: map[string]any{
+			"pid": os.Getpid(),
+		},
+	}
+	logger, err := config.Build()
+	if err != nil {
+		return err
+	}
+
+	zap.ReplaceGlobals(logger)
+	return nil
+}
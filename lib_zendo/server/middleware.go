@@ -0,0 +1,14 @@
+package server
+
+import "net/http"
+
+// Middleware wraps a handler, e.g. telemetry.AccessLog or CORS headers
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps handler in middlewares. The first is outermost, so requests pass through them in the order given.
+func Chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
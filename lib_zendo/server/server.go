@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_READ_TIMEOUT  time.Duration = 15 * time.Second
+	DEFAULT_WRITE_TIMEOUT time.Duration = 15 * time.Second
+	DEFAULT_IDLE_TIMEOUT  time.Duration = 60 * time.Second
+	// DEFAULT_SHUTDOWN_TIMEOUT leaves time to log and exit inside the 10 seconds docker waits before killing a container
+	DEFAULT_SHUTDOWN_TIMEOUT time.Duration = 8 * time.Second
+)
+
+type Timeouts struct {
+	// Read covers the headers and body of a request
+	Read time.Duration
+	// Write covers the response, streaming routes push their own deadline forward as they write
+	Write time.Duration
+	// Idle is how long a keep alive connection waits for the next request
+	Idle time.Duration
+	// Shutdown is how long in flight requests get to finish once a signal arrives
+	Shutdown time.Duration
+}
+
+// Server runs Handler on Addr until SIGINT or SIGTERM, then stops accepting connections and drains in flight requests
+type Server struct {
+	Addr     string
+	Handler  http.Handler
+	Timeouts Timeouts
+	// OnShutdown is called as shutdown starts, to end streams and websockets that would otherwise hold it up
+	OnShutdown []func()
+}
+
+// TimeoutsFromEnv reads SERVER_READ_TIMEOUT, SERVER_WRITE_TIMEOUT, SERVER_IDLE_TIMEOUT and SERVER_SHUTDOWN_TIMEOUT
+// as Go durations like 30s, falling back to the defaults when unset
+func TimeoutsFromEnv() (Timeouts, error) {
+	timeouts := Timeouts{}
+	for _, setting := range []struct {
+		variable string
+		value    *time.Duration
+		fallback time.Duration
+	}{
+		{"SERVER_READ_TIMEOUT", &timeouts.Read, DEFAULT_READ_TIMEOUT},
+		{"SERVER_WRITE_TIMEOUT", &timeouts.Write, DEFAULT_WRITE_TIMEOUT},
+		{"SERVER_IDLE_TIMEOUT", &timeouts.Idle, DEFAULT_IDLE_TIMEOUT},
+		{"SERVER_SHUTDOWN_TIMEOUT", &timeouts.Shutdown, DEFAULT_SHUTDOWN_TIMEOUT},
+	} {
+		raw := os.Getenv(setting.variable)
+		if len(raw) == 0 {
+			*setting.value = setting.fallback
+			continue
+		}
+
+		duration, err := time.ParseDuration(raw)
+		if err != nil || duration <= 0 {
+			return Timeouts{}, fmt.Errorf("invalid %s: %s", setting.variable, raw)
+		}
+		*setting.value = duration
+	}
+
+	return timeouts, nil
+}
+
+// Run blocks until the server has stopped. It returns nil after a clean shutdown, or an error if the server
+// couldn't listen or requests were still running after the shutdown timeout, in which case they are cut off.
+// A second signal while draining kills the process straight away.
+func (s *Server) Run() error {
+	timeouts := s.timeouts()
+	server := &http.Server{
+		Addr:              s.Addr,
+		Handler:           s.Handler,
+		ReadHeaderTimeout: timeouts.Read,
+		ReadTimeout:       timeouts.Read,
+		WriteTimeout:      timeouts.Write,
+		IdleTimeout:       timeouts.Idle,
+	}
+	for _, f := range s.OnShutdown {
+		server.RegisterOnShutdown(f)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	failed := make(chan error, 1)
+	go func() {
+		zap.L().Info("Server starting", zap.String("addr", s.Addr))
+		failed <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-failed:
+		return err
+	case <-ctx.Done():
+	}
+	// restore the default handling so another signal isn't swallowed
+	stop()
+
+	zap.L().Info("Shutting down, draining requests", zap.Duration("timeout", timeouts.Shutdown))
+	drainCtx, cancel := context.WithTimeout(context.Background(), timeouts.Shutdown)
+	defer cancel()
+
+	if err := server.Shutdown(drainCtx); err != nil {
+		zap.L().Warn("Requests still running at the shutdown timeout, closing them", zap.Error(err))
+		server.Close()
+		return err
+	}
+	if err := <-failed; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	zap.L().Info("Server stopped")
+	return nil
+}
+
+// private
+
+func (s *Server) timeouts() Timeouts {
+	timeouts := s.Timeouts
+	if timeouts.Read <= 0 {
+		timeouts.Read = DEFAULT_READ_TIMEOUT
+	}
+	if timeouts.Write <= 0 {
+		timeouts.Write = DEFAULT_WRITE_TIMEOUT
+	}
+	if timeouts.Idle <= 0 {
+		timeouts.Idle = DEFAULT_IDLE_TIMEOUT
+	}
+	if timeouts.Shutdown <= 0 {
+		timeouts.Shutdown = DEFAULT_SHUTDOWN_TIMEOUT
+	}
+	return timeouts
+}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"math"
+	"sort"
+	"time"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/utils"
+)
+
+// private
+
+// aggregateWindow matches the day of readings the data processor correlates over
+const aggregateWindow time.Duration = 24 * time.Hour
+
+// aggregateMetric builds the metric for an energy reading. The data processor only works on CouchDB, the other backends
+// call this as each reading is stored. The reading is paired with the latest weather at or before it like the data processor.
+// The correlations cover the readings in the day up to it. energy and weather must be sorted by time and reach back a day
+// before the reading, with the weather going back to the last reading before that. Readings before any weather give nil.
+func aggregateMetric(reading *model.LatestEnergeyResponse, energy []model.LatestEnergeyResponse, weather []model.WeatherResponse) *model.Metric {
+	t := reading.Timestamp
+	if t == nil {
+		return nil
+	}
+	paired := weatherAt(weather, *t)
+	if paired == nil {
+		return nil
+	}
+
+	var radiation, solar, temperature, consumption []float64
+	start := sort.Search(len(energy), func(i int) bool {
+		return !energyTimestamp(&energy[i]).Before(t.Add(-aggregateWindow))
+	})
+	for i := start; i < len(energy) && !energyTimestamp(&energy[i]).After(*t); i++ {
+		other := &energy[i]
+		otherWeather := weatherAt(weather, *other.Timestamp)
+		if otherWeather == nil {
+			continue
+		}
+
+		// a missing source produced nothing
+		var solarProduction uint32
+		if other.PowerProductionBreakdown.Solar != nil {
+			solarProduction = *other.PowerProductionBreakdown.Solar
+		}
+
+		radiation = append(radiation, float64(otherWeather.WeatherData.DirectRadiation))
+		solar = append(solar, float64(solarProduction))
+		temperature = append(temperature, float64(otherWeather.WeatherData.Temperature))
+		consumption = append(consumption, float64(other.PowerConsumptionTotal))
+	}
+
+	return &model.Metric{
+		BaseDocument: model.BaseDocument{
+			Type:           utils.StringPointer(model.AGGREGATED_TYPE),
+			Timestamp:      utils.TimePointer(*t),
+			HistoricalSeed: reading.HistoricalSeed,
+		},
+		TotalProduction:      reading.PowerProductionTotal,
+		TotalConsumption:     reading.PowerConsumptionTotal,
+		NetBalance:           int32(reading.PowerProductionTotal) - int32(reading.PowerConsumptionTotal),
+		WeatherData:          paired.WeatherData,
+		PowerProductionData:  reading.PowerProductionBreakdown,
+		PowerConsumptionData: reading.PowerConsumptionBreakdown,
+		CorrelationData: model.CorrelationData{
+			SolarIrradianceVsSolarProductionCorrelation: correlation(radiation, solar),
+			TemperatureVsConsumptionCorrelation:         correlation(temperature, consumption),
+		},
+	}
+}
+
+// aggregateRange is the span of stored readings aggregateMetric needs for the readings given, ok is false when none have a timestamp
+func aggregateRange(readings []model.LatestEnergeyResponse) (time.Time, time.Time, bool) {
+	var from, to time.Time
+	ok := false
+	for i := range readings {
+		t := readings[i].Timestamp
+		if t == nil {
+			continue
+		}
+		if !ok || t.Before(from) {
+			from = *t
+		}
+		if !ok || t.After(to) {
+			to = *t
+		}
+		ok = true
+	}
+
+	return from.Add(-aggregateWindow), to, ok
+}
+
+// weatherAt returns the latest weather reading at or before t, nil when there is none
+func weatherAt(weather []model.WeatherResponse, t time.Time) *model.WeatherResponse {
+	i := sort.Search(len(weather), func(i int) bool {
+		return weatherTimestamp(&weather[i]).After(t)
+	})
+	if i == 0 {
+		return nil
+	}
+	return &weather[i-1]
+}
+
+// correlation is the Pearson coefficient of x and y, 0 when there are too few readings or either doesn't vary
+func correlation(x []float64, y []float64) float32 {
+	n := float64(len(x))
+	if len(x) < 2 || len(x) != len(y) {
+		return 0
+	}
+
+	var meanX, meanY float64
+	for i := range x {
+		meanX += x[i] / n
+		meanY += y[i] / n
+	}
+
+	var covariance, varianceX, varianceY float64
+	for i := range x {
+		covariance += (x[i] - meanX) * (y[i] - meanY)
+		varianceX += (x[i] - meanX) * (x[i] - meanX)
+		varianceY += (y[i] - meanY) * (y[i] - meanY)
+	}
+	if varianceX == 0 || varianceY == 0 {
+		return 0
+	}
+
+	return float32(covariance / math.Sqrt(varianceX*varianceY))
+}
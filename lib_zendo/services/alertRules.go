@@ -0,0 +1,46 @@
+package services
+
+import (
+	"fmt"
+	"zendo/lib_zendo/model"
+)
+
+// BalanceAlertRule raises an alert whenever the net balance crosses zero,
+// so clients hear once when consumption outstrips production and once when it recovers.
+type BalanceAlertRule struct {
+	lastBalance *int32
+}
+
+func (r *BalanceAlertRule) Check(metric *model.Metric) *model.Alert {
+	if metric.Timestamp == nil {
+		return nil
+	}
+
+	previous := r.lastBalance
+	balance := metric.NetBalance
+	r.lastBalance = &balance
+
+	// the first metric only sets the baseline
+	if previous == nil {
+		return nil
+	}
+
+	switch {
+	case *previous >= 0 && balance < 0:
+		return &model.Alert{
+			Kind:       model.DEFICIT_ALERT,
+			Message:    fmt.Sprintf("Consumption is exceeding production by %d MW", -balance),
+			Timestamp:  *metric.Timestamp,
+			NetBalance: balance,
+		}
+	case *previous < 0 && balance >= 0:
+		return &model.Alert{
+			Kind:       model.SURPLUS_ALERT,
+			Message:    fmt.Sprintf("Production is back above consumption by %d MW", balance),
+			Timestamp:  *metric.Timestamp,
+			NetBalance: balance,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"zendo/lib_zendo/errors"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/telemetry"
+
+	"go.uber.org/zap"
+)
+
+// API_KEY_PREFIX starts every key so they are easy to spot in config and secret scanners
+const API_KEY_PREFIX string = "zk_"
+
+// ApiKeyService issues and checks api keys. A key is zk_<id>_<secret>, the id is stored in the clear to look the key up
+// and only a hash of the secret is stored. Checked keys are cached for a minute, so a key revoked by another process
+// can keep working for up to a minute.
+type ApiKeyService struct {
+	Store IApiKeyStore
+
+	mu    sync.Mutex
+	cache map[string]cachedApiKey
+}
+
+// CreateApiKey stores a new key and returns it in full, this is the only time the secret is available
+func (s *ApiKeyService) CreateApiKey(ctx context.Context, name string, scopes []string) (string, *model.ApiKey, error) {
+	if len(strings.TrimSpace(name)) == 0 {
+		return "", nil, &errors.ValidationError{Reason: "a key needs a name"}
+	}
+	if len(scopes) == 0 {
+		return "", nil, &errors.ValidationError{Reason: "a key needs at least one scope"}
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(model.SCOPES, scope) {
+			return "", nil, &errors.ValidationError{Reason: "unknown scope: " + scope}
+		}
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	encodedSecret := base64.RawURLEncoding.EncodeToString(secret)
+
+	key := model.ApiKey{
+		Id:        hex.EncodeToString(id),
+		Name:      name,
+		Hash:      hashSecret(encodedSecret),
+		Scopes:    slices.Compact(slices.Sorted(slices.Values(scopes))),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := s.Store.PostApiKey(ctx, &key); err != nil {
+		return "", nil, err
+	}
+
+	telemetry.Logger(ctx).Info("Created api key", zap.String("id", key.Id), zap.String("name", key.Name), zap.Strings("scopes", key.Scopes))
+	return API_KEY_PREFIX + key.Id + "_" + encodedSecret, &key, nil
+}
+
+// Authenticate returns the stored key for a presented key, nil when it is malformed, unknown, wrong or revoked
+func (s *ApiKeyService) Authenticate(ctx context.Context, presented string) (*model.ApiKey, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(presented, API_KEY_PREFIX), "_")
+	if !strings.HasPrefix(presented, API_KEY_PREFIX) || !ok {
+		return nil, nil
+	}
+
+	key, err := s.lookup(ctx, id)
+	if err != nil || key == nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(key.Hash)) != 1 {
+		return nil, nil
+	}
+	if key.RevokedAt != nil {
+		return nil, nil
+	}
+
+	return key, nil
+}
+
+func (s *ApiKeyService) GetApiKeys(ctx context.Context) (*[]model.ApiKey, error) {
+	return s.Store.GetApiKeys(ctx)
+}
+
+// RevokeApiKey stops a key working, it reports whether the key was found
+func (s *ApiKeyService) RevokeApiKey(ctx context.Context, id string) (bool, error) {
+	found, err := s.Store.RevokeApiKey(ctx, id, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	delete(s.cache, id)
+	s.mu.Unlock()
+
+	if found {
+		telemetry.Logger(ctx).Info("Revoked api key", zap.String("id", id))
+	}
+	return found, nil
+}
+
+// private
+
+const apiKeyCacheTtl time.Duration = time.Minute
+
+type cachedApiKey struct {
+	key     *model.ApiKey
+	expires time.Time
+}
+
+// lookup caches misses as well so a stream of bad keys doesn't reach storage on every request
+func (s *ApiKeyService) lookup(ctx context.Context, id string) (*model.ApiKey, error) {
+	s.mu.Lock()
+	cached, ok := s.cache[id]
+	s.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.key, nil
+	}
+
+	key, err := s.Store.GetApiKey(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cache == nil {
+		s.cache = map[string]cachedApiKey{}
+	}
+	// drop expired entries as we go so ids that are never seen again don't pile up
+	for cachedId, entry := range s.cache {
+		if time.Now().After(entry.expires) {
+			delete(s.cache, cachedId)
+		}
+	}
+	s.cache[id] = cachedApiKey{
+		key:     key,
+		expires: time.Now().Add(apiKeyCacheTtl),
+	}
+
+	return key, nil
+}
+
+// hashSecret uses a plain SHA-256, the secrets are 256 random bits so a slow password hash adds nothing
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,124 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+	"zendo/lib_zendo/model"
+
+	"go.uber.org/zap"
+)
+
+// DEFAULT_CACHE_TTL bounds how stale the cache can get if an invalidation is missed
+const DEFAULT_CACHE_TTL time.Duration = time.Minute
+
+// CachingDataService keeps the latest metric in memory in front of another data service, every other call goes
+// straight through. Call Invalidate when new aggregated data is written, or InvalidateOn to follow an EventHub.
+// The cached metric is shared between callers so it must not be modified.
+type CachingDataService struct {
+	IDataService
+	Ttl time.Duration
+
+	mu         sync.Mutex
+	latest     *model.Metric
+	expires    time.Time
+	generation uint64
+
+	// loading lets one caller read storage on a miss while the rest wait for its result
+	loading sync.Mutex
+}
+
+func (s *CachingDataService) GetLatestMetric(ctx context.Context) (*model.Metric, error) {
+	if metric, ok := s.cached(); ok {
+		return metric, nil
+	}
+
+	s.loading.Lock()
+	defer s.loading.Unlock()
+	if metric, ok := s.cached(); ok {
+		return metric, nil
+	}
+
+	generation := s.currentGeneration()
+	metric, err := s.IDataService.GetLatestMetric(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// an invalidation during the read means the metric may already be stale
+	if generation == s.generation {
+		s.latest = metric
+		s.expires = time.Now().Add(s.ttl())
+	}
+
+	return metric, nil
+}
+
+// Invalidate drops the cached metric so the next read goes to storage
+func (s *CachingDataService) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.generation++
+	s.latest = nil
+	s.expires = time.Time{}
+}
+
+// InvalidateOn invalidates the cache on every new metric from hub until ctx is done.
+// If the hub drops this subscriber it invalidates, as events may have been missed, and subscribes again.
+func (s *CachingDataService) InvalidateOn(ctx context.Context, hub *EventHub) {
+	for {
+		events, unsubscribe := hub.Subscribe()
+		s.invalidateUntilClosed(ctx, events)
+		unsubscribe()
+
+		if ctx.Err() != nil {
+			return
+		}
+		zap.L().Warn("Cache invalidation fell behind, resubscribing")
+		s.Invalidate()
+	}
+}
+
+// private
+
+func (s *CachingDataService) invalidateUntilClosed(ctx context.Context, events <-chan LiveEvent) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Topic == METRICS_TOPIC {
+				s.Invalidate()
+			}
+		}
+	}
+}
+
+func (s *CachingDataService) cached() (*model.Metric, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Now().After(s.expires) {
+		return nil, false
+	}
+	return s.latest, true
+}
+
+func (s *CachingDataService) currentGeneration() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.generation
+}
+
+func (s *CachingDataService) ttl() time.Duration {
+	if s.Ttl <= 0 {
+		return DEFAULT_CACHE_TTL
+	}
+	return s.Ttl
+}
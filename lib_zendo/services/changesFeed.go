@@ -0,0 +1,386 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/telemetry"
+	"zendo/lib_zendo/utils"
+
+	"go.uber.org/zap"
+)
+
+type ChangesFeedMode string
+
+const (
+	CONTINUOUS_FEED ChangesFeedMode = "continuous"
+	LONGPOLL_FEED   ChangesFeedMode = "longpoll"
+
+	ENERGY_DOCUMENTS_FILTER  string = "filters/only_energy_documents"
+	WEATHER_DOCUMENTS_FILTER string = "filters/only_weather_documents"
+	LIVE_DOCUMENTS_FILTER    string = "filters/only_live_documents"
+
+	defaultHeartbeat       time.Duration = 10 * time.Second
+	changesFeedMinBackoff  time.Duration = time.Second
+	changesFeedMaxBackoff  time.Duration = time.Minute
+	changesFeedMaxLineSize int           = 8 * 1024 * 1024
+)
+
+// Change is a single row from the changes feed, the document is decoded into the matching model type
+type Change struct {
+	Seq     string
+	Id      string
+	Deleted bool
+	Type    *string
+	Energy  *model.LatestEnergeyResponse
+	Weather *model.WeatherResponse
+	Metric  *model.Metric
+}
+
+// ChangeHandler is called for every change in order, returning an error stops the change being checkpointed
+// and the feed reconnects from the last checkpoint so the change is delivered again.
+type ChangeHandler func(change Change) error
+
+type ICheckpointStore interface {
+	Load() (string, error)
+	Save(seq string) error
+}
+
+// CouchDBChangesFeed follows the CouchDB _changes feed, reconnecting with backoff whenever the connection drops
+// or the heartbeat goes quiet. The last handled seq is saved to Checkpoints so a restart picks up where it left off.
+// The wait before reconnecting starts at Backoff, or a second when unset, and doubles up to a minute.
+type CouchDBChangesFeed struct {
+	Http        utils.IHttpClient
+	Mode        ChangesFeedMode
+	Filter      string
+	Heartbeat   time.Duration
+	Backoff     time.Duration
+	Checkpoints ICheckpointStore
+}
+
+// Subscribe blocks delivering changes to handler until ctx is cancelled
+func (f *CouchDBChangesFeed) Subscribe(ctx context.Context, handler ChangeHandler) error {
+	since, err := f.loadSince(ctx)
+	if err != nil {
+		return err
+	}
+
+	backoff := f.minBackoff()
+	for {
+		connected, err := f.follow(ctx, &since, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if connected {
+			backoff = f.minBackoff()
+		}
+		if err == nil {
+			// longpoll batch complete
+			continue
+		}
+
+		telemetry.Logger(ctx).Warn("Changes feed disconnected, reconnecting", zap.Error(err), zap.String("since", since), zap.Duration("backoff", backoff))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, changesFeedMaxBackoff)
+	}
+}
+
+// Changes is a channel based alternative to Subscribe, the channel is closed once ctx is cancelled
+func (f *CouchDBChangesFeed) Changes(ctx context.Context) <-chan Change {
+	changes := make(chan Change)
+
+	go func() {
+		defer close(changes)
+		f.Subscribe(ctx, func(change Change) error {
+			select {
+			case changes <- change:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	return changes
+}
+
+type FileCheckpointStore struct {
+	Path string
+}
+
+func (s *FileCheckpointStore) Load() (string, error) {
+	data, err := os.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (s *FileCheckpointStore) Save(seq string) error {
+	// write then rename so a crash never leaves a half written checkpoint
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(seq); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// private
+
+type couchDBChangeRow struct {
+	Seq     json.RawMessage `json:"seq"`
+	Id      string          `json:"id"`
+	Deleted bool            `json:"deleted"`
+	Doc     json.RawMessage `json:"doc"`
+	LastSeq json.RawMessage `json:"last_seq"`
+}
+
+type couchDBLongpollResponse struct {
+	Results []couchDBChangeRow `json:"results"`
+	LastSeq json.RawMessage    `json:"last_seq"`
+}
+
+func (f *CouchDBChangesFeed) loadSince(ctx context.Context) (string, error) {
+	if f.Checkpoints == nil {
+		return "now", nil
+	}
+
+	since, err := f.Checkpoints.Load()
+	if err != nil {
+		telemetry.Logger(ctx).Error("Failed to load changes feed checkpoint", zap.Error(err))
+		return "", err
+	}
+	if len(since) == 0 {
+		return "now", nil
+	}
+
+	return since, nil
+}
+
+func (f *CouchDBChangesFeed) heartbeat() time.Duration {
+	if f.Heartbeat <= 0 {
+		return defaultHeartbeat
+	}
+	return f.Heartbeat
+}
+
+func (f *CouchDBChangesFeed) minBackoff() time.Duration {
+	if f.Backoff <= 0 {
+		return changesFeedMinBackoff
+	}
+	return f.Backoff
+}
+
+// follow holds one connection to the feed, connected reports whether the feed was reached before it dropped
+func (f *CouchDBChangesFeed) follow(ctx context.Context, since *string, handler ChangeHandler) (bool, error) {
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	response, err := f.Http.Stream(reqCtx, f.changesUrl(*since))
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode > 299 {
+		return false, couchDBStatusError(response.StatusCode)
+	}
+
+	// CouchDB writes a newline every heartbeat, if nothing arrives for two of them the connection is treated as dead
+	quiet := 2 * f.heartbeat()
+	watchdog := time.AfterFunc(quiet, cancel)
+	defer watchdog.Stop()
+
+	body := &heartbeatReader{
+		reader: response.Body,
+		onRead: func() {
+			watchdog.Reset(quiet)
+		},
+	}
+
+	if f.Mode == LONGPOLL_FEED {
+		return true, f.readLongpoll(ctx, body, since, handler)
+	}
+	return true, f.readContinuous(ctx, body, since, handler)
+}
+
+func (f *CouchDBChangesFeed) readContinuous(ctx context.Context, body io.Reader, since *string, handler ChangeHandler) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), changesFeedMaxLineSize)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			telemetry.Logger(ctx).Debug("Changes feed heartbeat")
+			continue
+		}
+
+		var row couchDBChangeRow
+		if err := json.Unmarshal(line, &row); err != nil {
+			telemetry.Logger(ctx).Error("Failed to decode change", zap.Error(err))
+			continue
+		}
+
+		if len(row.LastSeq) > 0 {
+			// the feed was closed by the server
+			*since = seqString(row.LastSeq)
+			return io.EOF
+		}
+
+		if err := f.deliver(ctx, row, since, handler); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func (f *CouchDBChangesFeed) readLongpoll(ctx context.Context, body io.Reader, since *string, handler ChangeHandler) error {
+	var response couchDBLongpollResponse
+	if err := json.NewDecoder(body).Decode(&response); err != nil {
+		return err
+	}
+
+	for _, row := range response.Results {
+		if err := f.deliver(ctx, row, since, handler); err != nil {
+			return err
+		}
+	}
+
+	if len(response.LastSeq) > 0 {
+		*since = seqString(response.LastSeq)
+	}
+
+	// a longpoll response always ends the request, go straight back for the next batch
+	return nil
+}
+
+func (f *CouchDBChangesFeed) deliver(ctx context.Context, row couchDBChangeRow, since *string, handler ChangeHandler) error {
+	change, err := decodeChange(row)
+	if err != nil {
+		// a malformed document would fail every time, skip it rather than blocking the feed
+		telemetry.Logger(ctx).Error("Failed to decode changed document, skipping", zap.String("id", row.Id), zap.Error(err))
+	} else if err := handler(change); err != nil {
+		telemetry.Logger(ctx).Warn("Change handler failed", zap.String("id", change.Id), zap.Error(err))
+		return err
+	}
+
+	*since = change.Seq
+	if f.Checkpoints != nil {
+		if err := f.Checkpoints.Save(change.Seq); err != nil {
+			telemetry.Logger(ctx).Error("Failed to save changes feed checkpoint", zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+func (f *CouchDBChangesFeed) changesUrl(since string) string {
+	query := url.Values{}
+	query.Set("feed", string(CONTINUOUS_FEED))
+	if f.Mode == LONGPOLL_FEED {
+		query.Set("feed", string(LONGPOLL_FEED))
+	}
+	query.Set("include_docs", "true")
+	query.Set("since", since)
+	query.Set("heartbeat", strconv.FormatInt(f.heartbeat().Milliseconds(), 10))
+	if len(f.Filter) > 0 {
+		query.Set("filter", f.Filter)
+	}
+
+	var builder strings.Builder
+	builder.WriteString(baseUrl())
+	builder.WriteString("/_changes?")
+	builder.WriteString(query.Encode())
+	return builder.String()
+}
+
+func decodeChange(row couchDBChangeRow) (Change, error) {
+	change := Change{
+		Seq:     seqString(row.Seq),
+		Id:      row.Id,
+		Deleted: row.Deleted,
+	}
+
+	if row.Deleted || len(row.Doc) == 0 {
+		return change, nil
+	}
+
+	var base model.BaseDocument
+	if err := json.Unmarshal(row.Doc, &base); err != nil {
+		return change, err
+	}
+	change.Type = base.Type
+
+	if base.Type == nil {
+		return change, nil
+	}
+
+	switch *base.Type {
+	case model.ENERGY_TYPE:
+		change.Energy = &model.LatestEnergeyResponse{}
+		return change, json.Unmarshal(row.Doc, change.Energy)
+	case model.WEATHER_TYPE:
+		change.Weather = &model.WeatherResponse{}
+		return change, json.Unmarshal(row.Doc, change.Weather)
+	case model.AGGREGATED_TYPE:
+		change.Metric = &model.Metric{}
+		return change, json.Unmarshal(row.Doc, change.Metric)
+	}
+
+	return change, nil
+}
+
+// seqString handles both the opaque string seqs of CouchDB 2+ and the numeric seqs of 1.x
+func seqString(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
+
+type heartbeatReader struct {
+	reader io.Reader
+	onRead func()
+}
+
+func (r *heartbeatReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.onRead()
+	}
+	return n, err
+}
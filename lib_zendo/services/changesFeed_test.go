@@ -0,0 +1,274 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/utils"
+)
+
+func TestChangesFeedReconnectsWithBackoff(t *testing.T) {
+	backoff := 50 * time.Millisecond
+	couchDB := couchDBForTest(t, func(resp http.ResponseWriter, req *http.Request, attempt int) {
+		switch {
+		case attempt < 3:
+			resp.WriteHeader(http.StatusServiceUnavailable)
+		case attempt == 3:
+			// one change then the connection drops
+			writeChangeForTest(resp, "1-a")
+		default:
+			writeChangeForTest(resp, "2-b")
+			<-req.Context().Done()
+		}
+	})
+	checkpoints := &FileCheckpointStore{Path: filepath.Join(t.TempDir(), "seq")}
+	if err := checkpoints.Save("0-start"); err != nil {
+		t.Fatal(err)
+	}
+	feed := &CouchDBChangesFeed{Http: &utils.HttpClient{}, Mode: CONTINUOUS_FEED, Backoff: backoff, Checkpoints: checkpoints}
+
+	changes := followForTest(t, feed, 2)
+	if changes[0].Seq != "1-a" || changes[1].Seq != "2-b" || changes[1].Metric == nil {
+		t.Fatalf("expected both changes with their metrics, got %+v", changes)
+	}
+
+	requests := couchDB.requests()
+	if len(requests) != 5 {
+		t.Fatalf("expected 3 failures and 2 connections, got %d requests", len(requests))
+	}
+	// the wait doubles after each failure
+	for i := 1; i < 4; i++ {
+		if gap, expected := requests[i].at.Sub(requests[i-1].at), backoff<<(i-1); gap < expected {
+			t.Fatalf("expected retry %d to wait at least %v, waited %v", i, expected, gap)
+		}
+	}
+	// a connection that was reached starts the backoff over
+	if reset, doubled := requests[4].at.Sub(requests[3].at), requests[3].at.Sub(requests[2].at); reset < backoff || reset >= doubled {
+		t.Fatalf("expected the wait to go back to %v after connecting, waited %v", backoff, reset)
+	}
+
+	for i, since := range []string{"0-start", "0-start", "0-start", "0-start", "1-a"} {
+		if requests[i].since != since {
+			t.Fatalf("expected request %d to resume from %s, got %s", i, since, requests[i].since)
+		}
+	}
+}
+
+func TestChangesFeedReconnectsWhenTheHeartbeatStalls(t *testing.T) {
+	heartbeat := 20 * time.Millisecond
+	stalled := make(chan struct{})
+	couchDB := couchDBForTest(t, func(resp http.ResponseWriter, req *http.Request, attempt int) {
+		if attempt > 0 {
+			writeChangeForTest(resp, "2-b")
+			<-req.Context().Done()
+			return
+		}
+
+		// heartbeats keep the connection well past the watchdog, then they stop
+		for range 10 {
+			fmt.Fprint(resp, "\n")
+			resp.(http.Flusher).Flush()
+			time.Sleep(heartbeat / 2)
+		}
+		writeChangeForTest(resp, "1-a")
+		<-req.Context().Done()
+		close(stalled)
+	})
+	feed := &CouchDBChangesFeed{Http: &utils.HttpClient{}, Mode: CONTINUOUS_FEED, Heartbeat: heartbeat, Backoff: time.Millisecond}
+
+	changes := followForTest(t, feed, 2)
+	if changes[0].Seq != "1-a" || changes[1].Seq != "2-b" {
+		t.Fatalf("expected the change before and after the stall, got %+v", changes)
+	}
+	select {
+	case <-stalled:
+	default:
+		t.Fatal("expected the feed to drop the stalled connection")
+	}
+
+	requests := couchDB.requests()
+	if requests[0].heartbeat != "20" {
+		t.Fatalf("expected the heartbeat to be asked for in milliseconds, got %s", requests[0].heartbeat)
+	}
+	if requests[1].since != "1-a" {
+		t.Fatalf("expected the reconnect to resume from 1-a, got %s", requests[1].since)
+	}
+}
+
+func TestChangesFeedLongpollFollowsLastSeq(t *testing.T) {
+	couchDB := couchDBForTest(t, func(resp http.ResponseWriter, req *http.Request, attempt int) {
+		resp.Header().Set("Content-Type", "application/json")
+		switch attempt {
+		case 0:
+			fmt.Fprintf(resp, `{"results":[%s],"last_seq":"2-b"}`, changeForTest("1-a"))
+		case 1:
+			// nothing changed before the timeout, CouchDB 1.x seqs are numbers
+			fmt.Fprint(resp, `{"results":[],"last_seq":3}`)
+		default:
+			fmt.Fprintf(resp, `{"results":[%s],"last_seq":"4-d"}`, changeForTest("4-d"))
+		}
+	})
+	checkpoints := &FileCheckpointStore{Path: filepath.Join(t.TempDir(), "seq")}
+	feed := &CouchDBChangesFeed{Http: &utils.HttpClient{}, Mode: LONGPOLL_FEED, Checkpoints: checkpoints}
+
+	changes := followForTest(t, feed, 2)
+	if changes[0].Seq != "1-a" || changes[1].Seq != "4-d" {
+		t.Fatalf("expected a change from each batch, got %+v", changes)
+	}
+
+	requests := couchDB.requests()
+	if len(requests) != 3 {
+		t.Fatalf("expected a request for each batch, got %d", len(requests))
+	}
+	for i, since := range []string{"now", "2-b", "3"} {
+		if requests[i].since != since {
+			t.Fatalf("expected request %d to poll from %s, got %s", i, since, requests[i].since)
+		}
+		if requests[i].feed != string(LONGPOLL_FEED) {
+			t.Fatalf("expected a longpoll request, got %s", requests[i].feed)
+		}
+	}
+
+	// only handled changes are checkpointed
+	if saved, err := checkpoints.Load(); err != nil || saved != "4-d" {
+		t.Fatalf("expected the checkpoint at 4-d, got %q and %v", saved, err)
+	}
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	dir := t.TempDir()
+	store := &FileCheckpointStore{Path: filepath.Join(dir, "seq")}
+
+	if seq, err := store.Load(); err != nil || seq != "" {
+		t.Fatalf("expected no checkpoint before the first save, got %q and %v", seq, err)
+	}
+
+	for _, seq := range []string{"12-abc", "13-def"} {
+		if err := store.Save(seq); err != nil {
+			t.Fatal(err)
+		}
+		if loaded, err := store.Load(); err != nil || loaded != seq {
+			t.Fatalf("expected %s, got %q and %v", seq, loaded, err)
+		}
+	}
+
+	// the temporary file is renamed into place
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "seq" {
+		t.Fatalf("expected only the checkpoint in the directory, got %v", entries)
+	}
+
+	// an edited checkpoint still loads
+	if err := os.WriteFile(store.Path, []byte("14-ghi\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := store.Load(); err != nil || loaded != "14-ghi" {
+		t.Fatalf("expected the trailing newline to be trimmed, got %q and %v", loaded, err)
+	}
+
+	unreadable := &FileCheckpointStore{Path: dir}
+	if _, err := unreadable.Load(); err == nil {
+		t.Fatal("expected a checkpoint that can't be read to fail")
+	}
+}
+
+// private
+
+type requestForTest struct {
+	at        time.Time
+	since     string
+	feed      string
+	heartbeat string
+}
+
+// changesServerForTest records the _changes requests it has served
+type changesServerForTest struct {
+	mu   sync.Mutex
+	seen []requestForTest
+}
+
+func (c *changesServerForTest) requests() []requestForTest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]requestForTest{}, c.seen...)
+}
+
+// couchDBForTest serves _changes with handle and points the feed at it, attempt counts the requests from 0
+func couchDBForTest(t *testing.T, handle func(resp http.ResponseWriter, req *http.Request, attempt int)) *changesServerForTest {
+	t.Helper()
+
+	couchDB := &changesServerForTest{}
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/zendo/_changes" {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		query := req.URL.Query()
+		couchDB.mu.Lock()
+		attempt := len(couchDB.seen)
+		couchDB.seen = append(couchDB.seen, requestForTest{
+			at:        time.Now(),
+			since:     query.Get("since"),
+			feed:      query.Get("feed"),
+			heartbeat: query.Get("heartbeat"),
+		})
+		couchDB.mu.Unlock()
+
+		handle(resp, req, attempt)
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv("COUCHDB_URL", strings.TrimPrefix(server.URL, "http://"))
+	t.Setenv("COUCHDB_DB", "zendo")
+	t.Setenv("COUCHDB_USER", "admin")
+	t.Setenv("COUCHDB_PASSWORD", "password")
+	return couchDB
+}
+
+// followForTest subscribes to feed until count changes have been handled
+func followForTest(t *testing.T, feed *CouchDBChangesFeed, count int) []Change {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	changes := []Change{}
+	done := make(chan error, 1)
+	go func() {
+		done <- feed.Subscribe(ctx, func(change Change) error {
+			changes = append(changes, change)
+			if len(changes) == count {
+				cancel()
+			}
+			return nil
+		})
+	}()
+
+	if err := <-done; err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	if len(changes) != count {
+		t.Fatalf("expected %d changes before the timeout, got %d", count, len(changes))
+	}
+	return changes
+}
+
+func changeForTest(seq string) string {
+	return fmt.Sprintf(`{"seq":%q,"id":"%s:%s","doc":{"type":%q,"totalProduction":5}}`, seq, model.AGGREGATED_TYPE, seq, model.AGGREGATED_TYPE)
+}
+
+func writeChangeForTest(resp http.ResponseWriter, seq string) {
+	fmt.Fprintln(resp, changeForTest(seq))
+	resp.(http.Flusher).Flush()
+}
@@ -1,68 +1,134 @@
 package services
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 	"zendo/lib_zendo/errors"
 	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/telemetry"
 	"zendo/lib_zendo/utils"
 
 	"go.uber.org/zap"
 )
 
 type IDataService interface {
-	PostLatestData(energy *model.LatestEnergeyResponse, weather *model.WeatherResponse) error
-	SeedHistoricalData(energyData *[]model.LatestEnergeyResponse, weatherData *[]model.WeatherResponse) error
-	GetLatestWeatherDate() (*time.Time, error)
-	GetLatestEnergyDate() (*time.Time, error)
-	GetLatestMetric() (*model.Metric, error)
-	Get24HoursOfMetrics() (*[]model.Metric, error)
+	IApiKeyStore
+	IStorageHealth
+
+	PostLatestData(ctx context.Context, energy *model.LatestEnergeyResponse, weather *model.WeatherResponse) error
+	SeedHistoricalData(ctx context.Context, energyData *[]model.LatestEnergeyResponse, weatherData *[]model.WeatherResponse) error
+	GetLatestWeatherDate(ctx context.Context) (*time.Time, error)
+	GetLatestEnergyDate(ctx context.Context) (*time.Time, error)
+	GetLatestMetric(ctx context.Context) (*model.Metric, error)
+	Get24HoursOfMetrics(ctx context.Context) (*[]model.Metric, error)
+	GetMetricsInRange(ctx context.Context, query MetricsRangeQuery) (*MetricsPage, error)
+	GetRollups(ctx context.Context, resolution string, from time.Time, to time.Time) (*[]model.MetricRollup, error)
+	PostRollups(ctx context.Context, rollups *[]model.MetricRollup) error
+	PurgeBefore(ctx context.Context, docType string, before time.Time, dryRun bool) (int, error)
+	PurgeRollupsBefore(ctx context.Context, resolution string, before time.Time, dryRun bool) (int, error)
+}
+
+// IApiKeyStore keeps api keys alongside the data. GetApiKey returns nil when there is no key with the id,
+// RevokeApiKey reports whether the key was found.
+type IApiKeyStore interface {
+	PostApiKey(ctx context.Context, key *model.ApiKey) error
+	GetApiKey(ctx context.Context, id string) (*model.ApiKey, error)
+	GetApiKeys(ctx context.Context) (*[]model.ApiKey, error)
+	RevokeApiKey(ctx context.Context, id string, at time.Time) (bool, error)
+}
+
+// IStorageHealth backs the readiness checks. Ping checks storage can be reached,
+// CheckSetup checks it holds what the services query, e.g. the CouchDB design docs or the SQL migrations.
+type IStorageHealth interface {
+	Ping(ctx context.Context) error
+	CheckSetup(ctx context.Context) error
+}
+
+// MetricsRangeQuery selects metrics with From <= timestamp <= To, a Limit of 0 returns every match.
+// StartAt continues a previous page from its NextCursor.
+type MetricsRangeQuery struct {
+	From       time.Time
+	To         time.Time
+	Descending bool
+	Limit      int
+	StartAt    *MetricsCursor
+}
+
+// MetricsCursor is the position of the first metric on the next page
+type MetricsCursor struct {
+	Timestamp time.Time `json:"t"`
+	Id        string    `json:"id"`
+}
+
+// MetricsPage holds one page of a range query, NextCursor is nil on the last page.
+// TotalCount is the number of metrics in the whole range, not just this page.
+type MetricsPage struct {
+	Metrics    []model.Metric
+	NextCursor *MetricsCursor
+	TotalCount int
+}
+
+// Last24HoursQuery is the default range, newest first
+func Last24HoursQuery() MetricsRangeQuery {
+	now := time.Now()
+	return MetricsRangeQuery{
+		From:       now.Add(-time.Hour * 24),
+		To:         now,
+		Descending: true,
+	}
 }
 
 type CouchDBDataService struct {
 	Http utils.IHttpClient
 }
 
-func (s *CouchDBDataService) PostLatestData(energy *model.LatestEnergeyResponse, weather *model.WeatherResponse) error {
+func (s *CouchDBDataService) PostLatestData(ctx context.Context, energy *model.LatestEnergeyResponse, weather *model.WeatherResponse) error {
 	// NOTE: This may need to become more complex but for now we are just going to add a type property and post
 
 	if energy == nil && weather == nil {
-		zap.L().Panic("Neither energy update nor weather update was set")
+		telemetry.Logger(ctx).Panic("Neither energy update nor weather update was set")
 		return &errors.DatabaseError{}
 	}
 
 	if weather != nil {
-		zap.L().Info("Adding new weather data point", zap.Timep("timestamp", weather.Timestamp))
+		telemetry.Logger(ctx).Info("Adding new weather data point", zap.Timep("timestamp", weather.Timestamp))
 	}
 	if energy != nil {
-		zap.L().Info("Adding new energy data point", zap.Timep("timestamp", energy.Timestamp))
+		telemetry.Logger(ctx).Info("Adding new energy data point", zap.Timep("timestamp", energy.Timestamp))
 	}
 
 	payloadSlice := []any{}
 	if energy != nil {
 		energy.BaseDocument.Type = utils.StringPointer(model.ENERGY_TYPE)
-		payloadSlice = append(payloadSlice, energy)
+		payloadSlice = append(payloadSlice, couchDBEnergyDocument{
+			Id:                    energy.DocumentId(),
+			LatestEnergeyResponse: energy,
+		})
 	}
 	if weather != nil {
 		weather.BaseDocument.Type = utils.StringPointer(model.WEATHER_TYPE)
-		payloadSlice = append(payloadSlice, weather)
+		payloadSlice = append(payloadSlice, couchDBWeatherDocument{
+			Id:              weather.DocumentId(),
+			WeatherResponse: weather,
+		})
 	}
 
-	payload := map[string][]any{
-		"docs": payloadSlice,
-	}
-	if _, err := s.Http.Post(bulkDocsUrl(), payload, nil); err != nil {
-		zap.L().DPanic("Failed to post latest data", zap.Error(err))
-		return &errors.DatabaseError{}
+	if _, err := s.postBulkDocs(ctx, payloadSlice); err != nil {
+		return bulkDocsError(ctx, "Failed to post latest data", err)
 	}
 
 	return nil
 }
 
-func (s *CouchDBDataService) SeedHistoricalData(energyData *[]model.LatestEnergeyResponse, weatherData *[]model.WeatherResponse) error {
+func (s *CouchDBDataService) SeedHistoricalData(ctx context.Context, energyData *[]model.LatestEnergeyResponse, weatherData *[]model.WeatherResponse) error {
 	if energyData == nil || weatherData == nil {
-		zap.L().Panic("Neither energy data nor weather data was set")
+		telemetry.Logger(ctx).Panic("Neither energy data nor weather data was set")
 		return &errors.DatabaseError{}
 	}
 
@@ -72,25 +138,57 @@ func (s *CouchDBDataService) SeedHistoricalData(energyData *[]model.LatestEnerge
 	for i, x := range *energyData {
 		x.Type = utils.StringPointer(model.ENERGY_TYPE)
 		x.HistoricalSeed = true
-		docs[i] = x
+		docs[i] = couchDBEnergyDocument{
+			Id:                    x.DocumentId(),
+			LatestEnergeyResponse: &x,
+		}
 	}
 	for i, x := range *weatherData {
 		x.Type = utils.StringPointer(model.WEATHER_TYPE)
 		x.HistoricalSeed = true
-		docs[i+energyLen] = x
+		docs[i+energyLen] = couchDBWeatherDocument{
+			Id:              x.DocumentId(),
+			WeatherResponse: &x,
+		}
 	}
 
-	payload := map[string][]any{
-		"docs": docs,
-	}
-	if _, err := s.Http.Post(bulkDocsUrl(), payload, nil); err != nil {
-		zap.L().DPanic("Failed to post seed data", zap.Error(err))
-		return &errors.DatabaseError{}
+	if _, err := s.postBulkDocs(ctx, docs); err != nil {
+		return bulkDocsError(ctx, "Failed to post seed data", err)
 	}
 
 	return nil
 }
 
+// couchDBEnergyDocument and couchDBWeatherDocument attach a deterministic _id so re-posting a data point conflicts instead of duplicating
+type couchDBEnergyDocument struct {
+	Id string `json:"_id"`
+	*model.LatestEnergeyResponse
+}
+
+type couchDBWeatherDocument struct {
+	Id string `json:"_id"`
+	*model.WeatherResponse
+}
+
+type couchDBRollupDocument struct {
+	Id string `json:"_id"`
+	*model.MetricRollup
+}
+
+type CouchDBBulkDocResult struct {
+	Id     string  `json:"id"`
+	Rev    *string `json:"rev,omitempty"`
+	Error  *string `json:"error,omitempty"`
+	Reason *string `json:"reason,omitempty"`
+}
+
+// BulkWriteResult is the outcome of a _bulk_docs write split by document id
+type BulkWriteResult struct {
+	Stored        []string
+	AlreadyStored []string
+	Failed        []errors.BulkDocumentFailure
+}
+
 type CouchDBViewDocMetadata struct {
 	Id  string             `json:"id"`
 	Doc model.BaseDocument `json:"doc"`
@@ -100,14 +198,14 @@ type CouchDBViewResponse struct {
 	Rows []CouchDBViewDocMetadata `json:"rows"`
 }
 
-func (s *CouchDBDataService) GetLatestWeatherDate() (*time.Time, error) {
+func (s *CouchDBDataService) GetLatestWeatherDate(ctx context.Context) (*time.Time, error) {
 	var body CouchDBViewResponse
-	result, err := s.Http.Get(latestWeatherUrl(), &body)
+	result, err := s.Http.Get(ctx, latestWeatherUrl(), &body)
 	if err != nil {
-		zap.L().DPanic("Failed to get latest weather date", zap.Error(err))
-		return nil, &errors.HttpError{
-			StatusCode: result.StatusCode,
-		}
+		return nil, couchDBRequestError(ctx, "Failed to get latest weather date", err)
+	}
+	if result.StatusCode > 299 {
+		return nil, couchDBStatusError(result.StatusCode)
 	}
 
 	if len(body.Rows) == 0 {
@@ -118,14 +216,14 @@ func (s *CouchDBDataService) GetLatestWeatherDate() (*time.Time, error) {
 	return body.Rows[0].Doc.Timestamp, nil
 }
 
-func (s *CouchDBDataService) GetLatestEnergyDate() (*time.Time, error) {
+func (s *CouchDBDataService) GetLatestEnergyDate(ctx context.Context) (*time.Time, error) {
 	var body CouchDBViewResponse
-	result, err := s.Http.Get(latestEnergyUrl(), &body)
+	result, err := s.Http.Get(ctx, latestEnergyUrl(), &body)
 	if err != nil {
-		zap.L().DPanic("Failed to get latest weather date", zap.Error(err))
-		return nil, &errors.HttpError{
-			StatusCode: result.StatusCode,
-		}
+		return nil, couchDBRequestError(ctx, "Failed to get latest weather date", err)
+	}
+	if result.StatusCode > 299 {
+		return nil, couchDBStatusError(result.StatusCode)
 	}
 
 	if len(body.Rows) == 0 {
@@ -139,6 +237,7 @@ func (s *CouchDBDataService) GetLatestEnergyDate() (*time.Time, error) {
 // TODO: This is not the cleanest, want better inheritance
 type CouchDBViewMetricMetadata struct {
 	Id  string       `json:"id"`
+	Key string       `json:"key"`
 	Doc model.Metric `json:"doc"`
 }
 
@@ -146,14 +245,22 @@ type CouchDBMetricViewResponse struct {
 	Rows []CouchDBViewMetricMetadata `json:"rows"`
 }
 
-func (s *CouchDBDataService) GetLatestMetric() (*model.Metric, error) {
+type CouchDBReduceRow struct {
+	Value int `json:"value"`
+}
+
+type CouchDBReduceResponse struct {
+	Rows []CouchDBReduceRow `json:"rows"`
+}
+
+func (s *CouchDBDataService) GetLatestMetric(ctx context.Context) (*model.Metric, error) {
 	var body CouchDBMetricViewResponse
-	result, err := s.Http.Get(latestMetricUrl(), &body)
+	result, err := s.Http.Get(ctx, latestMetricUrl(), &body)
 	if err != nil {
-		zap.L().DPanic("Failed to get latest metric", zap.Error(err))
-		return nil, &errors.HttpError{
-			StatusCode: result.StatusCode,
-		}
+		return nil, couchDBRequestError(ctx, "Failed to get latest metric", err)
+	}
+	if result.StatusCode > 299 {
+		return nil, couchDBStatusError(result.StatusCode)
 	}
 
 	if len(body.Rows) == 0 {
@@ -164,31 +271,510 @@ func (s *CouchDBDataService) GetLatestMetric() (*model.Metric, error) {
 	return &body.Rows[0].Doc, nil
 }
 
-func (s *CouchDBDataService) Get24HoursOfMetrics() (*[]model.Metric, error) {
+func (s *CouchDBDataService) Get24HoursOfMetrics(ctx context.Context) (*[]model.Metric, error) {
+	page, err := s.GetMetricsInRange(ctx, Last24HoursQuery())
+	if err != nil {
+		return nil, err
+	}
+
+	return &page.Metrics, nil
+}
+
+func (s *CouchDBDataService) GetMetricsInRange(ctx context.Context, query MetricsRangeQuery) (*MetricsPage, error) {
 	var body CouchDBMetricViewResponse
-	result, err := s.Http.Get(last24HoursMetricUrl(), &body)
+	result, err := s.Http.Get(ctx, metricsInRangeUrl(query), &body)
+	if err != nil {
+		return nil, couchDBRequestError(ctx, "Failed to get metrics in range", err)
+	}
+	if result.StatusCode > 299 {
+		telemetry.Logger(ctx).Error("Failed to get metrics in range", zap.Int("status", result.StatusCode))
+		telemetry.CountCouchDBError(telemetry.COUCHDB_STATUS_ERROR, strconv.Itoa(result.StatusCode))
+		return nil, &errors.DatabaseError{}
+	}
+
+	var count CouchDBReduceResponse
+	countResult, err := s.Http.Get(ctx, metricsInRangeCountUrl(query), &count)
 	if err != nil {
-		zap.L().DPanic("Failed to get 24 hours of metrics", zap.Error(err))
-		return nil, &errors.HttpError{
-			StatusCode: result.StatusCode,
+		return nil, couchDBRequestError(ctx, "Failed to count metrics in range", err)
+	}
+	if countResult.StatusCode > 299 {
+		telemetry.Logger(ctx).Error("Failed to count metrics in range, is the aggregated_by_time reduce deployed?", zap.Int("status", countResult.StatusCode))
+		telemetry.CountCouchDBError(telemetry.COUCHDB_STATUS_ERROR, strconv.Itoa(countResult.StatusCode))
+		return nil, &errors.DatabaseError{}
+	}
+
+	page := MetricsPage{
+		Metrics: []model.Metric{},
+	}
+	if len(count.Rows) > 0 {
+		// reduce without grouping returns a single row, no rows means no data
+		page.TotalCount = count.Rows[0].Value
+	}
+
+	rows := body.Rows
+	if query.Limit > 0 && len(rows) > query.Limit {
+		// one extra row was requested to find where the next page starts
+		next := rows[query.Limit]
+		nextTimestamp, err := time.Parse(time.RFC3339Nano, next.Key)
+		if err != nil {
+			telemetry.Logger(ctx).DPanic("Failed to parse metric view key", zap.String("key", next.Key), zap.Error(err))
+			return nil, &errors.DatabaseError{}
+		}
+
+		page.NextCursor = &MetricsCursor{
+			Timestamp: nextTimestamp,
+			Id:        next.Id,
 		}
+		rows = rows[:query.Limit]
 	}
 
-	if len(body.Rows) == 0 {
-		// no data
-		return &[]model.Metric{}, nil
+	for i := range rows {
+		page.Metrics = append(page.Metrics, rows[i].Doc)
+	}
+
+	return &page, nil
+}
+
+type CouchDBViewRollupMetadata struct {
+	Id  string             `json:"id"`
+	Doc model.MetricRollup `json:"doc"`
+}
+
+type CouchDBRollupViewResponse struct {
+	Rows []CouchDBViewRollupMetadata `json:"rows"`
+}
+
+// GetRollups returns the stored rollups of one resolution with From <= bucket start <= To, oldest first
+func (s *CouchDBDataService) GetRollups(ctx context.Context, resolution string, from time.Time, to time.Time) (*[]model.MetricRollup, error) {
+	var body CouchDBRollupViewResponse
+	result, err := s.Http.Get(ctx, rollupsUrl(resolution, from, to), &body)
+	if err != nil {
+		return nil, couchDBRequestError(ctx, "Failed to get rollups", err)
+	}
+	if result.StatusCode > 299 {
+		telemetry.Logger(ctx).Error("Failed to get rollups, is the rollups_by_time view deployed?", zap.Int("status", result.StatusCode))
+		return nil, couchDBStatusError(result.StatusCode)
 	}
 
-	data := make([]model.Metric, len(body.Rows))
+	rollups := make([]model.MetricRollup, len(body.Rows))
 	for i := range body.Rows {
-		data[i] = body.Rows[i].Doc
+		rollups[i] = body.Rows[i].Doc
+	}
+
+	return &rollups, nil
+}
+
+func (s *CouchDBDataService) PostRollups(ctx context.Context, rollups *[]model.MetricRollup) error {
+	docs := make([]any, len(*rollups))
+	for i := range *rollups {
+		rollup := &(*rollups)[i]
+		rollup.Type = utils.StringPointer(model.ROLLUP_TYPE)
+		docs[i] = couchDBRollupDocument{
+			Id:           rollup.DocumentId(),
+			MetricRollup: rollup,
+		}
+	}
+
+	if _, err := s.postBulkDocs(ctx, docs); err != nil {
+		return bulkDocsError(ctx, "Failed to post rollups", err)
+	}
+
+	return nil
+}
+
+// couchDBTimeViews maps each raw document type to the view that orders it by timestamp
+var couchDBTimeViews = map[string]string{
+	model.ENERGY_TYPE:     "energy_by_time",
+	model.WEATHER_TYPE:    "weather_by_time",
+	model.AGGREGATED_TYPE: "aggregated_by_time",
+}
+
+type couchDBRevision struct {
+	Rev string `json:"_rev"`
+}
+
+type CouchDBViewRevMetadata struct {
+	Id  string          `json:"id"`
+	Doc couchDBRevision `json:"doc"`
+}
+
+type CouchDBRevViewResponse struct {
+	Rows []CouchDBViewRevMetadata `json:"rows"`
+}
+
+type couchDBDeletedDocument struct {
+	Id      string `json:"_id"`
+	Rev     string `json:"_rev"`
+	Deleted bool   `json:"_deleted"`
+}
+
+// PurgeBefore deletes every document of docType with a timestamp before the cutoff and returns how many went.
+// With dryRun nothing is deleted and the count is of the documents that would be.
+func (s *CouchDBDataService) PurgeBefore(ctx context.Context, docType string, before time.Time, dryRun bool) (int, error) {
+	view, ok := couchDBTimeViews[docType]
+	if !ok {
+		return 0, fmt.Errorf("unknown document type: %s", docType)
+	}
+
+	return s.purgeView(ctx, view, "", viewKey(before), dryRun)
+}
+
+func (s *CouchDBDataService) PurgeRollupsBefore(ctx context.Context, resolution string, before time.Time, dryRun bool) (int, error) {
+	// a key with just the resolution sorts before every key with a timestamp
+	return s.purgeView(ctx, "rollups_by_time", "[\""+resolution+"\"]", "[\""+resolution+"\","+viewKey(before)+"]", dryRun)
+}
+
+// couchDBApiKeyDocument carries the CouchDB metadata around a key, _rev is needed to update it
+type couchDBApiKeyDocument struct {
+	Id   string  `json:"_id"`
+	Rev  *string `json:"_rev,omitempty"`
+	Type string  `json:"type"`
+	*model.ApiKey
+}
+
+type CouchDBAllDocsApiKeyRow struct {
+	Id  string        `json:"id"`
+	Doc *model.ApiKey `json:"doc"`
+}
+
+type CouchDBAllDocsApiKeyResponse struct {
+	Rows []CouchDBAllDocsApiKeyRow `json:"rows"`
+}
+
+func (s *CouchDBDataService) PostApiKey(ctx context.Context, key *model.ApiKey) error {
+	doc := couchDBApiKeyDocument{
+		Id:     key.DocumentId(),
+		Type:   model.API_KEY_TYPE,
+		ApiKey: key,
+	}
+
+	result, err := s.Http.Put(ctx, documentUrl(doc.Id), doc, nil)
+	if err != nil {
+		return couchDBRequestError(ctx, "Failed to post api key", err)
+	}
+	if result.StatusCode > 299 {
+		telemetry.Logger(ctx).Error("Failed to post api key", zap.String("id", key.Id), zap.Int("status", result.StatusCode))
+		return couchDBStatusError(result.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *CouchDBDataService) GetApiKey(ctx context.Context, id string) (*model.ApiKey, error) {
+	doc, err := s.getApiKeyDocument(ctx, id)
+	if err != nil || doc == nil {
+		return nil, err
 	}
 
-	return &data, nil
+	return doc.ApiKey, nil
+}
+
+func (s *CouchDBDataService) GetApiKeys(ctx context.Context) (*[]model.ApiKey, error) {
+	var body CouchDBAllDocsApiKeyResponse
+	result, err := s.Http.Get(ctx, apiKeysUrl(), &body)
+	if err != nil {
+		return nil, couchDBRequestError(ctx, "Failed to get api keys", err)
+	}
+	if result.StatusCode > 299 {
+		return nil, couchDBStatusError(result.StatusCode)
+	}
+
+	keys := []model.ApiKey{}
+	for _, row := range body.Rows {
+		if row.Doc != nil {
+			keys = append(keys, *row.Doc)
+		}
+	}
+
+	return &keys, nil
+}
+
+func (s *CouchDBDataService) RevokeApiKey(ctx context.Context, id string, at time.Time) (bool, error) {
+	doc, err := s.getApiKeyDocument(ctx, id)
+	if err != nil || doc == nil {
+		return false, err
+	}
+	if doc.RevokedAt != nil {
+		return true, nil
+	}
+
+	doc.RevokedAt = &at
+	result, err := s.Http.Put(ctx, documentUrl(doc.Id), doc, nil)
+	if err != nil {
+		return false, couchDBRequestError(ctx, "Failed to revoke api key", err)
+	}
+	if result.StatusCode > 299 {
+		telemetry.Logger(ctx).Error("Failed to revoke api key", zap.String("id", id), zap.Int("status", result.StatusCode))
+		return false, couchDBStatusError(result.StatusCode)
+	}
+
+	return true, nil
+}
+
+// REQUIRED_DESIGN_DOCS are queried by the services, zendo-admin setup uploads them
+var REQUIRED_DESIGN_DOCS = []string{"_design/views", "_design/filters"}
+
+// Ping reads the database info, errors are returned as is since a failing check is expected while CouchDB is down
+func (s *CouchDBDataService) Ping(ctx context.Context) error {
+	result, err := s.Http.Get(ctx, baseUrl(), nil)
+	if err != nil {
+		countCouchDBFailure(ctx, err)
+		return err
+	}
+	if result.StatusCode > 299 {
+		return couchDBStatusError(result.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *CouchDBDataService) CheckSetup(ctx context.Context) error {
+	for _, id := range REQUIRED_DESIGN_DOCS {
+		result, err := s.Http.Get(ctx, baseUrl()+"/"+id, nil)
+		if err != nil {
+			countCouchDBFailure(ctx, err)
+			return err
+		}
+		if result.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%s is missing, run zendo-admin setup", id)
+		}
+		if result.StatusCode > 299 {
+			return couchDBStatusError(result.StatusCode)
+		}
+	}
+
+	return nil
 }
 
 // private
 
+func (s *CouchDBDataService) getApiKeyDocument(ctx context.Context, id string) (*couchDBApiKeyDocument, error) {
+	key := model.ApiKey{Id: id}
+	var doc couchDBApiKeyDocument
+	result, err := s.Http.Get(ctx, documentUrl(key.DocumentId()), &doc)
+	if err != nil {
+		return nil, couchDBRequestError(ctx, "Failed to get api key", err)
+	}
+
+	switch {
+	case result.StatusCode == 404:
+		return nil, nil
+	case result.StatusCode > 299:
+		return nil, couchDBStatusError(result.StatusCode)
+	case doc.ApiKey == nil || doc.Type != model.API_KEY_TYPE:
+		return nil, nil
+	}
+
+	return &doc, nil
+}
+
+// purgeView deletes the documents between startKey and endKey, exclusive of endKey, a batch at a time
+func (s *CouchDBDataService) purgeView(ctx context.Context, view string, startKey string, endKey string, dryRun bool) (int, error) {
+	purged := 0
+	for {
+		var body CouchDBRevViewResponse
+		result, err := s.Http.Get(ctx, purgeUrl(view, startKey, endKey, dryRun), &body)
+		if err != nil {
+			return purged, couchDBRequestError(ctx, "Failed to list documents to purge", err)
+		}
+		if result.StatusCode > 299 {
+			return purged, couchDBStatusError(result.StatusCode)
+		}
+
+		if dryRun {
+			return len(body.Rows), nil
+		}
+		if len(body.Rows) == 0 {
+			return purged, nil
+		}
+
+		docs := make([]any, len(body.Rows))
+		for i, row := range body.Rows {
+			docs[i] = couchDBDeletedDocument{
+				Id:      row.Id,
+				Rev:     row.Doc.Rev,
+				Deleted: true,
+			}
+		}
+
+		written, err := s.postBulkDocs(ctx, docs)
+		if err != nil {
+			return purged, bulkDocsError(ctx, "Failed to purge documents", err)
+		}
+		purged += len(written.Stored)
+
+		if len(written.Stored) == 0 {
+			// every delete conflicted with a concurrent update, stop rather than fetching the same batch forever
+			telemetry.Logger(ctx).Warn("No documents purged from batch, stopping", zap.String("view", view))
+			return purged, nil
+		}
+	}
+}
+
+// pageOfMetrics trims the extra metric fetched beyond the limit and points the next cursor at it
+func pageOfMetrics(metrics []model.Metric, limit int, totalCount int) *MetricsPage {
+	page := MetricsPage{
+		Metrics:    metrics,
+		TotalCount: totalCount,
+	}
+
+	if limit > 0 && len(metrics) > limit {
+		next := metrics[limit]
+		page.NextCursor = &MetricsCursor{
+			Timestamp: *next.Timestamp,
+			Id:        next.DocumentId(),
+		}
+		page.Metrics = metrics[:limit]
+	}
+
+	return &page
+}
+
+const (
+	couchDBConflict     string        = "conflict"
+	bulkDocsMaxAttempts int           = 3
+	bulkDocsRetryDelay  time.Duration = 500 * time.Millisecond
+)
+
+// permanentBulkDocErrors will fail again on retry, any other per document error is treated as transient
+var permanentBulkDocErrors = map[string]bool{
+	"forbidden":      true,
+	"unauthorized":   true,
+	"bad_request":    true,
+	"doc_validation": true,
+}
+
+// postBulkDocs writes docs via _bulk_docs and sorts the per document results.
+// A conflict means the document is already stored and is not treated as a failure.
+// Transient failures, including 5xx responses, are retried with a growing delay.
+// If any documents are finally rejected the result is returned alongside an *errors.BulkWriteError.
+func (s *CouchDBDataService) postBulkDocs(ctx context.Context, docs []any) (*BulkWriteResult, error) {
+	result := BulkWriteResult{}
+
+	pending := docs
+	for attempt := 1; len(pending) > 0; attempt++ {
+		if attempt > 1 {
+			telemetry.Logger(ctx).Warn("Retrying bulk write", zap.Int("attempt", attempt), zap.Int("documents", len(pending)))
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(bulkDocsRetryDelay * time.Duration(attempt-1)):
+			}
+		}
+		canRetry := attempt < bulkDocsMaxAttempts
+
+		payload := map[string][]any{
+			"docs": pending,
+		}
+
+		// NOTE: CouchDB returns the results in the same order as the request docs
+		var results []CouchDBBulkDocResult
+		response, err := s.Http.Post(ctx, bulkDocsUrl(), payload, &results)
+		if err != nil {
+			countCouchDBFailure(ctx, err)
+			if canRetry && !errors.IsCancelled(err) {
+				telemetry.Logger(ctx).Warn("Bulk write request failed", zap.Error(err))
+				continue
+			}
+			return nil, err
+		}
+		if response.StatusCode >= 500 && canRetry {
+			telemetry.Logger(ctx).Warn("Bulk write request failed", zap.Int("status", response.StatusCode))
+			telemetry.CountCouchDBError(telemetry.COUCHDB_STATUS_ERROR, strconv.Itoa(response.StatusCode))
+			continue
+		}
+		if response.StatusCode > 299 {
+			return nil, couchDBStatusError(response.StatusCode)
+		}
+		if len(results) != len(pending) {
+			telemetry.Logger(ctx).Error("Bulk write returned an unexpected number of results", zap.Int("expected", len(pending)), zap.Int("got", len(results)))
+			return nil, &errors.DatabaseError{}
+		}
+
+		retry := []any{}
+		for i, r := range results {
+			switch {
+			case r.Error == nil:
+				result.Stored = append(result.Stored, r.Id)
+			case *r.Error == couchDBConflict:
+				telemetry.Logger(ctx).Info("Document already stored, skipping", zap.String("id", r.Id))
+				result.AlreadyStored = append(result.AlreadyStored, r.Id)
+			case !permanentBulkDocErrors[*r.Error] && canRetry:
+				telemetry.CountCouchDBError(telemetry.COUCHDB_DOCUMENT_ERROR, *r.Error)
+				retry = append(retry, pending[i])
+			default:
+				telemetry.CountCouchDBError(telemetry.COUCHDB_DOCUMENT_ERROR, *r.Error)
+				failure := errors.BulkDocumentFailure{
+					Id:    r.Id,
+					Error: *r.Error,
+				}
+				if r.Reason != nil {
+					failure.Reason = *r.Reason
+				}
+				telemetry.Logger(ctx).Warn("Failed to store document", zap.String("id", failure.Id), zap.String("error", failure.Error), zap.String("reason", failure.Reason))
+				result.Failed = append(result.Failed, failure)
+			}
+		}
+		pending = retry
+	}
+
+	telemetry.Logger(ctx).Info("Bulk write complete", zap.Int("stored", len(result.Stored)), zap.Int("alreadyStored", len(result.AlreadyStored)), zap.Int("failed", len(result.Failed)))
+
+	if len(result.Failed) > 0 {
+		return &result, &errors.BulkWriteError{
+			Failures: result.Failed,
+		}
+	}
+
+	return &result, nil
+}
+
+// bulkDocsError passes rejected documents through to the caller, anything else is reported as a database error
+func bulkDocsError(ctx context.Context, msg string, err error) error {
+	if bulkErr, ok := err.(*errors.BulkWriteError); ok {
+		telemetry.Logger(ctx).Error(msg, zap.Error(err), zap.Any("failures", bulkErr.Failures))
+		return bulkErr
+	}
+
+	return requestError(ctx, msg, err)
+}
+
+// couchDBStatusError counts an error response from CouchDB
+func couchDBStatusError(status int) error {
+	telemetry.CountCouchDBError(telemetry.COUCHDB_STATUS_ERROR, strconv.Itoa(status))
+	return &errors.HttpError{
+		StatusCode: status,
+	}
+}
+
+// couchDBRequestError counts a call to CouchDB that got no response before handling it like any other storage error
+func couchDBRequestError(ctx context.Context, msg string, err error) error {
+	countCouchDBFailure(ctx, err)
+	return requestError(ctx, msg, err)
+}
+
+// countCouchDBFailure counts a call that got no response, unless ctx is done as then the caller gave up rather than CouchDB failing
+func countCouchDBFailure(ctx context.Context, err error) {
+	switch {
+	case ctx.Err() != nil:
+	case errors.IsCancelled(err):
+		telemetry.CountCouchDBError(telemetry.COUCHDB_REQUEST_ERROR, "timeout")
+	default:
+		telemetry.CountCouchDBError(telemetry.COUCHDB_REQUEST_ERROR, "unreachable")
+	}
+}
+
+// requestError passes a cancelled or timed out call through so callers can tell it apart, anything else is a database error
+func requestError(ctx context.Context, msg string, err error) error {
+	if errors.IsCancelled(err) {
+		telemetry.Logger(ctx).Warn(msg, zap.Error(err))
+		return err
+	}
+
+	telemetry.Logger(ctx).DPanic(msg, zap.Error(err))
+	return &errors.DatabaseError{}
+}
+
 func baseUrl() string {
 	var builder strings.Builder
 	builder.WriteString("http://")
@@ -202,6 +788,28 @@ func baseUrl() string {
 	return builder.String()
 }
 
+func documentUrl(id string) string {
+	var builder strings.Builder
+	builder.WriteString(baseUrl())
+	builder.WriteString("/")
+	builder.WriteString(url.PathEscape(id))
+	return builder.String()
+}
+
+// apiKeysUrl lists every api key by the prefix of their ids
+func apiKeysUrl() string {
+	values := url.Values{}
+	values.Set("include_docs", "true")
+	values.Set("startkey", "\""+model.API_KEY_TYPE+":\"")
+	values.Set("endkey", "\""+model.API_KEY_TYPE+":\ufff0\"")
+
+	var builder strings.Builder
+	builder.WriteString(baseUrl())
+	builder.WriteString("/_all_docs?")
+	builder.WriteString(values.Encode())
+	return builder.String()
+}
+
 func bulkDocsUrl() string {
 	var builder strings.Builder
 	builder.WriteString(baseUrl())
@@ -219,21 +827,103 @@ func latestWeatherUrl() string {
 func latestMetricUrl() string {
 	var builder strings.Builder
 	builder.WriteString(baseUrl())
-	builder.WriteString("/_design/views/_view/aggregated_by_time?include_docs=true&descending=true&limit=1")
+	builder.WriteString("/_design/views/_view/aggregated_by_time?include_docs=true&reduce=false&descending=true&limit=1")
+	return builder.String()
+}
+
+func metricsInRangeUrl(query MetricsRangeQuery) string {
+	startKey, endKey := rangeKeys(query)
+
+	values := url.Values{}
+	values.Set("include_docs", "true")
+	values.Set("reduce", "false")
+	values.Set("descending", strconv.FormatBool(query.Descending))
+	values.Set("startkey", viewKey(startKey))
+	values.Set("endkey", viewKey(endKey))
+	if query.StartAt != nil {
+		values.Set("startkey", viewKey(query.StartAt.Timestamp))
+		values.Set("startkey_docid", query.StartAt.Id)
+	}
+	if query.Limit > 0 {
+		values.Set("limit", strconv.Itoa(query.Limit+1))
+	}
+
+	var builder strings.Builder
+	builder.WriteString(baseUrl())
+	builder.WriteString("/_design/views/_view/aggregated_by_time?")
+	builder.WriteString(values.Encode())
 	return builder.String()
 }
 
-func last24HoursMetricUrl() string {
-	yesterday := time.Now().Add(-time.Hour * 24)
+// metricsInRangeCountUrl counts the whole range with the view's _count reduce
+func metricsInRangeCountUrl(query MetricsRangeQuery) string {
+	startKey, endKey := rangeKeys(query)
+
+	values := url.Values{}
+	values.Set("reduce", "true")
+	values.Set("descending", strconv.FormatBool(query.Descending))
+	values.Set("startkey", viewKey(startKey))
+	values.Set("endkey", viewKey(endKey))
 
 	var builder strings.Builder
 	builder.WriteString(baseUrl())
-	builder.WriteString("/_design/views/_view/aggregated_by_time?include_docs=true&descending=true&startKey=\"")
-	builder.WriteString(yesterday.Format(time.RFC3339))
-	builder.WriteString("\"")
+	builder.WriteString("/_design/views/_view/aggregated_by_time?")
+	builder.WriteString(values.Encode())
 	return builder.String()
 }
 
+// rollupsUrl selects one resolution from the [resolution, timestamp] keys of the rollups view
+func rollupsUrl(resolution string, from time.Time, to time.Time) string {
+	values := url.Values{}
+	values.Set("include_docs", "true")
+	values.Set("startkey", "[\""+resolution+"\","+viewKey(from)+"]")
+	values.Set("endkey", "[\""+resolution+"\","+viewKey(to)+"]")
+
+	var builder strings.Builder
+	builder.WriteString(baseUrl())
+	builder.WriteString("/_design/views/_view/rollups_by_time?")
+	builder.WriteString(values.Encode())
+	return builder.String()
+}
+
+const purgeBatchSize int = 1000
+
+// purgeUrl lists the documents to purge, a dry run only needs the ids so skips the docs and the batch limit
+func purgeUrl(view string, startKey string, endKey string, dryRun bool) string {
+	values := url.Values{}
+	values.Set("reduce", "false")
+	values.Set("inclusive_end", "false")
+	values.Set("endkey", endKey)
+	if len(startKey) > 0 {
+		values.Set("startkey", startKey)
+	}
+	if !dryRun {
+		values.Set("include_docs", "true")
+		values.Set("limit", strconv.Itoa(purgeBatchSize))
+	}
+
+	var builder strings.Builder
+	builder.WriteString(baseUrl())
+	builder.WriteString("/_design/views/_view/")
+	builder.WriteString(view)
+	builder.WriteString("?")
+	builder.WriteString(values.Encode())
+	return builder.String()
+}
+
+// rangeKeys orders the bounds for the view, a descending view walks the keys backwards so they swap
+func rangeKeys(query MetricsRangeQuery) (time.Time, time.Time) {
+	if query.Descending {
+		return query.To, query.From
+	}
+	return query.From, query.To
+}
+
+// viewKey formats a time the same way documents store their timestamp so view keys compare correctly
+func viewKey(t time.Time) string {
+	return "\"" + t.UTC().Format(time.RFC3339Nano) + "\""
+}
+
 func latestEnergyUrl() string {
 	var builder strings.Builder
 	builder.WriteString(baseUrl())
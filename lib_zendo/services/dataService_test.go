@@ -0,0 +1,96 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	stdErrors "errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"zendo/lib_zendo/errors"
+	"zendo/lib_zendo/utils"
+)
+
+func TestCouchDBMetricsInRangeChecksEachStatus(t *testing.T) {
+	viewBody := `{"rows":[{"id":"AGGREGATED_DATA:2025-01-01T00:00:00Z","key":"2025-01-01T00:00:00Z","doc":{"totalProduction":10}}]}`
+	countBody := `{"rows":[{"key":null,"value":1}]}`
+	query := MetricsRangeQuery{From: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)}
+
+	for _, test := range []struct {
+		name        string
+		viewStatus  int
+		countStatus int
+	}{
+		{"view fails", http.StatusNotFound, http.StatusOK},
+		{"count fails", http.StatusOK, http.StatusInternalServerError},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := CouchDBDataService{
+				Http: &stubHttpClient{responses: map[string]stubResponse{
+					"reduce=false": {test.viewStatus, viewBody},
+					"reduce=true":  {test.countStatus, countBody},
+				}},
+			}
+
+			page, err := s.GetMetricsInRange(context.Background(), query)
+			var databaseError *errors.DatabaseError
+			if !stdErrors.As(err, &databaseError) {
+				t.Fatalf("expected a database error, got page %+v and error %v", page, err)
+			}
+		})
+	}
+
+	s := CouchDBDataService{
+		Http: &stubHttpClient{responses: map[string]stubResponse{
+			"reduce=false": {http.StatusOK, viewBody},
+			"reduce=true":  {http.StatusOK, countBody},
+		}},
+	}
+	page, err := s.GetMetricsInRange(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Metrics) != 1 || page.TotalCount != 1 {
+		t.Fatalf("expected 1 metric of 1, got %d of %d", len(page.Metrics), page.TotalCount)
+	}
+}
+
+// private
+
+type stubResponse struct {
+	status int
+	body   string
+}
+
+// stubHttpClient answers a GET with the response for the first part of the url it contains
+type stubHttpClient struct {
+	responses map[string]stubResponse
+}
+
+func (c *stubHttpClient) Get(ctx context.Context, url string, responseBody any, opts ...*utils.HttpOptions) (*utils.HttpResponse, error) {
+	for match, response := range c.responses {
+		if !strings.Contains(url, match) {
+			continue
+		}
+		if response.status < 300 && responseBody != nil {
+			if err := json.Unmarshal([]byte(response.body), responseBody); err != nil {
+				return nil, err
+			}
+		}
+		return &utils.HttpResponse{StatusCode: response.status}, nil
+	}
+	return &utils.HttpResponse{StatusCode: http.StatusNotFound}, nil
+}
+
+func (c *stubHttpClient) Post(ctx context.Context, url string, body any, responseBody any, opts ...*utils.HttpOptions) (*utils.HttpResponse, error) {
+	return &utils.HttpResponse{StatusCode: http.StatusMethodNotAllowed}, nil
+}
+
+func (c *stubHttpClient) Put(ctx context.Context, url string, body any, responseBody any, opts ...*utils.HttpOptions) (*utils.HttpResponse, error) {
+	return &utils.HttpResponse{StatusCode: http.StatusMethodNotAllowed}, nil
+}
+
+func (c *stubHttpClient) Stream(ctx context.Context, url string, opts ...*utils.HttpOptions) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusMethodNotAllowed, Body: http.NoBody}, nil
+}
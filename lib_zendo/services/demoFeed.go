@@ -0,0 +1,151 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"time"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/utils"
+
+	"go.uber.org/zap"
+)
+
+// DEMO_INTERVAL matches how often cron asks the data fetcher for an update
+const DEMO_INTERVAL time.Duration = 5 * time.Minute
+
+// DemoFeed stands in for the data fetcher when the api keeps everything in memory, as the fetcher can't reach it.
+// It seeds a day of made up readings then adds one every Interval, which defaults to DEMO_INTERVAL.
+// The readings follow a daily cycle so the dashboard, rollups and balance alerts have something to show.
+type DemoFeed struct {
+	DataService IDataService
+	Interval    time.Duration
+}
+
+// Run blocks until ctx is done, it only returns an error if the seed couldn't be stored
+func (f *DemoFeed) Run(ctx context.Context) error {
+	interval := f.Interval
+	if interval <= 0 {
+		interval = DEMO_INTERVAL
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	energyData := []model.LatestEnergeyResponse{}
+	weatherData := []model.WeatherResponse{}
+	for at := now.Add(-demoHistory).Truncate(interval); at.Before(now); at = at.Add(interval) {
+		energy, weather := demoReading(at)
+		energyData = append(energyData, *energy)
+		weatherData = append(weatherData, *weather)
+	}
+	if err := f.DataService.SeedHistoricalData(ctx, &energyData, &weatherData); err != nil {
+		return err
+	}
+	zap.L().Info("Seeded demo data", zap.Int("readings", len(energyData)))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		energy, weather := demoReading(time.Now().UTC().Truncate(time.Second))
+		if err := f.DataService.PostLatestData(ctx, energy, weather); err != nil {
+			zap.L().Warn("Failed to store demo reading", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// CreateDemoKey gives memory storage a key with every scope and prints it once to out, as zendo-admin create-key runs in
+// its own process and can't reach it. The key is kept out of the logs, which are shipped and kept. It only lasts as long
+// as the process.
+func CreateDemoKey(ctx context.Context, apiKeys *ApiKeyService, out io.Writer) error {
+	key, _, err := apiKeys.CreateApiKey(ctx, "demo", model.SCOPES)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(out, "Demo API key with every scope: %s\n", key); err != nil {
+		return err
+	}
+	zap.L().Warn("Storage is in memory, the demo key for the admin routes has been printed to stdout")
+	return nil
+}
+
+// private
+
+const (
+	demoHistory time.Duration = 24 * time.Hour
+	demoZone    string        = "DEMO"
+)
+
+// demoReading makes up the energy and weather at a time. Solar and radiation follow the sun, consumption peaks in the evening
+// and wind drifts over a few hours, so production crosses consumption a couple of times a day.
+func demoReading(at time.Time) (*model.LatestEnergeyResponse, *model.WeatherResponse) {
+	hour := float64(at.Hour()) + float64(at.Minute())/60
+	daylight := max(0, math.Sin((hour-6)/12*math.Pi))
+	evening := math.Sin((hour - 12) / 24 * 2 * math.Pi)
+	drift := math.Sin(float64(at.Unix()) / 10800)
+
+	production := model.PowerProductionBreakdown{
+		Nuclear: demoMegawatts(4500),
+		Gas:     demoMegawatts(8000 + 1500*evening),
+		Wind:    demoMegawatts(6000 + 3500*drift),
+		Solar:   demoMegawatts(5000 * daylight),
+		Hydro:   demoMegawatts(600),
+	}
+	var productionTotal uint32
+	for _, value := range production.Sources() {
+		if value != nil {
+			productionTotal += *value
+		}
+	}
+	consumptionTotal := uint32(24000 + 4000*evening + 1500*daylight)
+
+	// consumption is met from the sources in proportion to what they produce
+	share := float64(consumptionTotal) / float64(productionTotal)
+	consumed := func(produced *uint32) *uint32 {
+		return demoMegawatts(float64(*produced) * share)
+	}
+	consumption := model.PowerConsumptionBreakdown{
+		Nuclear: consumed(production.Nuclear),
+		Gas:     consumed(production.Gas),
+		Wind:    consumed(production.Wind),
+		Solar:   consumed(production.Solar),
+		Hydro:   consumed(production.Hydro),
+	}
+
+	energy := model.LatestEnergeyResponse{
+		BaseDocument: model.BaseDocument{
+			Timestamp: utils.TimePointer(at),
+		},
+		Zone:                      demoZone,
+		SourceTime:                at,
+		PowerProductionBreakdown:  production,
+		PowerConsumptionBreakdown: consumption,
+		PowerProductionTotal:      productionTotal,
+		PowerConsumptionTotal:     consumptionTotal,
+	}
+	weather := model.WeatherResponse{
+		BaseDocument: model.BaseDocument{
+			Timestamp: utils.TimePointer(at),
+		},
+		Location: demoZone,
+		WeatherData: model.WeatherData{
+			Temperature:       float32(11 + 5*math.Sin((hour-9)/24*2*math.Pi)),
+			DirectRadiation:   float32(650 * daylight * (0.8 + 0.2*drift)),
+			CloudCoverPercent: byte(50 - 40*drift),
+			WindSpeedKmPHr:    float32(18 + 12*drift),
+		},
+	}
+
+	return &energy, &weather
+}
+
+func demoMegawatts(value float64) *uint32 {
+	megawatts := uint32(max(0, value))
+	return &megawatts
+}
@@ -0,0 +1,283 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+	"zendo/lib_zendo/errors"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/utils"
+
+	"go.uber.org/zap"
+)
+
+const (
+	METRICS_TOPIC string = "metrics"
+	ENERGY_TOPIC  string = "energy"
+	WEATHER_TOPIC string = "weather"
+	ALERTS_TOPIC  string = "alerts"
+
+	defaultHubBufferSize int           = 16
+	defaultPollInterval  time.Duration = 30 * time.Second
+)
+
+var LIVE_TOPICS = []string{
+	METRICS_TOPIC,
+	ENERGY_TOPIC,
+	WEATHER_TOPIC,
+	ALERTS_TOPIC,
+}
+
+// LiveEvent is a single update pushed to live clients, only the field matching Topic is set
+type LiveEvent struct {
+	Topic   string
+	Metric  *model.Metric
+	Energy  *model.LatestEnergeyResponse
+	Weather *model.WeatherResponse
+	Alert   *model.Alert
+}
+
+// IEventSource delivers each newly written document to handler until ctx is cancelled
+type IEventSource interface {
+	Subscribe(ctx context.Context, handler func(event LiveEvent) error) error
+}
+
+// IAlertRule looks at each new metric in turn and returns an alert when something worth flagging happened
+type IAlertRule interface {
+	Check(metric *model.Metric) *model.Alert
+}
+
+// ChangesFeedEventSource follows the CouchDB changes feed for live energy, weather and aggregated documents,
+// the same feed the data processor follows to write the metrics.
+type ChangesFeedEventSource struct {
+	Feed *CouchDBChangesFeed
+}
+
+// PollingEventSource asks storage for metrics newer than the last one seen, for backends without a changes feed.
+// Only metrics are polled, the raw energy and weather topics need the CouchDB changes feed.
+type PollingEventSource struct {
+	DataService IDataService
+	Interval    time.Duration
+}
+
+// EventHub holds a single upstream subscription and fans every event out to its subscribers.
+// A subscriber that can't keep up is dropped rather than slowing everyone else down,
+// its channel is closed so the client can reconnect and catch up from storage.
+type EventHub struct {
+	Source     IEventSource
+	AlertRules []IAlertRule
+	BufferSize int
+
+	mu          sync.Mutex
+	subscribers map[chan LiveEvent]struct{}
+	stopped     bool
+}
+
+// NewEventSource follows the changes feed on CouchDB and polls storage on every other backend
+func NewEventSource(storage string, dataService IDataService, http utils.IHttpClient) IEventSource {
+	if ResolveStorage(storage) == COUCHDB_STORAGE {
+		return &ChangesFeedEventSource{
+			Feed: &CouchDBChangesFeed{
+				Http:   http,
+				Mode:   CONTINUOUS_FEED,
+				Filter: LIVE_DOCUMENTS_FILTER,
+			},
+		}
+	}
+
+	return &PollingEventSource{
+		DataService: dataService,
+		Interval:    defaultPollInterval,
+	}
+}
+
+// Run blocks holding the upstream subscription until ctx is cancelled, then closes every subscriber
+func (h *EventHub) Run(ctx context.Context) error {
+	defer h.closeAll()
+
+	return h.Source.Subscribe(ctx, func(event LiveEvent) error {
+		h.publish(event)
+
+		if event.Metric == nil {
+			return nil
+		}
+		for _, rule := range h.AlertRules {
+			if alert := rule.Check(event.Metric); alert != nil {
+				zap.L().Info("Raising alert", zap.String("kind", alert.Kind), zap.Time("timestamp", alert.Timestamp))
+				h.publish(LiveEvent{
+					Topic: ALERTS_TOPIC,
+					Alert: alert,
+				})
+			}
+		}
+		return nil
+	})
+}
+
+// Subscribe returns a channel of every new event and a func to stop receiving them
+func (h *EventHub) Subscribe() (<-chan LiveEvent, func()) {
+	return h.SubscribeBuffered(h.BufferSize)
+}
+
+// SubscribeBuffered is Subscribe with its own buffer size, for subscribers that can fall further behind before being dropped
+func (h *EventHub) SubscribeBuffered(size int) (<-chan LiveEvent, func()) {
+	if size <= 0 {
+		size = defaultHubBufferSize
+	}
+	ch := make(chan LiveEvent, size)
+
+	h.mu.Lock()
+	if h.subscribers == nil {
+		h.subscribers = map[chan LiveEvent]struct{}{}
+	}
+	h.subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		if _, ok := h.subscribers[ch]; ok {
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Stopped reports whether Run has returned. A subscriber whose channel is closed was dropped for falling behind
+// unless the hub has stopped.
+func (h *EventHub) Stopped() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.stopped
+}
+
+// Timestamp is the time of the document behind the event
+func (e *LiveEvent) Timestamp() *time.Time {
+	switch {
+	case e.Metric != nil:
+		return e.Metric.Timestamp
+	case e.Energy != nil:
+		return e.Energy.Timestamp
+	case e.Weather != nil:
+		return e.Weather.Timestamp
+	case e.Alert != nil:
+		return &e.Alert.Timestamp
+	}
+	return nil
+}
+
+// Data is the document behind the event
+func (e *LiveEvent) Data() any {
+	switch {
+	case e.Metric != nil:
+		return e.Metric
+	case e.Energy != nil:
+		return e.Energy
+	case e.Weather != nil:
+		return e.Weather
+	case e.Alert != nil:
+		return e.Alert
+	}
+	return nil
+}
+
+func (s *ChangesFeedEventSource) Subscribe(ctx context.Context, handler func(event LiveEvent) error) error {
+	return s.Feed.Subscribe(ctx, func(change Change) error {
+		switch {
+		case change.Deleted:
+			return nil
+		case change.Metric != nil:
+			return handler(LiveEvent{Topic: METRICS_TOPIC, Metric: change.Metric})
+		case change.Energy != nil:
+			return handler(LiveEvent{Topic: ENERGY_TOPIC, Energy: change.Energy})
+		case change.Weather != nil:
+			return handler(LiveEvent{Topic: WEATHER_TOPIC, Weather: change.Weather})
+		}
+		return nil
+	})
+}
+
+func (s *PollingEventSource) Subscribe(ctx context.Context, handler func(event LiveEvent) error) error {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// metrics are stamped with the time of the energy reading which lags behind now, start from the latest stored metric instead
+	var since *time.Time
+	for {
+		if since == nil {
+			latest, err := s.DataService.GetLatestMetric(ctx)
+			if err == nil {
+				since = &time.Time{}
+				if latest != nil && latest.Timestamp != nil {
+					since = latest.Timestamp
+				}
+			} else if !errors.IsCancelled(err) {
+				zap.L().Warn("Failed to get latest metric to poll from", zap.Error(err))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if since == nil {
+			continue
+		}
+
+		page, err := s.DataService.GetMetricsInRange(ctx, MetricsRangeQuery{
+			From: since.Add(time.Nanosecond),
+			To:   time.Now(),
+		})
+		if err != nil {
+			if !errors.IsCancelled(err) {
+				zap.L().Warn("Failed to poll for new metrics", zap.Error(err))
+			}
+			continue
+		}
+
+		for _, metric := range page.Metrics {
+			if err := handler(LiveEvent{Topic: METRICS_TOPIC, Metric: &metric}); err != nil {
+				return err
+			}
+			if metric.Timestamp != nil && metric.Timestamp.After(*since) {
+				since = metric.Timestamp
+			}
+		}
+	}
+}
+
+// private
+
+func (h *EventHub) publish(event LiveEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+			zap.L().Warn("Dropping slow live subscriber")
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (h *EventHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.stopped = true
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
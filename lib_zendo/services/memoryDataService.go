@@ -0,0 +1,373 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"zendo/lib_zendo/errors"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/telemetry"
+	"zendo/lib_zendo/utils"
+
+	"go.uber.org/zap"
+)
+
+// MemoryDataService keeps documents in memory, it is intended for tests and demo mode.
+// Documents are kept ordered by timestamp to mirror the CouchDB by_time views. Nothing else can reach the memory
+// of the process, so each energy reading is aggregated into a metric as it is stored, as the data processor would.
+type MemoryDataService struct {
+	mu      sync.RWMutex
+	energy  []model.LatestEnergeyResponse
+	weather []model.WeatherResponse
+	metrics []model.Metric
+	rollups map[string][]model.MetricRollup
+	apiKeys map[string]model.ApiKey
+}
+
+func NewMemoryDataService() *MemoryDataService {
+	return &MemoryDataService{
+		energy:  []model.LatestEnergeyResponse{},
+		weather: []model.WeatherResponse{},
+		metrics: []model.Metric{},
+		rollups: map[string][]model.MetricRollup{},
+		apiKeys: map[string]model.ApiKey{},
+	}
+}
+
+func (s *MemoryDataService) PostLatestData(ctx context.Context, energy *model.LatestEnergeyResponse, weather *model.WeatherResponse) error {
+	if energy == nil && weather == nil {
+		telemetry.Logger(ctx).Panic("Neither energy update nor weather update was set")
+		return &errors.DatabaseError{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if energy != nil {
+		telemetry.Logger(ctx).Info("Adding new energy data point", zap.Timep("timestamp", energy.Timestamp))
+		energy.Type = utils.StringPointer(model.ENERGY_TYPE)
+		s.energy = insertByTime(s.energy, *energy, energyTimestamp)
+	}
+	if weather != nil {
+		telemetry.Logger(ctx).Info("Adding new weather data point", zap.Timep("timestamp", weather.Timestamp))
+		weather.Type = utils.StringPointer(model.WEATHER_TYPE)
+		s.weather = insertByTime(s.weather, *weather, weatherTimestamp)
+	}
+	if energy != nil {
+		s.aggregate(energy)
+	}
+
+	return nil
+}
+
+func (s *MemoryDataService) SeedHistoricalData(ctx context.Context, energyData *[]model.LatestEnergeyResponse, weatherData *[]model.WeatherResponse) error {
+	if energyData == nil || weatherData == nil {
+		telemetry.Logger(ctx).Panic("Neither energy data nor weather data was set")
+		return &errors.DatabaseError{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, x := range *energyData {
+		x.Type = utils.StringPointer(model.ENERGY_TYPE)
+		x.HistoricalSeed = true
+		s.energy = insertByTime(s.energy, x, energyTimestamp)
+	}
+	for _, x := range *weatherData {
+		x.Type = utils.StringPointer(model.WEATHER_TYPE)
+		x.HistoricalSeed = true
+		s.weather = insertByTime(s.weather, x, weatherTimestamp)
+	}
+	for _, x := range *energyData {
+		x.HistoricalSeed = true
+		s.aggregate(&x)
+	}
+
+	return nil
+}
+
+// PostMetric stores an aggregated metric as is, for tests that need metrics without energy and weather behind them.
+func (s *MemoryDataService) PostMetric(metric model.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metric.Type = utils.StringPointer(model.AGGREGATED_TYPE)
+	s.metrics = insertByTime(s.metrics, metric, metricTimestamp)
+}
+
+func (s *MemoryDataService) GetLatestWeatherDate(ctx context.Context) (*time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.weather) == 0 {
+		// no data
+		return nil, nil
+	}
+
+	t := *weatherTimestamp(&s.weather[len(s.weather)-1])
+	return &t, nil
+}
+
+func (s *MemoryDataService) GetLatestEnergyDate(ctx context.Context) (*time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.energy) == 0 {
+		// no data
+		return nil, nil
+	}
+
+	t := *energyTimestamp(&s.energy[len(s.energy)-1])
+	return &t, nil
+}
+
+func (s *MemoryDataService) GetLatestMetric(ctx context.Context) (*model.Metric, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.metrics) == 0 {
+		// no data
+		return nil, nil
+	}
+
+	metric := s.metrics[len(s.metrics)-1]
+	return &metric, nil
+}
+
+func (s *MemoryDataService) Get24HoursOfMetrics(ctx context.Context) (*[]model.Metric, error) {
+	page, err := s.GetMetricsInRange(ctx, Last24HoursQuery())
+	if err != nil {
+		return nil, err
+	}
+
+	return &page.Metrics, nil
+}
+
+func (s *MemoryDataService) GetMetricsInRange(ctx context.Context, query MetricsRangeQuery) (*MetricsPage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data := []model.Metric{}
+	count := 0
+	for i := range s.metrics {
+		// walk backwards for descending order to match the CouchDB view
+		metric := s.metrics[i]
+		if query.Descending {
+			metric = s.metrics[len(s.metrics)-1-i]
+		}
+
+		t := metricTimestamp(&metric)
+		if t.Before(query.From) || t.After(query.To) {
+			continue
+		}
+		count++
+
+		if query.StartAt != nil {
+			if query.Descending && t.After(query.StartAt.Timestamp) {
+				continue
+			}
+			if !query.Descending && t.Before(query.StartAt.Timestamp) {
+				continue
+			}
+		}
+
+		// one extra metric finds the start of the next page
+		if query.Limit == 0 || len(data) <= query.Limit {
+			data = append(data, metric)
+		}
+	}
+
+	return pageOfMetrics(data, query.Limit, count), nil
+}
+
+func (s *MemoryDataService) GetRollups(ctx context.Context, resolution string, from time.Time, to time.Time) (*[]model.MetricRollup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rollups := []model.MetricRollup{}
+	for _, rollup := range s.rollups[resolution] {
+		t := rollupTimestamp(&rollup)
+		if t.Before(from) || t.After(to) {
+			continue
+		}
+		rollups = append(rollups, rollup)
+	}
+
+	return &rollups, nil
+}
+
+func (s *MemoryDataService) PostRollups(ctx context.Context, rollups *[]model.MetricRollup) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rollup := range *rollups {
+		rollup.Type = utils.StringPointer(model.ROLLUP_TYPE)
+		s.rollups[rollup.Resolution] = insertByTime(s.rollups[rollup.Resolution], rollup, rollupTimestamp)
+	}
+
+	return nil
+}
+
+func (s *MemoryDataService) PurgeBefore(ctx context.Context, docType string, before time.Time, dryRun bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged int
+	switch docType {
+	case model.ENERGY_TYPE:
+		s.energy, purged = purgeByTime(s.energy, before, dryRun, energyTimestamp)
+	case model.WEATHER_TYPE:
+		s.weather, purged = purgeByTime(s.weather, before, dryRun, weatherTimestamp)
+	case model.AGGREGATED_TYPE:
+		s.metrics, purged = purgeByTime(s.metrics, before, dryRun, metricTimestamp)
+	default:
+		return 0, fmt.Errorf("unknown document type: %s", docType)
+	}
+
+	return purged, nil
+}
+
+func (s *MemoryDataService) PurgeRollupsBefore(ctx context.Context, resolution string, before time.Time, dryRun bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged int
+	s.rollups[resolution], purged = purgeByTime(s.rollups[resolution], before, dryRun, rollupTimestamp)
+	return purged, nil
+}
+
+func (s *MemoryDataService) PostApiKey(ctx context.Context, key *model.ApiKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.apiKeys[key.Id]; ok {
+		return fmt.Errorf("api key already exists: %s", key.Id)
+	}
+	s.apiKeys[key.Id] = *key
+
+	return nil
+}
+
+func (s *MemoryDataService) GetApiKey(ctx context.Context, id string) (*model.ApiKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.apiKeys[id]
+	if !ok {
+		return nil, nil
+	}
+
+	return &key, nil
+}
+
+func (s *MemoryDataService) GetApiKeys(ctx context.Context) (*[]model.ApiKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]model.ApiKey, 0, len(s.apiKeys))
+	for _, key := range s.apiKeys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Id < keys[j].Id
+	})
+
+	return &keys, nil
+}
+
+func (s *MemoryDataService) RevokeApiKey(ctx context.Context, id string, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[id]
+	if !ok {
+		return false, nil
+	}
+	if key.RevokedAt == nil {
+		key.RevokedAt = &at
+		s.apiKeys[id] = key
+	}
+
+	return true, nil
+}
+
+func (s *MemoryDataService) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemoryDataService) CheckSetup(ctx context.Context) error {
+	return nil
+}
+
+// private
+
+// aggregate stores the metric for an energy reading, readings before any weather are skipped
+func (s *MemoryDataService) aggregate(energy *model.LatestEnergeyResponse) {
+	metric := aggregateMetric(energy, s.energy, s.weather)
+	if metric == nil {
+		zap.L().Debug("No weather to aggregate the energy reading with", zap.Timep("timestamp", energy.Timestamp))
+		return
+	}
+	s.metrics = insertByTime(s.metrics, *metric, metricTimestamp)
+}
+
+// purgeByTime drops the documents before the cutoff from the front of the sorted slice, a dry run leaves the slice as is
+func purgeByTime[T any](docs []T, before time.Time, dryRun bool, timestamp func(*T) *time.Time) ([]T, int) {
+	i := sort.Search(len(docs), func(i int) bool {
+		return !timestamp(&docs[i]).Before(before)
+	})
+
+	if dryRun {
+		return docs, i
+	}
+	return docs[i:], i
+}
+
+// insertByTime keeps the slice sorted ascending by timestamp, documents without one are dropped like the CouchDB views do.
+// A document with the same id as one already stored is ignored so repeated ingests are safe.
+func insertByTime[T any, P interface {
+	*T
+	DocumentId() string
+}](docs []T, doc T, timestamp func(*T) *time.Time) []T {
+	t := timestamp(&doc)
+	if t == nil {
+		zap.L().Warn("Skipping document without a timestamp")
+		return docs
+	}
+
+	i := sort.Search(len(docs), func(i int) bool {
+		return timestamp(&docs[i]).After(*t)
+	})
+
+	id := P(&doc).DocumentId()
+	for j := i - 1; j >= 0 && timestamp(&docs[j]).Equal(*t); j-- {
+		if P(&docs[j]).DocumentId() == id {
+			zap.L().Info("Document already stored, skipping", zap.String("id", id))
+			return docs
+		}
+	}
+
+	docs = append(docs, doc)
+	copy(docs[i+1:], docs[i:])
+	docs[i] = doc
+	return docs
+}
+
+func energyTimestamp(doc *model.LatestEnergeyResponse) *time.Time {
+	return doc.Timestamp
+}
+
+func weatherTimestamp(doc *model.WeatherResponse) *time.Time {
+	return doc.Timestamp
+}
+
+func metricTimestamp(doc *model.Metric) *time.Time {
+	return doc.Timestamp
+}
+
+func rollupTimestamp(doc *model.MetricRollup) *time.Time {
+	return doc.Timestamp
+}
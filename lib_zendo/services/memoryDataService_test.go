@@ -0,0 +1,279 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/utils"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestInsertByTimeKeepsOrder(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	docs := []model.Metric{}
+	for _, hour := range []int{3, 1, 4, 0, 2} {
+		docs = insertByTime(docs, metricForTest(start.Add(time.Duration(hour)*time.Hour), hour), metricTimestamp)
+	}
+
+	if len(docs) != 5 {
+		t.Fatalf("expected 5 metrics, got %d", len(docs))
+	}
+	for i, doc := range docs {
+		if !doc.Timestamp.Equal(start.Add(time.Duration(i) * time.Hour)) {
+			t.Fatalf("expected metrics in ascending order, got %v at %d", doc.Timestamp, i)
+		}
+	}
+}
+
+func TestInsertByTimeSkipsDuplicates(t *testing.T) {
+	at := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	docs := []model.LatestEnergeyResponse{}
+
+	docs = insertByTime(docs, *energyForTest(at, 100), energyTimestamp)
+	docs = insertByTime(docs, *energyForTest(at.Add(time.Hour), 200), energyTimestamp)
+	// same zone and time is the same data point, the first one stored is kept
+	docs = insertByTime(docs, *energyForTest(at, 999), energyTimestamp)
+	if len(docs) != 2 || docs[0].PowerProductionTotal != 100 {
+		t.Fatalf("expected the repeated reading to be skipped, got %d readings", len(docs))
+	}
+
+	// another zone at the same time is a different data point
+	other := energyForTest(at, 300)
+	other.Zone = "FR"
+	docs = insertByTime(docs, *other, energyTimestamp)
+	if len(docs) != 3 {
+		t.Fatalf("expected a reading from another zone to be stored, got %d readings", len(docs))
+	}
+	if docs[0].Zone != "GB" || docs[1].Zone != "FR" || !docs[2].Timestamp.Equal(at.Add(time.Hour)) {
+		t.Fatal("expected the readings at the same time to stay ahead of the later one in the order stored")
+	}
+
+	// like the views, a document without a timestamp isn't stored
+	docs = insertByTime(docs, model.LatestEnergeyResponse{Zone: "GB"}, energyTimestamp)
+	if len(docs) != 3 {
+		t.Fatalf("expected a reading without a timestamp to be skipped, got %d readings", len(docs))
+	}
+}
+
+func TestMemoryMetricsRangePaging(t *testing.T) {
+	s := NewMemoryDataService()
+	ctx := context.Background()
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range 7 {
+		s.PostMetric(metricForTest(start.Add(time.Duration(i)*time.Hour), i))
+	}
+
+	for _, descending := range []bool{false, true} {
+		query := MetricsRangeQuery{
+			From:       start.Add(time.Hour),
+			To:         start.Add(5 * time.Hour),
+			Descending: descending,
+			Limit:      2,
+		}
+
+		seen := []int{}
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatal("paging didn't finish")
+			}
+
+			page, err := s.GetMetricsInRange(ctx, query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if page.TotalCount != 5 {
+				t.Fatalf("expected a total count of 5, got %d", page.TotalCount)
+			}
+			if len(page.Metrics) > 2 {
+				t.Fatalf("expected at most 2 metrics per page, got %d", len(page.Metrics))
+			}
+			for _, metric := range page.Metrics {
+				seen = append(seen, int(metric.TotalProduction))
+			}
+
+			if page.NextCursor == nil {
+				break
+			}
+			query.StartAt = page.NextCursor
+		}
+
+		expected := []int{1, 2, 3, 4, 5}
+		if descending {
+			expected = []int{5, 4, 3, 2, 1}
+		}
+		if len(seen) != len(expected) {
+			t.Fatalf("descending %v: expected %v over every page, got %v", descending, expected, seen)
+		}
+		for i := range expected {
+			if seen[i] != expected[i] {
+				t.Fatalf("descending %v: expected %v over every page, got %v", descending, expected, seen)
+			}
+		}
+	}
+
+	// without a limit the whole range is one page
+	page, err := s.GetMetricsInRange(ctx, MetricsRangeQuery{From: start, To: start.Add(6 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Metrics) != 7 || page.NextCursor != nil {
+		t.Fatalf("expected every metric on one page, got %d and cursor %v", len(page.Metrics), page.NextCursor)
+	}
+}
+
+func TestPurgeByTime(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	docs := []model.Metric{}
+	for i := range 4 {
+		docs = insertByTime(docs, metricForTest(start.Add(time.Duration(i)*time.Hour), i), metricTimestamp)
+	}
+	cutoff := start.Add(2 * time.Hour)
+
+	kept, counted := purgeByTime(docs, cutoff, true, metricTimestamp)
+	if counted != 2 || len(kept) != 4 {
+		t.Fatalf("expected the dry run to count 2 and keep all 4, got %d and %d", counted, len(kept))
+	}
+
+	kept, purged := purgeByTime(docs, cutoff, false, metricTimestamp)
+	if purged != 2 || len(kept) != 2 {
+		t.Fatalf("expected 2 purged and 2 kept, got %d and %d", purged, len(kept))
+	}
+	// the cutoff itself is kept
+	if !kept[0].Timestamp.Equal(cutoff) {
+		t.Fatalf("expected the metric at the cutoff to be kept, got %v first", kept[0].Timestamp)
+	}
+
+	if kept, purged := purgeByTime(docs, start, false, metricTimestamp); purged != 0 || len(kept) != 4 {
+		t.Fatalf("expected nothing before the first metric to purge, got %d purged", purged)
+	}
+	if kept, purged := purgeByTime(docs, start.Add(time.Hour*24), false, metricTimestamp); purged != 4 || len(kept) != 0 {
+		t.Fatalf("expected everything to be purged, got %d purged", purged)
+	}
+}
+
+func TestMemoryAggregatesEnergyReadings(t *testing.T) {
+	s := NewMemoryDataService()
+	ctx := context.Background()
+	at := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// without weather to pair with there is no metric
+	if err := s.PostLatestData(ctx, energyForTest(at.Add(-2*time.Hour), 100), nil); err != nil {
+		t.Fatal(err)
+	}
+	if latest, _ := s.GetLatestMetric(ctx); latest != nil {
+		t.Fatalf("expected no metric without weather, got %+v", latest)
+	}
+
+	energy := []model.LatestEnergeyResponse{*energyForTest(at.Add(-time.Hour), 200)}
+	weather := []model.WeatherResponse{*weatherForTest(at.Add(-time.Hour), 4)}
+	if err := s.SeedHistoricalData(ctx, &energy, &weather); err != nil {
+		t.Fatal(err)
+	}
+
+	reading := energyForTest(at, 300)
+	reading.PowerConsumptionTotal = 350
+	if err := s.PostLatestData(ctx, reading, weatherForTest(at, 6)); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := s.GetMetricsInRange(ctx, MetricsRangeQuery{From: at.Add(-time.Hour * 24), To: at})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Metrics) != 2 {
+		t.Fatalf("expected a metric for each reading with weather, got %d", len(page.Metrics))
+	}
+
+	latest := page.Metrics[1]
+	if !latest.Timestamp.Equal(at) || latest.Type == nil || *latest.Type != model.AGGREGATED_TYPE {
+		t.Fatalf("expected an aggregated metric at %v, got %+v", at, latest)
+	}
+	if latest.TotalProduction != 300 || latest.TotalConsumption != 350 || latest.NetBalance != -50 {
+		t.Fatalf("expected totals of 300 and 350 with a balance of -50, got %+v", latest)
+	}
+	if latest.WeatherData.Temperature != 6 {
+		t.Fatalf("expected the weather at the reading, got a temperature of %v", latest.WeatherData.Temperature)
+	}
+	// temperature and consumption rose together over the two readings paired with weather
+	if latest.CorrelationData.TemperatureVsConsumptionCorrelation < 0.99 {
+		t.Fatalf("expected a correlation of 1, got %v", latest.CorrelationData.TemperatureVsConsumptionCorrelation)
+	}
+}
+
+func TestDemoFeedFillsMemory(t *testing.T) {
+	s := NewMemoryDataService()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	feed := DemoFeed{DataService: s, Interval: time.Hour}
+	done := make(chan error, 1)
+	go func() {
+		done <- feed.Run(ctx)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		latest, _ := s.GetLatestMetric(ctx)
+		if latest != nil && time.Since(*latest.Timestamp) < time.Minute {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected a current metric from the demo feed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	page, err := s.GetMetricsInRange(ctx, Last24HoursQuery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Metrics) < 24 {
+		t.Fatalf("expected a day of hourly metrics, got %d", len(page.Metrics))
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("expected the feed to stop cleanly, got %v", err)
+	}
+}
+
+func TestCreateDemoKeyKeepsTheKeyOutOfTheLogs(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+	ctx := context.Background()
+	apiKeys := &ApiKeyService{Store: NewMemoryDataService()}
+
+	var out bytes.Buffer
+	if err := CreateDemoKey(ctx, apiKeys, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	_, key, found := strings.Cut(strings.TrimSpace(out.String()), ": ")
+	if !found {
+		t.Fatalf("expected the key to be printed, got %q", out.String())
+	}
+	if stored, err := apiKeys.Authenticate(ctx, key); err != nil || stored == nil || len(stored.Scopes) != len(model.SCOPES) {
+		t.Fatalf("expected the printed key to have every scope, got %+v and %v", stored, err)
+	}
+	for _, entry := range logs.All() {
+		if strings.Contains(fmt.Sprint(entry.Message, entry.ContextMap()), key) {
+			t.Fatalf("expected the key to stay out of the logs, got %q", entry.Message)
+		}
+	}
+}
+
+// private
+
+func metricForTest(at time.Time, value int) model.Metric {
+	return model.Metric{
+		BaseDocument:     model.BaseDocument{Timestamp: utils.TimePointer(at)},
+		TotalProduction:  uint32(value),
+		TotalConsumption: uint32(value),
+	}
+}
@@ -0,0 +1,83 @@
+-- Typed tables for the three document kinds, indexed by time.
+
+CREATE TABLE IF NOT EXISTS energy (
+    timestamp TIMESTAMPTZ NOT NULL,
+    source_time TIMESTAMPTZ NOT NULL,
+    historical_seed BOOLEAN NOT NULL DEFAULT FALSE,
+    production_nuclear BIGINT,
+    production_geothermal BIGINT,
+    production_biomass BIGINT,
+    production_coal BIGINT,
+    production_wind BIGINT,
+    production_solar BIGINT,
+    production_hydro BIGINT,
+    production_gas BIGINT,
+    production_oil BIGINT,
+    production_unknown BIGINT,
+    production_hydro_discharge BIGINT,
+    production_battery_discharge BIGINT,
+    consumption_nuclear BIGINT,
+    consumption_geothermal BIGINT,
+    consumption_biomass BIGINT,
+    consumption_coal BIGINT,
+    consumption_wind BIGINT,
+    consumption_solar BIGINT,
+    consumption_hydro BIGINT,
+    consumption_gas BIGINT,
+    consumption_oil BIGINT,
+    consumption_unknown BIGINT,
+    consumption_hydro_discharge BIGINT,
+    consumption_battery_discharge BIGINT,
+    production_total BIGINT NOT NULL,
+    consumption_total BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS energy_by_time ON energy (timestamp DESC);
+
+CREATE TABLE IF NOT EXISTS weather (
+    timestamp TIMESTAMPTZ NOT NULL,
+    historical_seed BOOLEAN NOT NULL DEFAULT FALSE,
+    temperature REAL NOT NULL,
+    direct_radiation REAL NOT NULL,
+    cloud_cover SMALLINT NOT NULL,
+    wind_speed REAL NOT NULL
+);
+CREATE INDEX IF NOT EXISTS weather_by_time ON weather (timestamp DESC);
+
+CREATE TABLE IF NOT EXISTS metrics (
+    timestamp TIMESTAMPTZ NOT NULL,
+    historical_seed BOOLEAN NOT NULL DEFAULT FALSE,
+    total_production BIGINT NOT NULL,
+    total_consumption BIGINT NOT NULL,
+    net_balance BIGINT NOT NULL,
+    temperature REAL NOT NULL,
+    direct_radiation REAL NOT NULL,
+    cloud_cover SMALLINT NOT NULL,
+    wind_speed REAL NOT NULL,
+    production_nuclear BIGINT,
+    production_geothermal BIGINT,
+    production_biomass BIGINT,
+    production_coal BIGINT,
+    production_wind BIGINT,
+    production_solar BIGINT,
+    production_hydro BIGINT,
+    production_gas BIGINT,
+    production_oil BIGINT,
+    production_unknown BIGINT,
+    production_hydro_discharge BIGINT,
+    production_battery_discharge BIGINT,
+    consumption_nuclear BIGINT,
+    consumption_geothermal BIGINT,
+    consumption_biomass BIGINT,
+    consumption_coal BIGINT,
+    consumption_wind BIGINT,
+    consumption_solar BIGINT,
+    consumption_hydro BIGINT,
+    consumption_gas BIGINT,
+    consumption_oil BIGINT,
+    consumption_unknown BIGINT,
+    consumption_hydro_discharge BIGINT,
+    consumption_battery_discharge BIGINT,
+    solar_correlation REAL NOT NULL,
+    temperature_correlation REAL NOT NULL
+);
+CREATE INDEX IF NOT EXISTS metrics_by_time ON metrics (timestamp DESC);
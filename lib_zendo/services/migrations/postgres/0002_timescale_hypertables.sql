@@ -0,0 +1,12 @@
+-- Turn the tables into hypertables when TimescaleDB is available, plain Postgres is left as is.
+
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = 'timescaledb') THEN
+        CREATE EXTENSION IF NOT EXISTS timescaledb;
+        PERFORM create_hypertable('energy', 'timestamp', if_not_exists => TRUE, migrate_data => TRUE);
+        PERFORM create_hypertable('weather', 'timestamp', if_not_exists => TRUE, migrate_data => TRUE);
+        PERFORM create_hypertable('metrics', 'timestamp', if_not_exists => TRUE, migrate_data => TRUE);
+    END IF;
+END
+$$;
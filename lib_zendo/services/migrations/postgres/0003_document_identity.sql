@@ -0,0 +1,13 @@
+-- Identify each data point by its type (table), source and timestamp so repeated ingests are ignored.
+
+ALTER TABLE energy ADD COLUMN IF NOT EXISTS zone TEXT NOT NULL DEFAULT '';
+ALTER TABLE weather ADD COLUMN IF NOT EXISTS location TEXT NOT NULL DEFAULT '';
+
+-- drop duplicates written before the identity existed, keeping one row per data point
+DELETE FROM energy a USING energy b WHERE a.ctid < b.ctid AND a.zone = b.zone AND a.timestamp = b.timestamp;
+DELETE FROM weather a USING weather b WHERE a.ctid < b.ctid AND a.location = b.location AND a.timestamp = b.timestamp;
+DELETE FROM metrics a USING metrics b WHERE a.ctid < b.ctid AND a.timestamp = b.timestamp;
+
+CREATE UNIQUE INDEX IF NOT EXISTS energy_identity ON energy (zone, timestamp);
+CREATE UNIQUE INDEX IF NOT EXISTS weather_identity ON weather (location, timestamp);
+CREATE UNIQUE INDEX IF NOT EXISTS metrics_identity ON metrics (timestamp);
@@ -0,0 +1,8 @@
+-- Downsampled metrics, one row per resolution and bucket start. The per source stats vary so are kept as json.
+
+CREATE TABLE IF NOT EXISTS rollups (
+	resolution TEXT NOT NULL,
+	timestamp TIMESTAMPTZ NOT NULL,
+	doc JSONB NOT NULL,
+	PRIMARY KEY (resolution, timestamp)
+);
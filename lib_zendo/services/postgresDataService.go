@@ -0,0 +1,821 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"zendo/lib_zendo/errors"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/telemetry"
+	"zendo/lib_zendo/utils"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"go.uber.org/zap"
+)
+
+// PostgresDataService stores each document kind in its own typed table, see migrations/postgres.
+// When TimescaleDB is installed the tables are converted to hypertables.
+type PostgresDataService struct {
+	db *sql.DB
+}
+
+//go:embed migrations/postgres/*.sql
+var postgresMigrations embed.FS
+
+var breakdownColumnNames = []string{
+	"nuclear",
+	"geothermal",
+	"biomass",
+	"coal",
+	"wind",
+	"solar",
+	"hydro",
+	"gas",
+	"oil",
+	"unknown",
+	"hydro_discharge",
+	"battery_discharge",
+}
+
+var (
+	energyColumns = columnList(
+		[]string{"timestamp", "zone", "source_time", "historical_seed"},
+		prefixedColumns("production_"),
+		prefixedColumns("consumption_"),
+		[]string{"production_total", "consumption_total"},
+	)
+	weatherColumns = columnList(
+		[]string{"timestamp", "location", "historical_seed", "temperature", "direct_radiation", "cloud_cover", "wind_speed"},
+	)
+	metricColumns = columnList(
+		[]string{"timestamp", "historical_seed", "total_production", "total_consumption", "net_balance"},
+		[]string{"temperature", "direct_radiation", "cloud_cover", "wind_speed"},
+		prefixedColumns("production_"),
+		prefixedColumns("consumption_"),
+		[]string{"solar_correlation", "temperature_correlation"},
+	)
+)
+
+func NewPostgresDataService(url string) (*PostgresDataService, error) {
+	db, err := sql.Open("pgx", url)
+	if err != nil {
+		zap.L().Error("Failed to open postgres connection", zap.Error(err))
+		return nil, &errors.DatabaseError{}
+	}
+
+	if err := db.Ping(); err != nil {
+		zap.L().Error("Failed to connect to postgres", zap.Error(err))
+		db.Close()
+		return nil, &errors.DatabaseError{}
+	}
+
+	s := PostgresDataService{
+		db: db,
+	}
+	if err := s.migrate(); err != nil {
+		zap.L().Error("Failed to migrate postgres schema", zap.Error(err))
+		db.Close()
+		return nil, &errors.DatabaseError{}
+	}
+
+	return &s, nil
+}
+
+func (s *PostgresDataService) Close() error {
+	return s.db.Close()
+}
+
+func (s *PostgresDataService) PostLatestData(ctx context.Context, energy *model.LatestEnergeyResponse, weather *model.WeatherResponse) error {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	if energy == nil && weather == nil {
+		telemetry.Logger(ctx).Panic("Neither energy update nor weather update was set")
+		return &errors.DatabaseError{}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return requestError(ctx, "Failed to start transaction", err)
+	}
+	defer tx.Rollback()
+
+	if energy != nil {
+		telemetry.Logger(ctx).Info("Adding new energy data point", zap.Timep("timestamp", energy.Timestamp))
+		if err := insertEnergy(ctx, tx, energy); err != nil {
+			return requestError(ctx, "Failed to insert latest energy data", err)
+		}
+	}
+	if weather != nil {
+		telemetry.Logger(ctx).Info("Adding new weather data point", zap.Timep("timestamp", weather.Timestamp))
+		if err := insertWeather(ctx, tx, weather); err != nil {
+			return requestError(ctx, "Failed to insert latest weather data", err)
+		}
+	}
+	if energy != nil {
+		if err := s.aggregate(ctx, tx, []model.LatestEnergeyResponse{*energy}); err != nil {
+			return requestError(ctx, "Failed to aggregate latest energy data", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return requestError(ctx, "Failed to commit latest data", err)
+	}
+
+	return nil
+}
+
+func (s *PostgresDataService) SeedHistoricalData(ctx context.Context, energyData *[]model.LatestEnergeyResponse, weatherData *[]model.WeatherResponse) error {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	if energyData == nil || weatherData == nil {
+		telemetry.Logger(ctx).Panic("Neither energy data nor weather data was set")
+		return &errors.DatabaseError{}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return requestError(ctx, "Failed to start transaction", err)
+	}
+	defer tx.Rollback()
+
+	seeded := make([]model.LatestEnergeyResponse, 0, len(*energyData))
+	for _, x := range *energyData {
+		x.HistoricalSeed = true
+		if err := insertEnergy(ctx, tx, &x); err != nil {
+			return requestError(ctx, "Failed to insert seed energy data", err)
+		}
+		seeded = append(seeded, x)
+	}
+	for _, x := range *weatherData {
+		x.HistoricalSeed = true
+		if err := insertWeather(ctx, tx, &x); err != nil {
+			return requestError(ctx, "Failed to insert seed weather data", err)
+		}
+	}
+	if err := s.aggregate(ctx, tx, seeded); err != nil {
+		return requestError(ctx, "Failed to aggregate seed energy data", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return requestError(ctx, "Failed to commit seed data", err)
+	}
+
+	return nil
+}
+
+func (s *PostgresDataService) GetLatestWeatherDate(ctx context.Context) (*time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	return s.latestTimestamp(ctx, "weather")
+}
+
+func (s *PostgresDataService) GetLatestEnergyDate(ctx context.Context) (*time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	return s.latestTimestamp(ctx, "energy")
+}
+
+func (s *PostgresDataService) GetLatestMetric(ctx context.Context) (*model.Metric, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	metrics, err := s.queryMetrics(ctx, "SELECT "+metricColumns+" FROM metrics ORDER BY timestamp DESC LIMIT 1")
+	if err != nil {
+		return nil, requestError(ctx, "Failed to get latest metric", err)
+	}
+
+	if len(metrics) == 0 {
+		// no data
+		return nil, nil
+	}
+
+	return &metrics[0], nil
+}
+
+func (s *PostgresDataService) Get24HoursOfMetrics(ctx context.Context) (*[]model.Metric, error) {
+	page, err := s.GetMetricsInRange(ctx, Last24HoursQuery())
+	if err != nil {
+		return nil, err
+	}
+
+	return &page.Metrics, nil
+}
+
+func (s *PostgresDataService) GetMetricsInRange(ctx context.Context, query MetricsRangeQuery) (*MetricsPage, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	order := "ASC"
+	start := ">="
+	startAt := query.From
+	if query.Descending {
+		order = "DESC"
+		start = "<="
+		startAt = query.To
+	}
+
+	// metrics are unique by timestamp so the cursor timestamp alone marks the position
+	if query.StartAt != nil {
+		startAt = query.StartAt.Timestamp
+	}
+
+	// a NULL limit is the same as no limit, one extra row finds the start of the next page
+	var limit *int
+	if query.Limit > 0 {
+		pageLimit := query.Limit + 1
+		limit = &pageLimit
+	}
+
+	metrics, err := s.queryMetrics(ctx,
+		"SELECT "+metricColumns+" FROM metrics WHERE timestamp BETWEEN $1 AND $2 AND timestamp "+start+" $3 ORDER BY timestamp "+order+" LIMIT $4",
+		query.From,
+		query.To,
+		startAt,
+		limit,
+	)
+	if err != nil {
+		return nil, requestError(ctx, "Failed to get metrics in range", err)
+	}
+
+	var count int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM metrics WHERE timestamp BETWEEN $1 AND $2", query.From, query.To).Scan(&count); err != nil {
+		return nil, requestError(ctx, "Failed to count metrics in range", err)
+	}
+
+	return pageOfMetrics(metrics, query.Limit, count), nil
+}
+
+func (s *PostgresDataService) GetRollups(ctx context.Context, resolution string, from time.Time, to time.Time) (*[]model.MetricRollup, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT doc FROM rollups WHERE resolution = $1 AND timestamp BETWEEN $2 AND $3 ORDER BY timestamp ASC",
+		resolution,
+		from,
+		to,
+	)
+	if err != nil {
+		return nil, requestError(ctx, "Failed to get rollups", err)
+	}
+	defer rows.Close()
+
+	rollups := []model.MetricRollup{}
+	for rows.Next() {
+		var doc []byte
+		if err := rows.Scan(&doc); err != nil {
+			return nil, requestError(ctx, "Failed to read rollup", err)
+		}
+
+		var rollup model.MetricRollup
+		if err := json.Unmarshal(doc, &rollup); err != nil {
+			return nil, requestError(ctx, "Failed to decode rollup", err)
+		}
+		rollups = append(rollups, rollup)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, requestError(ctx, "Failed to get rollups", err)
+	}
+
+	return &rollups, nil
+}
+
+func (s *PostgresDataService) PostRollups(ctx context.Context, rollups *[]model.MetricRollup) error {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return requestError(ctx, "Failed to start transaction", err)
+	}
+	defer tx.Rollback()
+
+	for i := range *rollups {
+		rollup := &(*rollups)[i]
+		rollup.Type = utils.StringPointer(model.ROLLUP_TYPE)
+
+		doc, err := json.Marshal(rollup)
+		if err != nil {
+			return requestError(ctx, "Failed to encode rollup", err)
+		}
+
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO rollups (resolution, timestamp, doc) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+			rollup.Resolution,
+			rollup.Timestamp,
+			string(doc),
+		); err != nil {
+			return requestError(ctx, "Failed to insert rollup", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return requestError(ctx, "Failed to commit rollups", err)
+	}
+
+	return nil
+}
+
+func (s *PostgresDataService) PurgeBefore(ctx context.Context, docType string, before time.Time, dryRun bool) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	table, ok := documentTables[docType]
+	if !ok {
+		return 0, fmt.Errorf("unknown document type: %s", docType)
+	}
+
+	return s.purgeRows(ctx, table, "timestamp < $1", dryRun, before)
+}
+
+func (s *PostgresDataService) PurgeRollupsBefore(ctx context.Context, resolution string, before time.Time, dryRun bool) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	return s.purgeRows(ctx, "rollups", "resolution = $1 AND timestamp < $2", dryRun, resolution, before)
+}
+
+// PostApiKey stores a new key, the id is the primary key so an existing key is never overwritten
+func (s *PostgresDataService) PostApiKey(ctx context.Context, key *model.ApiKey) error {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx,
+		"INSERT INTO api_keys (id, name, hash, scopes, created_at, revoked_at) VALUES ($1, $2, $3, $4, $5, $6)",
+		key.Id,
+		key.Name,
+		key.Hash,
+		strings.Join(key.Scopes, " "),
+		key.CreatedAt,
+		key.RevokedAt,
+	); err != nil {
+		return requestError(ctx, "Failed to insert api key", err)
+	}
+
+	return nil
+}
+
+func (s *PostgresDataService) GetApiKey(ctx context.Context, id string) (*model.ApiKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	keys, err := s.queryApiKeys(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE id = $1", id)
+	if err != nil {
+		return nil, requestError(ctx, "Failed to get api key", err)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	return &keys[0], nil
+}
+
+func (s *PostgresDataService) GetApiKeys(ctx context.Context) (*[]model.ApiKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	keys, err := s.queryApiKeys(ctx, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, requestError(ctx, "Failed to get api keys", err)
+	}
+
+	return &keys, nil
+}
+
+func (s *PostgresDataService) RevokeApiKey(ctx context.Context, id string, at time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	// only the first revocation counts so the original time is kept
+	var found bool
+	if err := s.db.QueryRowContext(ctx,
+		"WITH revoked AS (UPDATE api_keys SET revoked_at = COALESCE(revoked_at, $2) WHERE id = $1 RETURNING id) SELECT EXISTS (SELECT 1 FROM revoked)",
+		id,
+		at,
+	).Scan(&found); err != nil {
+		return false, requestError(ctx, "Failed to revoke api key", err)
+	}
+
+	return found, nil
+}
+
+// Compact marks the space left by purged rows for reuse and refreshes the planner statistics
+func (s *PostgresDataService) Compact(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, "VACUUM ANALYZE energy, weather, metrics, rollups"); err != nil {
+		telemetry.Logger(ctx).Error("Failed to vacuum postgres tables", zap.Error(err))
+		return &errors.DatabaseError{}
+	}
+
+	return nil
+}
+
+func (s *PostgresDataService) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	return s.db.PingContext(ctx)
+}
+
+func (s *PostgresDataService) CheckSetup(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	latest, err := latestPostgresMigration()
+	if err != nil {
+		return err
+	}
+
+	var version int
+	if err := s.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return err
+	}
+	if version < latest {
+		return fmt.Errorf("schema is at version %d, expected %d", version, latest)
+	}
+
+	return nil
+}
+
+// private
+
+func latestPostgresMigration() (int, error) {
+	files, err := fs.Glob(postgresMigrations, "migrations/postgres/*.sql")
+	if err != nil {
+		return 0, err
+	}
+
+	latest := 0
+	for _, file := range files {
+		name := file[strings.LastIndex(file, "/")+1:]
+		version, err := strconv.Atoi(strings.SplitN(name, "_", 2)[0])
+		if err != nil {
+			return 0, err
+		}
+		latest = max(latest, version)
+	}
+	return latest, nil
+}
+
+// purgeRows deletes the rows of table matching where, a dry run counts them instead
+func (s *PostgresDataService) purgeRows(ctx context.Context, table string, where string, dryRun bool, args ...any) (int, error) {
+	if dryRun {
+		var count int
+		if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table+" WHERE "+where, args...).Scan(&count); err != nil {
+			return 0, requestError(ctx, "Failed to count rows to purge from "+table, err)
+		}
+		return count, nil
+	}
+
+	result, err := s.db.ExecContext(ctx, "DELETE FROM "+table+" WHERE "+where, args...)
+	if err != nil {
+		return 0, requestError(ctx, "Failed to purge rows from "+table, err)
+	}
+
+	purged, err := result.RowsAffected()
+	return int(purged), err
+}
+
+const apiKeyColumns string = "id, name, hash, scopes, created_at, revoked_at"
+
+func (s *PostgresDataService) queryApiKeys(ctx context.Context, query string, args ...any) ([]model.ApiKey, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []model.ApiKey{}
+	for rows.Next() {
+		var key model.ApiKey
+		var scopes string
+		if err := rows.Scan(&key.Id, &key.Name, &key.Hash, &scopes, &key.CreatedAt, &key.RevokedAt); err != nil {
+			return nil, err
+		}
+		key.Scopes = strings.Fields(scopes)
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// migrate applies every embedded migration newer than the recorded schema version, each in its own transaction.
+func (s *PostgresDataService) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return err
+	}
+
+	var current int
+	if err := s.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return err
+	}
+
+	files, err := fs.Glob(postgresMigrations, "migrations/postgres/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		name := file[strings.LastIndex(file, "/")+1:]
+		version, err := strconv.Atoi(strings.SplitN(name, "_", 2)[0])
+		if err != nil {
+			return err
+		}
+		if version <= current {
+			continue
+		}
+
+		script, err := postgresMigrations.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		zap.L().Info("Applying postgres migration", zap.String("migration", name))
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(string(script)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version) VALUES ($1)", version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *PostgresDataService) latestTimestamp(ctx context.Context, table string) (*time.Time, error) {
+	var t time.Time
+	err := s.db.QueryRowContext(ctx, "SELECT timestamp FROM "+table+" ORDER BY timestamp DESC LIMIT 1").Scan(&t)
+	if err == sql.ErrNoRows {
+		// no data
+		return nil, nil
+	}
+	if err != nil {
+		return nil, requestError(ctx, "Failed to get latest date from "+table, err)
+	}
+
+	return &t, nil
+}
+
+func (s *PostgresDataService) queryMetrics(ctx context.Context, query string, args ...any) ([]model.Metric, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metrics := []model.Metric{}
+	for rows.Next() {
+		var metric model.Metric
+		var timestamp time.Time
+		var consumption model.PowerProductionBreakdown
+
+		targets := []any{
+			&timestamp,
+			&metric.HistoricalSeed,
+			&metric.TotalProduction,
+			&metric.TotalConsumption,
+			&metric.NetBalance,
+			&metric.WeatherData.Temperature,
+			&metric.WeatherData.DirectRadiation,
+			&metric.WeatherData.CloudCoverPercent,
+			&metric.WeatherData.WindSpeedKmPHr,
+		}
+		targets = append(targets, breakdownTargets(&metric.PowerProductionData)...)
+		targets = append(targets, breakdownTargets(&consumption)...)
+		targets = append(targets,
+			&metric.CorrelationData.SolarIrradianceVsSolarProductionCorrelation,
+			&metric.CorrelationData.TemperatureVsConsumptionCorrelation,
+		)
+
+		if err := rows.Scan(targets...); err != nil {
+			return nil, err
+		}
+
+		metric.Type = utils.StringPointer(model.AGGREGATED_TYPE)
+		metric.Timestamp = &timestamp
+		metric.PowerConsumptionData = model.PowerConsumptionBreakdown(consumption)
+		metrics = append(metrics, metric)
+	}
+
+	return metrics, rows.Err()
+}
+
+// aggregate stores the metrics for energy readings already inserted in tx, see aggregateMetric
+func (s *PostgresDataService) aggregate(ctx context.Context, tx *sql.Tx, readings []model.LatestEnergeyResponse) error {
+	from, to, ok := aggregateRange(readings)
+	if !ok {
+		return nil
+	}
+
+	energy, err := queryEnergy(ctx, tx, "SELECT "+energyColumns+" FROM energy WHERE timestamp >= $1 AND timestamp <= $2 ORDER BY timestamp", from, to)
+	if err != nil {
+		return err
+	}
+	// the weather reaches back to the last reading before the range so the earliest energy reading has a pair
+	weather, err := queryWeather(ctx, tx,
+		"SELECT "+weatherColumns+" FROM weather WHERE timestamp <= $2 AND timestamp >= COALESCE((SELECT MAX(timestamp) FROM weather WHERE timestamp <= $1), $1) ORDER BY timestamp",
+		from,
+		to,
+	)
+	if err != nil {
+		return err
+	}
+
+	for i := range readings {
+		metric := aggregateMetric(&readings[i], energy, weather)
+		if metric == nil {
+			telemetry.Logger(ctx).Debug("No weather to aggregate the energy reading with", zap.Timep("timestamp", readings[i].Timestamp))
+			continue
+		}
+		if err := insertMetric(ctx, tx, metric); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func insertEnergy(ctx context.Context, tx *sql.Tx, energy *model.LatestEnergeyResponse) error {
+	energy.Type = utils.StringPointer(model.ENERGY_TYPE)
+	if energy.Timestamp == nil {
+		energy.Timestamp = &energy.SourceTime
+	}
+
+	args := []any{energy.Timestamp, energy.Zone, energy.SourceTime, energy.HistoricalSeed}
+	args = append(args, breakdownArgs(energy.PowerProductionBreakdown)...)
+	args = append(args, breakdownArgs(model.PowerProductionBreakdown(energy.PowerConsumptionBreakdown))...)
+	args = append(args, energy.PowerProductionTotal, energy.PowerConsumptionTotal)
+
+	// the (zone, timestamp) identity matches the document id, an existing data point is left as is
+	_, err := tx.ExecContext(ctx, "INSERT INTO energy ("+energyColumns+") VALUES ("+placeholders(len(args))+") ON CONFLICT DO NOTHING", args...)
+	return err
+}
+
+func insertWeather(ctx context.Context, tx *sql.Tx, weather *model.WeatherResponse) error {
+	weather.Type = utils.StringPointer(model.WEATHER_TYPE)
+	if weather.Timestamp == nil {
+		telemetry.Logger(ctx).Warn("Skipping weather data point without a timestamp")
+		return nil
+	}
+
+	args := []any{
+		weather.Timestamp,
+		weather.Location,
+		weather.HistoricalSeed,
+		weather.WeatherData.Temperature,
+		weather.WeatherData.DirectRadiation,
+		weather.WeatherData.CloudCoverPercent,
+		weather.WeatherData.WindSpeedKmPHr,
+	}
+
+	_, err := tx.ExecContext(ctx, "INSERT INTO weather ("+weatherColumns+") VALUES ("+placeholders(len(args))+") ON CONFLICT DO NOTHING", args...)
+	return err
+}
+
+func insertMetric(ctx context.Context, tx *sql.Tx, metric *model.Metric) error {
+	args := []any{
+		metric.Timestamp,
+		metric.HistoricalSeed,
+		metric.TotalProduction,
+		metric.TotalConsumption,
+		metric.NetBalance,
+		metric.WeatherData.Temperature,
+		metric.WeatherData.DirectRadiation,
+		metric.WeatherData.CloudCoverPercent,
+		metric.WeatherData.WindSpeedKmPHr,
+	}
+	args = append(args, breakdownArgs(metric.PowerProductionData)...)
+	args = append(args, breakdownArgs(model.PowerProductionBreakdown(metric.PowerConsumptionData))...)
+	args = append(args,
+		metric.CorrelationData.SolarIrradianceVsSolarProductionCorrelation,
+		metric.CorrelationData.TemperatureVsConsumptionCorrelation,
+	)
+
+	// the first metric for a timestamp is kept like the data processor's document id
+	_, err := tx.ExecContext(ctx, "INSERT INTO metrics ("+metricColumns+") VALUES ("+placeholders(len(args))+") ON CONFLICT DO NOTHING", args...)
+	return err
+}
+
+func queryEnergy(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]model.LatestEnergeyResponse, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	energy := []model.LatestEnergeyResponse{}
+	for rows.Next() {
+		var x model.LatestEnergeyResponse
+		var timestamp time.Time
+		var consumption model.PowerProductionBreakdown
+
+		targets := []any{&timestamp, &x.Zone, &x.SourceTime, &x.HistoricalSeed}
+		targets = append(targets, breakdownTargets(&x.PowerProductionBreakdown)...)
+		targets = append(targets, breakdownTargets(&consumption)...)
+		targets = append(targets, &x.PowerProductionTotal, &x.PowerConsumptionTotal)
+
+		if err := rows.Scan(targets...); err != nil {
+			return nil, err
+		}
+
+		x.Type = utils.StringPointer(model.ENERGY_TYPE)
+		x.Timestamp = &timestamp
+		x.PowerConsumptionBreakdown = model.PowerConsumptionBreakdown(consumption)
+		energy = append(energy, x)
+	}
+
+	return energy, rows.Err()
+}
+
+func queryWeather(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]model.WeatherResponse, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	weather := []model.WeatherResponse{}
+	for rows.Next() {
+		var x model.WeatherResponse
+		var timestamp time.Time
+
+		if err := rows.Scan(
+			&timestamp,
+			&x.Location,
+			&x.HistoricalSeed,
+			&x.WeatherData.Temperature,
+			&x.WeatherData.DirectRadiation,
+			&x.WeatherData.CloudCoverPercent,
+			&x.WeatherData.WindSpeedKmPHr,
+		); err != nil {
+			return nil, err
+		}
+
+		x.Type = utils.StringPointer(model.WEATHER_TYPE)
+		x.Timestamp = &timestamp
+		weather = append(weather, x)
+	}
+
+	return weather, rows.Err()
+}
+
+// NOTE: The production and consumption breakdowns share a layout so consumption is converted to use these helpers
+
+func breakdownArgs(b model.PowerProductionBreakdown) []any {
+	return []any{b.Nuclear, b.Geothermal, b.Biomass, b.Coal, b.Wind, b.Solar, b.Hydro, b.Gas, b.Oil, b.Unknown, b.HydroDischarge, b.BatteryDischarge}
+}
+
+func breakdownTargets(b *model.PowerProductionBreakdown) []any {
+	return []any{&b.Nuclear, &b.Geothermal, &b.Biomass, &b.Coal, &b.Wind, &b.Solar, &b.Hydro, &b.Gas, &b.Oil, &b.Unknown, &b.HydroDischarge, &b.BatteryDischarge}
+}
+
+func prefixedColumns(prefix string) []string {
+	columns := make([]string, len(breakdownColumnNames))
+	for i, name := range breakdownColumnNames {
+		columns[i] = prefix + name
+	}
+	return columns
+}
+
+func columnList(groups ...[]string) string {
+	columns := []string{}
+	for _, group := range groups {
+		columns = append(columns, group...)
+	}
+	return strings.Join(columns, ", ")
+}
+
+func placeholders(count int) string {
+	var builder strings.Builder
+	for i := 1; i <= count; i++ {
+		if i > 1 {
+			builder.WriteString(", ")
+		}
+		builder.WriteString("$")
+		builder.WriteString(strconv.Itoa(i))
+	}
+	return builder.String()
+}
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/telemetry"
+
+	"go.uber.org/zap"
+)
+
+// RetentionPolicy is how long each kind of document is kept, a missing entry keeps them forever.
+// Documents is keyed by raw document type and Rollups by resolution.
+type RetentionPolicy struct {
+	Documents map[string]time.Duration
+	Rollups   map[string]time.Duration
+}
+
+// ICompactor reclaims the space left behind by purged documents
+type ICompactor interface {
+	Compact(ctx context.Context) error
+}
+
+type PurgeResult struct {
+	Target string
+	Cutoff time.Time
+	Count  int
+}
+
+type RetentionReport struct {
+	DryRun         bool
+	RollupsWritten map[string]int
+	Purged         []PurgeResult
+	Compacted      bool
+}
+
+// RetentionService applies a RetentionPolicy. Rollups are always backfilled before any aggregated metrics are purged
+// so downsampled history outlives the raw data, compaction runs last once something has been purged.
+type RetentionService struct {
+	DataService   IDataService
+	RollupService IRollupService
+	Compactor     ICompactor
+	Policy        RetentionPolicy
+}
+
+// retainedTypes are the raw document types in the order they are purged
+var retainedTypes = []string{
+	model.ENERGY_TYPE,
+	model.WEATHER_TYPE,
+	model.AGGREGATED_TYPE,
+}
+
+// RetentionPolicyFromEnv reads RETENTION_<TYPE> for each raw document type, for example RETENTION_ENERGY_DATA=30d,
+// and RETENTION_ROLLUP_<RESOLUTION> for each rollup resolution, for example RETENTION_ROLLUP_1H=730d.
+func RetentionPolicyFromEnv() (RetentionPolicy, error) {
+	policy := RetentionPolicy{
+		Documents: map[string]time.Duration{},
+		Rollups:   map[string]time.Duration{},
+	}
+
+	for _, docType := range retainedTypes {
+		keep, err := retentionFromEnv("RETENTION_" + docType)
+		if err != nil {
+			return policy, err
+		}
+		if keep > 0 {
+			policy.Documents[docType] = keep
+		}
+	}
+
+	for resolution := range RollupResolutions {
+		keep, err := retentionFromEnv("RETENTION_ROLLUP_" + strings.ToUpper(resolution))
+		if err != nil {
+			return policy, err
+		}
+		if keep > 0 {
+			policy.Rollups[resolution] = keep
+		}
+	}
+
+	return policy, nil
+}
+
+// ParseRetention accepts a whole number of days such as 30d or any Go duration such as 12h
+func ParseRetention(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid retention: %s", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	keep, err := time.ParseDuration(value)
+	if err != nil || keep < 0 {
+		return 0, fmt.Errorf("invalid retention: %s", value)
+	}
+	return keep, nil
+}
+
+func (s *RetentionService) Run(ctx context.Context, dryRun bool) (*RetentionReport, error) {
+	now := time.Now()
+	report := RetentionReport{
+		DryRun:         dryRun,
+		RollupsWritten: map[string]int{},
+		Purged:         []PurgeResult{},
+	}
+
+	resolutions := make([]string, 0, len(RollupResolutions))
+	for resolution := range RollupResolutions {
+		resolutions = append(resolutions, resolution)
+	}
+	sort.Slice(resolutions, func(i, j int) bool {
+		return RollupResolutions[resolutions[i]] < RollupResolutions[resolutions[j]]
+	})
+
+	// rollups are built from the aggregated metrics so have to be written before those metrics go
+	if keep, ok := s.Policy.Documents[model.AGGREGATED_TYPE]; ok {
+		cutoff := retentionCutoff(now, keep)
+		for _, resolution := range resolutions {
+			if rollupKeep, ok := s.Policy.Rollups[resolution]; ok && rollupKeep <= keep {
+				// these rollups would be purged along with the metrics they summarise
+				continue
+			}
+
+			written, err := s.RollupService.BackfillRollups(ctx, resolution, cutoff, dryRun)
+			if err != nil {
+				telemetry.Logger(ctx).Error("Failed to backfill rollups, not purging", zap.String("resolution", resolution), zap.Error(err))
+				return &report, err
+			}
+			report.RollupsWritten[resolution] = written
+		}
+	}
+
+	purged := 0
+	for _, docType := range retainedTypes {
+		keep, ok := s.Policy.Documents[docType]
+		if !ok {
+			continue
+		}
+
+		cutoff := retentionCutoff(now, keep)
+		count, err := s.DataService.PurgeBefore(ctx, docType, cutoff, dryRun)
+		if err != nil {
+			telemetry.Logger(ctx).Error("Failed to purge documents", zap.String("type", docType), zap.Error(err))
+			return &report, err
+		}
+		report.Purged = append(report.Purged, PurgeResult{Target: docType, Cutoff: cutoff, Count: count})
+		purged += count
+	}
+
+	for _, resolution := range resolutions {
+		keep, ok := s.Policy.Rollups[resolution]
+		if !ok {
+			continue
+		}
+
+		cutoff := retentionCutoff(now, keep)
+		count, err := s.DataService.PurgeRollupsBefore(ctx, resolution, cutoff, dryRun)
+		if err != nil {
+			telemetry.Logger(ctx).Error("Failed to purge rollups", zap.String("resolution", resolution), zap.Error(err))
+			return &report, err
+		}
+		report.Purged = append(report.Purged, PurgeResult{Target: model.ROLLUP_TYPE + ":" + resolution, Cutoff: cutoff, Count: count})
+		purged += count
+	}
+
+	if !dryRun && purged > 0 && s.Compactor != nil {
+		if err := s.Compactor.Compact(ctx); err != nil {
+			return &report, err
+		}
+		report.Compacted = true
+	}
+
+	return &report, nil
+}
+
+// private
+
+// retentionCutoff lines up with the widest rollup bucket so every rollup covering purged metrics is complete
+func retentionCutoff(now time.Time, keep time.Duration) time.Time {
+	return now.Add(-keep).UTC().Truncate(24 * time.Hour)
+}
+
+func retentionFromEnv(name string) (time.Duration, error) {
+	value := os.Getenv(name)
+	if len(value) == 0 {
+		return 0, nil
+	}
+
+	keep, err := ParseRetention(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return keep, nil
+}
@@ -0,0 +1,230 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+	"zendo/lib_zendo/model"
+)
+
+func TestRetentionCutoffIsMidnightUtc(t *testing.T) {
+	// 16:30 UTC on the 10th, which is already the 11th in the offset
+	now := time.Date(2025, 3, 11, 5, 30, 0, 0, time.FixedZone("UTC+13", 13*60*60))
+
+	cutoff := retentionCutoff(now, 30*24*time.Hour)
+	if expected := time.Date(2025, 2, 8, 0, 0, 0, 0, time.UTC); !cutoff.Equal(expected) || cutoff.Location() != time.UTC {
+		t.Fatalf("expected %v, got %v", expected, cutoff)
+	}
+
+	cutoff = retentionCutoff(now, 12*time.Hour)
+	if expected := time.Date(2025, 3, 10, 0, 0, 0, 0, time.UTC); !cutoff.Equal(expected) {
+		t.Fatalf("expected a retention under a day to round down to %v, got %v", expected, cutoff)
+	}
+}
+
+func TestRetentionPurgesBeforeTheCutoff(t *testing.T) {
+	s, storage, _ := retentionForTest(RetentionPolicy{
+		Documents: map[string]time.Duration{model.ENERGY_TYPE: 30 * 24 * time.Hour},
+	})
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	for _, days := range []int{40, 35, 10} {
+		at := now.Add(-time.Duration(days) * 24 * time.Hour)
+		if err := storage.PostLatestData(ctx, energyForTest(at, 100), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before := retentionCutoff(time.Now(), 30*24*time.Hour)
+	report, err := s.Run(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := retentionCutoff(time.Now(), 30*24*time.Hour)
+
+	if len(report.Purged) != 1 {
+		t.Fatalf("expected only energy to be purged, got %+v", report.Purged)
+	}
+	purged := report.Purged[0]
+	if purged.Target != model.ENERGY_TYPE || purged.Count != 2 {
+		t.Fatalf("expected 2 energy documents purged, got %+v", purged)
+	}
+	// the run may have crossed midnight
+	if !purged.Cutoff.Equal(before) && !purged.Cutoff.Equal(after) {
+		t.Fatalf("expected a cutoff of %v, got %v", before, purged.Cutoff)
+	}
+
+	latest, err := storage.GetLatestEnergyDate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == nil || latest.Before(purged.Cutoff) {
+		t.Fatalf("expected the reading after the cutoff to be kept, latest is %v", latest)
+	}
+	if !report.Compacted {
+		t.Fatal("expected compaction after purging")
+	}
+}
+
+func TestRetentionSkipsRollupsPurgedWithTheMetrics(t *testing.T) {
+	s, _, calls := retentionForTest(RetentionPolicy{
+		Documents: map[string]time.Duration{model.AGGREGATED_TYPE: 30 * 24 * time.Hour},
+		Rollups: map[string]time.Duration{
+			"15m": 7 * 24 * time.Hour,
+			"1h":  30 * 24 * time.Hour,
+			"1d":  365 * 24 * time.Hour,
+		},
+	})
+
+	report, err := s.Run(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 15m and 1h rollups are kept no longer than the metrics so aren't worth writing
+	backfilled := []string{}
+	for _, call := range *calls {
+		if resolution, ok := strings.CutPrefix(call, "backfill "); ok {
+			backfilled = append(backfilled, resolution)
+		}
+	}
+	if len(backfilled) != 1 || backfilled[0] != "1d" {
+		t.Fatalf("expected only the 1d rollups to be backfilled, got %v", backfilled)
+	}
+	if _, ok := report.RollupsWritten["1h"]; ok || len(report.RollupsWritten) != 1 {
+		t.Fatalf("expected only the 1d rollups in the report, got %v", report.RollupsWritten)
+	}
+}
+
+func TestRetentionBackfillsBeforePurgingMetrics(t *testing.T) {
+	s, storage, calls := retentionForTest(RetentionPolicy{
+		Documents: map[string]time.Duration{model.AGGREGATED_TYPE: 30 * 24 * time.Hour},
+	})
+	ctx := context.Background()
+	start := time.Now().UTC().Truncate(24 * time.Hour).Add(-40 * 24 * time.Hour)
+	for i := range 3 {
+		storage.PostMetric(metricForTest(start.Add(time.Duration(i)*time.Hour), i))
+	}
+
+	report, err := s.Run(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	purge := -1
+	for i, call := range *calls {
+		if call == "purge "+model.AGGREGATED_TYPE {
+			purge = i
+		}
+	}
+	if purge < len(RollupResolutions) {
+		t.Fatalf("expected every resolution to be backfilled before the metrics were purged, got %v", *calls)
+	}
+	if report.Purged[0].Count != 3 {
+		t.Fatalf("expected 3 metrics purged, got %+v", report.Purged)
+	}
+
+	// the purged metrics live on in their rollups
+	for resolution, size := range RollupResolutions {
+		rollups, err := storage.GetRollups(ctx, resolution, start, start.Add(24*time.Hour-time.Nanosecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for _, rollup := range *rollups {
+			count += rollup.Count
+		}
+		if count != 3 {
+			t.Fatalf("expected the %s rollups (%v) to count the 3 purged metrics, got %d", resolution, size, count)
+		}
+	}
+}
+
+func TestRetentionDryRunOnlyCounts(t *testing.T) {
+	s, storage, _ := retentionForTest(RetentionPolicy{
+		Documents: map[string]time.Duration{model.AGGREGATED_TYPE: 30 * 24 * time.Hour},
+		Rollups:   map[string]time.Duration{"1d": 365 * 24 * time.Hour},
+	})
+	ctx := context.Background()
+	start := time.Now().UTC().Truncate(24 * time.Hour).Add(-40 * 24 * time.Hour)
+	for i := range 3 {
+		storage.PostMetric(metricForTest(start.Add(time.Duration(i)*time.Hour), i))
+	}
+
+	report, err := s.Run(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !report.DryRun || report.Compacted {
+		t.Fatalf("expected a dry run without compaction, got %+v", report)
+	}
+	if report.RollupsWritten["1d"] == 0 {
+		t.Fatalf("expected the 1d rollups that would be written to be counted, got %v", report.RollupsWritten)
+	}
+	counted := map[string]int{}
+	for _, purged := range report.Purged {
+		counted[purged.Target] = purged.Count
+	}
+	if counted[model.AGGREGATED_TYPE] != 3 {
+		t.Fatalf("expected 3 metrics counted, got %+v", report.Purged)
+	}
+
+	page, err := storage.GetMetricsInRange(ctx, MetricsRangeQuery{From: start, To: start.Add(24 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Metrics) != 3 {
+		t.Fatalf("expected the dry run to keep every metric, got %d", len(page.Metrics))
+	}
+	rollups, err := storage.GetRollups(ctx, "1d", time.Unix(0, 0), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*rollups) != 0 {
+		t.Fatalf("expected the dry run not to write rollups, got %d", len(*rollups))
+	}
+}
+
+// private
+
+// retentionForTest runs retention over memory, recording the backfills and purges in the order they are made
+func retentionForTest(policy RetentionPolicy) (*RetentionService, *MemoryDataService, *[]string) {
+	storage := NewMemoryDataService()
+	calls := &[]string{}
+	recorded := &recordingDataService{MemoryDataService: storage, calls: calls}
+
+	return &RetentionService{
+		DataService:   recorded,
+		RollupService: &recordingRollupService{RollupService: RollupService{DataService: storage}, calls: calls},
+		Compactor:     recorded,
+		Policy:        policy,
+	}, storage, calls
+}
+
+type recordingDataService struct {
+	*MemoryDataService
+	calls *[]string
+}
+
+func (s *recordingDataService) PurgeBefore(ctx context.Context, docType string, before time.Time, dryRun bool) (int, error) {
+	*s.calls = append(*s.calls, "purge "+docType)
+	return s.MemoryDataService.PurgeBefore(ctx, docType, before, dryRun)
+}
+
+func (s *recordingDataService) Compact(ctx context.Context) error {
+	*s.calls = append(*s.calls, "compact")
+	return nil
+}
+
+type recordingRollupService struct {
+	RollupService
+	calls *[]string
+}
+
+func (s *recordingRollupService) BackfillRollups(ctx context.Context, resolution string, before time.Time, dryRun bool) (int, error) {
+	*s.calls = append(*s.calls, "backfill "+resolution)
+	return s.RollupService.BackfillRollups(ctx, resolution, before, dryRun)
+}
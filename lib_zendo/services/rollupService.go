@@ -0,0 +1,275 @@
+package services
+
+import (
+	"context"
+	"sort"
+	"time"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/telemetry"
+	"zendo/lib_zendo/utils"
+
+	"go.uber.org/zap"
+)
+
+var RollupResolutions = map[string]time.Duration{
+	"15m": 15 * time.Minute,
+	"1h":  time.Hour,
+	"1d":  24 * time.Hour,
+}
+
+type IRollupService interface {
+	GetRollups(ctx context.Context, resolution string, query MetricsRangeQuery) (*[]model.MetricRollup, error)
+	BackfillRollups(ctx context.Context, resolution string, before time.Time, dryRun bool) (int, error)
+}
+
+// RollupService serves downsampled metrics from precomputed rollups.
+// Buckets missing from storage are computed from the raw metrics and stored on first use once they have been closed
+// for rollupGracePeriod, newer buckets are computed on the fly each time so late metrics are still counted.
+// Buckets without metrics are stored as empty markers so gaps in the data aren't recomputed, and left out of responses.
+type RollupService struct {
+	DataService IDataService
+}
+
+func (s *RollupService) GetRollups(ctx context.Context, resolution string, query MetricsRangeQuery) (*[]model.MetricRollup, error) {
+	size := RollupResolutions[resolution]
+	to := query.To
+
+	buckets, computed, err := s.loadRollups(ctx, resolution, query.From.UTC().Truncate(size), to)
+	if err != nil {
+		return nil, err
+	}
+
+	if closed := closedRollups(computed, size); len(closed) > 0 {
+		telemetry.Logger(ctx).Info("Storing new rollups", zap.String("resolution", resolution), zap.Int("count", len(closed)))
+		if err := s.DataService.PostRollups(ctx, &closed); err != nil {
+			// the rollups can be recomputed next time so still answer the request
+			telemetry.Logger(ctx).Warn("Failed to store rollups", zap.Error(err))
+		}
+	}
+
+	rollups := make([]model.MetricRollup, 0, len(buckets))
+	for _, rollup := range buckets {
+		if rollup.Timestamp.After(to) || rollup.Count == 0 {
+			continue
+		}
+		rollups = append(rollups, rollup)
+	}
+
+	sort.Slice(rollups, func(i, j int) bool {
+		if query.Descending {
+			return rollups[i].Timestamp.After(*rollups[j].Timestamp)
+		}
+		return rollups[i].Timestamp.Before(*rollups[j].Timestamp)
+	})
+
+	return &rollups, nil
+}
+
+// BackfillRollups stores every missing rollup for buckets that end before the cutoff, returning how many were written
+// including the empty markers.
+// It works through the metrics a window at a time so a long history is never loaded at once.
+// With dryRun nothing is stored and the count is of the rollups that would be written.
+func (s *RollupService) BackfillRollups(ctx context.Context, resolution string, before time.Time, dryRun bool) (int, error) {
+	size := RollupResolutions[resolution]
+	before = before.UTC().Truncate(size)
+
+	oldest, err := s.DataService.GetMetricsInRange(ctx, MetricsRangeQuery{
+		From:  time.Unix(0, 0),
+		To:    before,
+		Limit: 1,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(oldest.Metrics) == 0 {
+		// no data
+		return 0, nil
+	}
+
+	written := 0
+	for from := oldest.Metrics[0].Timestamp.UTC().Truncate(size); from.Before(before); from = from.Add(rollupBackfillWindow) {
+		to := from.Add(rollupBackfillWindow)
+		if to.After(before) {
+			to = before
+		}
+
+		// stop just short of the bucket starting at to
+		_, computed, err := s.loadRollups(ctx, resolution, from, to.Add(-time.Nanosecond))
+		if err != nil {
+			return written, err
+		}
+
+		closed := closedRollups(computed, size)
+		if len(closed) == 0 {
+			continue
+		}
+		if !dryRun {
+			if err := s.DataService.PostRollups(ctx, &closed); err != nil {
+				return written, err
+			}
+		}
+		written += len(closed)
+	}
+
+	return written, nil
+}
+
+// Downsample groups metrics into buckets of the given resolution, buckets without any metrics are left out
+func Downsample(metrics []model.Metric, resolution string) []model.MetricRollup {
+	size := RollupResolutions[resolution]
+
+	buckets := map[time.Time]*model.MetricRollup{}
+	for i := range metrics {
+		metric := &metrics[i]
+		if metric.Timestamp == nil {
+			continue
+		}
+
+		start := metric.Timestamp.UTC().Truncate(size)
+		rollup, ok := buckets[start]
+		if !ok {
+			rollup = &model.MetricRollup{
+				BaseDocument: model.BaseDocument{
+					Type:      utils.StringPointer(model.ROLLUP_TYPE),
+					Timestamp: utils.TimePointer(start),
+				},
+				Resolution:  resolution,
+				Production:  map[string]model.Stats{},
+				Consumption: map[string]model.Stats{},
+				Weather:     map[string]model.Stats{},
+			}
+			buckets[start] = rollup
+		}
+
+		rollup.Count++
+		rollup.TotalProduction.Add(float64(metric.TotalProduction))
+		rollup.TotalConsumption.Add(float64(metric.TotalConsumption))
+		rollup.NetBalance.Add(float64(metric.NetBalance))
+		addSources(rollup.Production, metric.PowerProductionData.Sources())
+		addSources(rollup.Consumption, metric.PowerConsumptionData.Sources())
+		for field, value := range metric.WeatherData.Fields() {
+			stats := rollup.Weather[field]
+			stats.Add(value)
+			rollup.Weather[field] = stats
+		}
+	}
+
+	rollups := make([]model.MetricRollup, 0, len(buckets))
+	for _, rollup := range buckets {
+		rollups = append(rollups, *rollup)
+	}
+	sort.Slice(rollups, func(i, j int) bool {
+		return rollups[i].Timestamp.Before(*rollups[j].Timestamp)
+	})
+
+	return rollups
+}
+
+// private
+
+// rollupGracePeriod is how long a bucket stays open after it ends. Metrics arrive about an hour behind the readings
+// they are aggregated from, a bucket stored any sooner would miss them.
+const rollupGracePeriod time.Duration = 2 * time.Hour
+
+// rollupBackfillWindow is a whole number of every resolution so the windows stay aligned to the buckets
+const rollupBackfillWindow time.Duration = 7 * 24 * time.Hour
+
+// loadRollups returns every bucket between from and to keyed by start, along with the ones computed because they were not stored
+func (s *RollupService) loadRollups(ctx context.Context, resolution string, from time.Time, to time.Time) (map[time.Time]model.MetricRollup, []model.MetricRollup, error) {
+	size := RollupResolutions[resolution]
+
+	stored, err := s.DataService.GetRollups(ctx, resolution, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buckets := map[time.Time]model.MetricRollup{}
+	for _, rollup := range *stored {
+		buckets[rollup.Timestamp.UTC()] = rollup
+	}
+
+	// compute each run of missing buckets on its own, so one missing bucket doesn't recompute those stored after it
+	created := []model.MetricRollup{}
+	for runFrom := from; !runFrom.After(to); {
+		if _, ok := buckets[runFrom]; ok {
+			runFrom = runFrom.Add(size)
+			continue
+		}
+
+		runTo := runFrom
+		for !runTo.After(to) {
+			if _, ok := buckets[runTo]; ok {
+				break
+			}
+			runTo = runTo.Add(size)
+		}
+
+		computed, err := s.computeRollups(ctx, resolution, runFrom, runTo)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, rollup := range computed {
+			buckets[*rollup.Timestamp] = rollup
+		}
+
+		for start := runFrom; start.Before(runTo); start = start.Add(size) {
+			rollup, ok := buckets[start]
+			if !ok {
+				rollup = emptyRollup(resolution, start)
+				buckets[start] = rollup
+			}
+			created = append(created, rollup)
+		}
+		runFrom = runTo
+	}
+
+	return buckets, created, nil
+}
+
+// closedRollups filters out the buckets still open to late metrics, only those past the grace period are worth storing
+func closedRollups(rollups []model.MetricRollup, size time.Duration) []model.MetricRollup {
+	frozen := time.Now().Add(-rollupGracePeriod)
+	closed := []model.MetricRollup{}
+	for _, rollup := range rollups {
+		if !rollup.Timestamp.Add(size).After(frozen) {
+			closed = append(closed, rollup)
+		}
+	}
+	return closed
+}
+
+// emptyRollup marks a bucket without metrics as computed
+func emptyRollup(resolution string, start time.Time) model.MetricRollup {
+	return model.MetricRollup{
+		BaseDocument: model.BaseDocument{
+			Type:      utils.StringPointer(model.ROLLUP_TYPE),
+			Timestamp: utils.TimePointer(start),
+		},
+		Resolution: resolution,
+	}
+}
+
+func (s *RollupService) computeRollups(ctx context.Context, resolution string, from time.Time, to time.Time) ([]model.MetricRollup, error) {
+	// the range is inclusive so stop just short of the next bucket
+	page, err := s.DataService.GetMetricsInRange(ctx, MetricsRangeQuery{
+		From: from,
+		To:   to.Add(-time.Nanosecond),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return Downsample(page.Metrics, resolution), nil
+}
+
+func addSources(stats map[string]model.Stats, sources map[string]*uint32) {
+	for source, value := range sources {
+		if value == nil {
+			continue
+		}
+
+		s := stats[source]
+		s.Add(float64(*value))
+		stats[source] = s
+	}
+}
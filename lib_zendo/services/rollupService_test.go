@@ -0,0 +1,133 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRollupsStoreEmptyBuckets(t *testing.T) {
+	storage := &countingDataService{MemoryDataService: NewMemoryDataService()}
+	s := RollupService{DataService: storage}
+	ctx := context.Background()
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// hours 1 and 3 have no metrics
+	storage.PostMetric(metricForTest(start, 10))
+	storage.PostMetric(metricForTest(start.Add(2*time.Hour+time.Minute), 20))
+	query := MetricsRangeQuery{From: start, To: start.Add(4*time.Hour - time.Nanosecond)}
+
+	rollups, err := s.GetRollups(ctx, "1h", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*rollups) != 2 {
+		t.Fatalf("expected the 2 hours with metrics, got %d rollups", len(*rollups))
+	}
+	for _, rollup := range *rollups {
+		if rollup.Count != 1 {
+			t.Fatalf("expected 1 metric in each rollup, got %d", rollup.Count)
+		}
+	}
+
+	stored, err := storage.MemoryDataService.GetRollups(ctx, "1h", start, query.To)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*stored) != 4 {
+		t.Fatalf("expected every closed hour stored including the empty ones, got %d", len(*stored))
+	}
+
+	// every bucket is stored now so the metrics aren't read again
+	storage.queries = nil
+	rollups, err = s.GetRollups(ctx, "1h", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(storage.queries) != 0 {
+		t.Fatalf("expected stored buckets to be reused, got %d metric queries", len(storage.queries))
+	}
+	if len(*rollups) != 2 {
+		t.Fatalf("expected the same 2 rollups from storage, got %d", len(*rollups))
+	}
+}
+
+func TestRollupsOnlyRecomputeOpenBuckets(t *testing.T) {
+	storage := &countingDataService{MemoryDataService: NewMemoryDataService()}
+	s := RollupService{DataService: storage}
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	// a week without metrics then one in the current hour
+	storage.PostMetric(metricForTest(now.Add(-time.Minute), 10))
+	query := MetricsRangeQuery{From: now.Add(-7 * 24 * time.Hour), To: now}
+
+	for range 2 {
+		storage.queries = nil
+		if _, err := s.GetRollups(ctx, "1h", query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the second request only computes the hours inside the grace period
+	if len(storage.queries) != 1 {
+		t.Fatalf("expected a single metric query, got %d", len(storage.queries))
+	}
+	recomputed := storage.queries[0]
+	if oldest := now.Truncate(time.Hour).Add(-rollupGracePeriod - time.Hour); recomputed.From.Before(oldest) {
+		t.Fatalf("expected the recompute to start after %v, it started at %v", oldest, recomputed.From)
+	}
+	if recomputed.To.After(now.Truncate(time.Hour).Add(time.Hour)) {
+		t.Fatalf("expected the recompute to end with the current hour, it ended at %v", recomputed.To)
+	}
+}
+
+func TestRollupsCountLateMetrics(t *testing.T) {
+	storage := NewMemoryDataService()
+	s := RollupService{DataService: storage}
+	ctx := context.Background()
+
+	// the hour before last has ended but is still within the grace period
+	hour := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour)
+	storage.PostMetric(metricForTest(hour, 10))
+	query := MetricsRangeQuery{From: hour, To: hour.Add(time.Hour - time.Nanosecond)}
+
+	rollups, err := s.GetRollups(ctx, "1h", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*rollups) != 1 || (*rollups)[0].Count != 1 {
+		t.Fatalf("expected 1 rollup of 1 metric, got %+v", *rollups)
+	}
+
+	// a metric aggregated late lands in the same hour
+	storage.PostMetric(metricForTest(hour.Add(30*time.Minute), 20))
+	rollups, err = s.GetRollups(ctx, "1h", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*rollups) != 1 || (*rollups)[0].Count != 2 {
+		t.Fatalf("expected the late metric to be counted, got %+v", *rollups)
+	}
+
+	stored, err := storage.GetRollups(ctx, "1h", hour, query.To)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*stored) != 0 {
+		t.Fatalf("expected an hour within the grace period not to be stored, got %d", len(*stored))
+	}
+}
+
+// private
+
+// countingDataService records the metric queries made through it
+type countingDataService struct {
+	*MemoryDataService
+	queries []MetricsRangeQuery
+}
+
+func (s *countingDataService) GetMetricsInRange(ctx context.Context, query MetricsRangeQuery) (*MetricsPage, error) {
+	s.queries = append(s.queries, query)
+	return s.MemoryDataService.GetMetricsInRange(ctx, query)
+}
@@ -0,0 +1,675 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+	"zendo/lib_zendo/errors"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/telemetry"
+	"zendo/lib_zendo/utils"
+
+	"go.uber.org/zap"
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteDataService stores documents in an embedded SQLite file so the stack can run without CouchDB.
+// Each document type gets its own table holding the raw json document alongside an indexed timestamp.
+type SQLiteDataService struct {
+	db *sql.DB
+}
+
+// sqliteMigrations are applied in order, the applied version is tracked with PRAGMA user_version
+var sqliteMigrations = []string{
+	sqliteSchema,
+	sqliteDocumentIds,
+	sqliteRollups,
+	sqliteApiKeys,
+}
+
+const sqliteSchema string = `
+CREATE TABLE IF NOT EXISTS energy (
+	timestamp INTEGER NOT NULL,
+	historical_seed INTEGER NOT NULL DEFAULT 0,
+	doc TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS energy_by_time ON energy (timestamp);
+
+CREATE TABLE IF NOT EXISTS weather (
+	timestamp INTEGER NOT NULL,
+	historical_seed INTEGER NOT NULL DEFAULT 0,
+	doc TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS weather_by_time ON weather (timestamp);
+
+CREATE TABLE IF NOT EXISTS metrics (
+	timestamp INTEGER NOT NULL,
+	historical_seed INTEGER NOT NULL DEFAULT 0,
+	doc TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS metrics_by_time ON metrics (timestamp);
+`
+
+// sqliteDocumentIds backfills deterministic ids for existing rows, drops duplicates and makes the ids unique
+const sqliteDocumentIds string = `
+ALTER TABLE energy ADD COLUMN id TEXT;
+UPDATE energy SET id = 'ENERGY_DATA:' || COALESCE(json_extract(doc, '$.zone') || ':', '') || strftime('%Y-%m-%dT%H:%M:%SZ', timestamp / 1000000000, 'unixepoch');
+DELETE FROM energy WHERE rowid NOT IN (SELECT MIN(rowid) FROM energy GROUP BY id);
+CREATE UNIQUE INDEX IF NOT EXISTS energy_id ON energy (id);
+
+ALTER TABLE weather ADD COLUMN id TEXT;
+UPDATE weather SET id = 'WEATHER_DATA:' || COALESCE(json_extract(doc, '$.location') || ':', '') || strftime('%Y-%m-%dT%H:%M:%SZ', timestamp / 1000000000, 'unixepoch');
+DELETE FROM weather WHERE rowid NOT IN (SELECT MIN(rowid) FROM weather GROUP BY id);
+CREATE UNIQUE INDEX IF NOT EXISTS weather_id ON weather (id);
+
+ALTER TABLE metrics ADD COLUMN id TEXT;
+UPDATE metrics SET id = 'AGGREGATED_DATA:' || strftime('%Y-%m-%dT%H:%M:%SZ', timestamp / 1000000000, 'unixepoch');
+DELETE FROM metrics WHERE rowid NOT IN (SELECT MIN(rowid) FROM metrics GROUP BY id);
+CREATE UNIQUE INDEX IF NOT EXISTS metrics_id ON metrics (id);
+`
+
+const sqliteRollups string = `
+CREATE TABLE IF NOT EXISTS rollups (
+	id TEXT NOT NULL PRIMARY KEY,
+	resolution TEXT NOT NULL,
+	timestamp INTEGER NOT NULL,
+	doc TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS rollups_by_time ON rollups (resolution, timestamp);
+`
+
+const sqliteApiKeys string = `
+CREATE TABLE IF NOT EXISTS api_keys (
+	id TEXT NOT NULL PRIMARY KEY,
+	doc TEXT NOT NULL
+);
+`
+
+func NewSQLiteDataService(path string) (*SQLiteDataService, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		zap.L().Error("Failed to open sqlite database", zap.String("path", path), zap.Error(err))
+		return nil, &errors.DatabaseError{}
+	}
+
+	// sqlite only allows a single writer, avoid lock contention between pooled connections
+	db.SetMaxOpenConns(1)
+
+	if err := migrateSQLite(db); err != nil {
+		zap.L().Error("Failed to migrate sqlite schema", zap.Error(err))
+		db.Close()
+		return nil, &errors.DatabaseError{}
+	}
+
+	return &SQLiteDataService{
+		db: db,
+	}, nil
+}
+
+func (s *SQLiteDataService) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteDataService) PostLatestData(ctx context.Context, energy *model.LatestEnergeyResponse, weather *model.WeatherResponse) error {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	if energy == nil && weather == nil {
+		telemetry.Logger(ctx).Panic("Neither energy update nor weather update was set")
+		return &errors.DatabaseError{}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return requestError(ctx, "Failed to start transaction", err)
+	}
+	defer tx.Rollback()
+
+	if energy != nil {
+		telemetry.Logger(ctx).Info("Adding new energy data point", zap.Timep("timestamp", energy.Timestamp))
+		energy.Type = utils.StringPointer(model.ENERGY_TYPE)
+		if err := insertDocument(ctx, tx, "energy", energy.DocumentId(), &energy.BaseDocument, energy); err != nil {
+			return requestError(ctx, "Failed to insert latest energy data", err)
+		}
+	}
+	if weather != nil {
+		telemetry.Logger(ctx).Info("Adding new weather data point", zap.Timep("timestamp", weather.Timestamp))
+		weather.Type = utils.StringPointer(model.WEATHER_TYPE)
+		if err := insertDocument(ctx, tx, "weather", weather.DocumentId(), &weather.BaseDocument, weather); err != nil {
+			return requestError(ctx, "Failed to insert latest weather data", err)
+		}
+	}
+	if energy != nil {
+		if err := s.aggregate(ctx, tx, []model.LatestEnergeyResponse{*energy}); err != nil {
+			return requestError(ctx, "Failed to aggregate latest energy data", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return requestError(ctx, "Failed to commit latest data", err)
+	}
+
+	return nil
+}
+
+func (s *SQLiteDataService) SeedHistoricalData(ctx context.Context, energyData *[]model.LatestEnergeyResponse, weatherData *[]model.WeatherResponse) error {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	if energyData == nil || weatherData == nil {
+		telemetry.Logger(ctx).Panic("Neither energy data nor weather data was set")
+		return &errors.DatabaseError{}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return requestError(ctx, "Failed to start transaction", err)
+	}
+	defer tx.Rollback()
+
+	seeded := make([]model.LatestEnergeyResponse, 0, len(*energyData))
+	for _, x := range *energyData {
+		x.Type = utils.StringPointer(model.ENERGY_TYPE)
+		x.HistoricalSeed = true
+		if err := insertDocument(ctx, tx, "energy", x.DocumentId(), &x.BaseDocument, x); err != nil {
+			return requestError(ctx, "Failed to insert seed energy data", err)
+		}
+		seeded = append(seeded, x)
+	}
+	for _, x := range *weatherData {
+		x.Type = utils.StringPointer(model.WEATHER_TYPE)
+		x.HistoricalSeed = true
+		if err := insertDocument(ctx, tx, "weather", x.DocumentId(), &x.BaseDocument, x); err != nil {
+			return requestError(ctx, "Failed to insert seed weather data", err)
+		}
+	}
+	if err := s.aggregate(ctx, tx, seeded); err != nil {
+		return requestError(ctx, "Failed to aggregate seed energy data", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return requestError(ctx, "Failed to commit seed data", err)
+	}
+
+	return nil
+}
+
+func (s *SQLiteDataService) GetLatestWeatherDate(ctx context.Context) (*time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	return s.latestTimestamp(ctx, "weather")
+}
+
+func (s *SQLiteDataService) GetLatestEnergyDate(ctx context.Context) (*time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	return s.latestTimestamp(ctx, "energy")
+}
+
+func (s *SQLiteDataService) GetLatestMetric(ctx context.Context) (*model.Metric, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	metrics, err := s.queryMetrics(ctx, "SELECT doc FROM metrics ORDER BY timestamp DESC LIMIT 1")
+	if err != nil {
+		return nil, requestError(ctx, "Failed to get latest metric", err)
+	}
+
+	if len(metrics) == 0 {
+		// no data
+		return nil, nil
+	}
+
+	return &metrics[0], nil
+}
+
+func (s *SQLiteDataService) Get24HoursOfMetrics(ctx context.Context) (*[]model.Metric, error) {
+	page, err := s.GetMetricsInRange(ctx, Last24HoursQuery())
+	if err != nil {
+		return nil, err
+	}
+
+	return &page.Metrics, nil
+}
+
+func (s *SQLiteDataService) GetMetricsInRange(ctx context.Context, query MetricsRangeQuery) (*MetricsPage, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	order := "ASC"
+	start := ">="
+	if query.Descending {
+		order = "DESC"
+		start = "<="
+	}
+
+	// metric ids are derived from the timestamp so the cursor timestamp alone marks the position
+	startAt := query.From.UnixNano()
+	if query.Descending {
+		startAt = query.To.UnixNano()
+	}
+	if query.StartAt != nil {
+		startAt = query.StartAt.Timestamp.UnixNano()
+	}
+
+	// a negative limit means no limit in sqlite, one extra row finds the start of the next page
+	limit := -1
+	if query.Limit > 0 {
+		limit = query.Limit + 1
+	}
+
+	metrics, err := s.queryMetrics(ctx,
+		"SELECT doc FROM metrics WHERE timestamp BETWEEN ? AND ? AND timestamp "+start+" ? ORDER BY timestamp "+order+" LIMIT ?",
+		query.From.UnixNano(),
+		query.To.UnixNano(),
+		startAt,
+		limit,
+	)
+	if err != nil {
+		return nil, requestError(ctx, "Failed to get metrics in range", err)
+	}
+
+	var count int
+	if err := s.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM metrics WHERE timestamp BETWEEN ? AND ?",
+		query.From.UnixNano(),
+		query.To.UnixNano(),
+	).Scan(&count); err != nil {
+		return nil, requestError(ctx, "Failed to count metrics in range", err)
+	}
+
+	return pageOfMetrics(metrics, query.Limit, count), nil
+}
+
+func (s *SQLiteDataService) GetRollups(ctx context.Context, resolution string, from time.Time, to time.Time) (*[]model.MetricRollup, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT doc FROM rollups WHERE resolution = ? AND timestamp BETWEEN ? AND ? ORDER BY timestamp ASC",
+		resolution,
+		from.UnixNano(),
+		to.UnixNano(),
+	)
+	if err != nil {
+		return nil, requestError(ctx, "Failed to get rollups", err)
+	}
+	defer rows.Close()
+
+	rollups := []model.MetricRollup{}
+	for rows.Next() {
+		var doc []byte
+		if err := rows.Scan(&doc); err != nil {
+			return nil, requestError(ctx, "Failed to read rollup", err)
+		}
+
+		var rollup model.MetricRollup
+		if err := json.Unmarshal(doc, &rollup); err != nil {
+			return nil, requestError(ctx, "Failed to decode rollup", err)
+		}
+		rollups = append(rollups, rollup)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, requestError(ctx, "Failed to get rollups", err)
+	}
+
+	return &rollups, nil
+}
+
+func (s *SQLiteDataService) PostRollups(ctx context.Context, rollups *[]model.MetricRollup) error {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return requestError(ctx, "Failed to start transaction", err)
+	}
+	defer tx.Rollback()
+
+	for i := range *rollups {
+		rollup := &(*rollups)[i]
+		rollup.Type = utils.StringPointer(model.ROLLUP_TYPE)
+
+		docBytes, err := json.Marshal(rollup)
+		if err != nil {
+			return requestError(ctx, "Failed to encode rollup", err)
+		}
+
+		if _, err := tx.ExecContext(ctx,
+			"INSERT OR IGNORE INTO rollups (id, resolution, timestamp, doc) VALUES (?, ?, ?, ?)",
+			rollup.DocumentId(),
+			rollup.Resolution,
+			rollup.Timestamp.UnixNano(),
+			string(docBytes),
+		); err != nil {
+			return requestError(ctx, "Failed to insert rollup", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return requestError(ctx, "Failed to commit rollups", err)
+	}
+
+	return nil
+}
+
+func (s *SQLiteDataService) PurgeBefore(ctx context.Context, docType string, before time.Time, dryRun bool) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	table, ok := documentTables[docType]
+	if !ok {
+		return 0, fmt.Errorf("unknown document type: %s", docType)
+	}
+
+	return s.purgeRows(ctx, table, "timestamp < ?", dryRun, before.UnixNano())
+}
+
+func (s *SQLiteDataService) PurgeRollupsBefore(ctx context.Context, resolution string, before time.Time, dryRun bool) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	return s.purgeRows(ctx, "rollups", "resolution = ? AND timestamp < ?", dryRun, resolution, before.UnixNano())
+}
+
+// PostApiKey stores a new key, the id is the primary key so an existing key is never overwritten
+func (s *SQLiteDataService) PostApiKey(ctx context.Context, key *model.ApiKey) error {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	docBytes, err := json.Marshal(key)
+	if err != nil {
+		return requestError(ctx, "Failed to encode api key", err)
+	}
+
+	if _, err := s.db.ExecContext(ctx, "INSERT INTO api_keys (id, doc) VALUES (?, ?)", key.Id, string(docBytes)); err != nil {
+		return requestError(ctx, "Failed to insert api key", err)
+	}
+
+	return nil
+}
+
+func (s *SQLiteDataService) GetApiKey(ctx context.Context, id string) (*model.ApiKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	keys, err := s.queryApiKeys(ctx, "SELECT doc FROM api_keys WHERE id = ?", id)
+	if err != nil {
+		return nil, requestError(ctx, "Failed to get api key", err)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	return &keys[0], nil
+}
+
+func (s *SQLiteDataService) GetApiKeys(ctx context.Context) (*[]model.ApiKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	keys, err := s.queryApiKeys(ctx, "SELECT doc FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, requestError(ctx, "Failed to get api keys", err)
+	}
+
+	return &keys, nil
+}
+
+func (s *SQLiteDataService) RevokeApiKey(ctx context.Context, id string, at time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	// only the first revocation counts so the original time is kept
+	if _, err := s.db.ExecContext(ctx,
+		"UPDATE api_keys SET doc = json_set(doc, '$.revokedAt', ?) WHERE id = ? AND json_extract(doc, '$.revokedAt') IS NULL",
+		at.UTC().Format(time.RFC3339Nano),
+		id,
+	); err != nil {
+		return false, requestError(ctx, "Failed to revoke api key", err)
+	}
+
+	var found int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM api_keys WHERE id = ?", id).Scan(&found); err != nil {
+		return false, requestError(ctx, "Failed to revoke api key", err)
+	}
+
+	return found > 0, nil
+}
+
+// Compact rebuilds the database file to hand the space left by purged rows back to the file system
+func (s *SQLiteDataService) Compact(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, "VACUUM"); err != nil {
+		telemetry.Logger(ctx).Error("Failed to vacuum sqlite database", zap.Error(err))
+		return &errors.DatabaseError{}
+	}
+
+	return nil
+}
+
+func (s *SQLiteDataService) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	return s.db.PingContext(ctx)
+}
+
+// CheckSetup compares the applied migrations with this build, a newer build may have migrated the file since
+func (s *SQLiteDataService) CheckSetup(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	var version int
+	if err := s.db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version < len(sqliteMigrations) {
+		return fmt.Errorf("schema is at version %d, expected %d", version, len(sqliteMigrations))
+	}
+
+	return nil
+}
+
+// private
+
+// purgeRows deletes the rows of table matching where, a dry run counts them instead
+func (s *SQLiteDataService) purgeRows(ctx context.Context, table string, where string, dryRun bool, args ...any) (int, error) {
+	if dryRun {
+		var count int
+		if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table+" WHERE "+where, args...).Scan(&count); err != nil {
+			return 0, requestError(ctx, "Failed to count rows to purge from "+table, err)
+		}
+		return count, nil
+	}
+
+	result, err := s.db.ExecContext(ctx, "DELETE FROM "+table+" WHERE "+where, args...)
+	if err != nil {
+		return 0, requestError(ctx, "Failed to purge rows from "+table, err)
+	}
+
+	purged, err := result.RowsAffected()
+	return int(purged), err
+}
+
+func (s *SQLiteDataService) latestTimestamp(ctx context.Context, table string) (*time.Time, error) {
+	var nanos int64
+	err := s.db.QueryRowContext(ctx, "SELECT timestamp FROM "+table+" ORDER BY timestamp DESC LIMIT 1").Scan(&nanos)
+	if err == sql.ErrNoRows {
+		// no data
+		return nil, nil
+	}
+	if err != nil {
+		return nil, requestError(ctx, "Failed to get latest date from "+table, err)
+	}
+
+	t := time.Unix(0, nanos).UTC()
+	return &t, nil
+}
+
+func (s *SQLiteDataService) queryMetrics(ctx context.Context, query string, args ...any) ([]model.Metric, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metrics := []model.Metric{}
+	for rows.Next() {
+		var doc []byte
+		if err := rows.Scan(&doc); err != nil {
+			return nil, err
+		}
+
+		var metric model.Metric
+		if err := json.Unmarshal(doc, &metric); err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, metric)
+	}
+
+	return metrics, rows.Err()
+}
+
+func (s *SQLiteDataService) queryApiKeys(ctx context.Context, query string, args ...any) ([]model.ApiKey, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []model.ApiKey{}
+	for rows.Next() {
+		var doc []byte
+		if err := rows.Scan(&doc); err != nil {
+			return nil, err
+		}
+
+		var key model.ApiKey
+		if err := json.Unmarshal(doc, &key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// aggregate stores the metrics for energy readings already inserted in tx, see aggregateMetric
+func (s *SQLiteDataService) aggregate(ctx context.Context, tx *sql.Tx, readings []model.LatestEnergeyResponse) error {
+	from, to, ok := aggregateRange(readings)
+	if !ok {
+		return nil
+	}
+
+	energy, err := queryDocuments[model.LatestEnergeyResponse](ctx, tx,
+		"SELECT doc FROM energy WHERE timestamp BETWEEN ? AND ? ORDER BY timestamp",
+		from.UnixNano(),
+		to.UnixNano(),
+	)
+	if err != nil {
+		return err
+	}
+	// the weather reaches back to the last reading before the range so the earliest energy reading has a pair
+	weather, err := queryDocuments[model.WeatherResponse](ctx, tx,
+		"SELECT doc FROM weather WHERE timestamp <= ? AND timestamp >= COALESCE((SELECT MAX(timestamp) FROM weather WHERE timestamp <= ?), ?) ORDER BY timestamp",
+		to.UnixNano(),
+		from.UnixNano(),
+		from.UnixNano(),
+	)
+	if err != nil {
+		return err
+	}
+
+	for i := range readings {
+		metric := aggregateMetric(&readings[i], energy, weather)
+		if metric == nil {
+			telemetry.Logger(ctx).Debug("No weather to aggregate the energy reading with", zap.Timep("timestamp", readings[i].Timestamp))
+			continue
+		}
+		if err := insertDocument(ctx, tx, "metrics", metric.DocumentId(), &metric.BaseDocument, metric); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		zap.L().Info("Applying sqlite migration", zap.Int("version", i+1))
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("PRAGMA user_version = " + strconv.Itoa(i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insertDocument ignores documents whose id is already stored so repeated ingests are safe
+func insertDocument(ctx context.Context, tx *sql.Tx, table string, id string, base *model.BaseDocument, doc any) error {
+	if base.Timestamp == nil {
+		telemetry.Logger(ctx).Warn("Skipping document without a timestamp", zap.Stringp("type", base.Type))
+		return nil
+	}
+
+	docBytes, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT OR IGNORE INTO "+table+" (id, timestamp, historical_seed, doc) VALUES (?, ?, ?, ?)",
+		id,
+		base.Timestamp.UnixNano(),
+		base.HistoricalSeed,
+		string(docBytes),
+	)
+	return err
+}
+
+// queryDocuments decodes the doc column of each row
+func queryDocuments[T any](ctx context.Context, tx *sql.Tx, query string, args ...any) ([]T, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := []T{}
+	for rows.Next() {
+		var doc []byte
+		if err := rows.Scan(&doc); err != nil {
+			return nil, err
+		}
+
+		var x T
+		if err := json.Unmarshal(doc, &x); err != nil {
+			return nil, err
+		}
+		docs = append(docs, x)
+	}
+
+	return docs, rows.Err()
+}
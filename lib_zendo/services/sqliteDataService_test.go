@@ -0,0 +1,338 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+	"zendo/lib_zendo/model"
+)
+
+func TestSQLiteMigrations(t *testing.T) {
+	s := sqliteForTest(t)
+	ctx := context.Background()
+
+	if err := s.CheckSetup(ctx); err != nil {
+		t.Fatalf("CheckSetup after migrating: %v", err)
+	}
+	if version := userVersionForTest(t, s.db); version != len(sqliteMigrations) {
+		t.Fatalf("expected user_version %d, got %d", len(sqliteMigrations), version)
+	}
+
+	// a second start finds nothing to do, the migrations that alter tables would fail if run again
+	if err := migrateSQLite(s.db); err != nil {
+		t.Fatalf("migrating again: %v", err)
+	}
+	if version := userVersionForTest(t, s.db); version != len(sqliteMigrations) {
+		t.Fatalf("expected migrating again to leave user_version at %d, got %d", len(sqliteMigrations), version)
+	}
+
+	if _, err := s.db.Exec("PRAGMA user_version = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckSetup(ctx); err == nil {
+		t.Fatal("expected CheckSetup to fail with migrations missing")
+	}
+}
+
+func TestSQLiteMigrationsBackfillDocumentIds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zendo.db")
+	at := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// a file from before documents had ids, with a data point ingested twice
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(sqliteSchema + "PRAGMA user_version = 1;"); err != nil {
+		t.Fatalf("creating the first schema: %v", err)
+	}
+	energy := []*model.LatestEnergeyResponse{energyForTest(at, 100), energyForTest(at, 999), energyForTest(at.Add(time.Hour), 200)}
+	for _, x := range energy {
+		insertRowForTest(t, db, "energy", x.Timestamp, x)
+	}
+	weather := []*model.WeatherResponse{weatherForTest(at, 5), weatherForTest(at, 99)}
+	for _, x := range weather {
+		insertRowForTest(t, db, "weather", x.Timestamp, x)
+	}
+	metric := metricForTest(at, 1)
+	for range 2 {
+		insertRowForTest(t, db, "metrics", metric.Timestamp, metric)
+	}
+
+	if err := migrateSQLite(db); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	if version := userVersionForTest(t, db); version != len(sqliteMigrations) {
+		t.Fatalf("expected user_version %d, got %d", len(sqliteMigrations), version)
+	}
+
+	// the backfilled ids match the ones new documents get, and the first copy of each is kept
+	for _, test := range []struct {
+		table string
+		ids   []string
+	}{
+		{"energy", []string{energy[0].DocumentId(), energy[2].DocumentId()}},
+		{"weather", []string{weather[0].DocumentId()}},
+		{"metrics", []string{metric.DocumentId()}},
+	} {
+		ids := idsForTest(t, db, test.table)
+		if len(ids) != len(test.ids) {
+			t.Fatalf("expected %v in %s, got %v", test.ids, test.table, ids)
+		}
+		for i := range ids {
+			if ids[i] != test.ids[i] {
+				t.Fatalf("expected %v in %s, got %v", test.ids, test.table, ids)
+			}
+		}
+	}
+	var total int
+	if err := db.QueryRow("SELECT json_extract(doc, '$.powerProductionTotal') FROM energy WHERE timestamp = ?", at.UnixNano()).Scan(&total); err != nil {
+		t.Fatal(err)
+	}
+	if total != 100 {
+		t.Fatalf("expected the first copy of the duplicate to be kept, production total is %d", total)
+	}
+	db.Close()
+
+	// the unique ids stop the same data point being stored again
+	s, err := NewSQLiteDataService(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteDataService: %v", err)
+	}
+	defer s.Close()
+	if err := s.PostLatestData(context.Background(), energyForTest(at, 300), nil); err != nil {
+		t.Fatal(err)
+	}
+	if rows := countRows(t, s.db, "energy", ""); rows != 2 {
+		t.Fatalf("expected the migrated ids to ignore a repeated data point, got %d energy rows", rows)
+	}
+}
+
+func TestSQLiteSeedIsIdempotent(t *testing.T) {
+	s := sqliteForTest(t)
+	ctx := context.Background()
+	at := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for range 2 {
+		if err := s.PostLatestData(ctx, energyForTest(at, 100), weatherForTest(at, 5)); err != nil {
+			t.Fatalf("PostLatestData: %v", err)
+		}
+	}
+
+	// the seed overlaps the live data point, which is kept as it was
+	energy := []model.LatestEnergeyResponse{*energyForTest(at.Add(-time.Hour), 90), *energyForTest(at, 999)}
+	weather := []model.WeatherResponse{*weatherForTest(at.Add(-time.Hour), 4), *weatherForTest(at, 99)}
+	for range 2 {
+		if err := s.SeedHistoricalData(ctx, &energy, &weather); err != nil {
+			t.Fatalf("SeedHistoricalData: %v", err)
+		}
+	}
+
+	for _, table := range []string{"energy", "weather", "metrics"} {
+		if rows := countRows(t, s.db, table, ""); rows != 2 {
+			t.Fatalf("expected 2 %s rows after posting and seeding twice, got %d", table, rows)
+		}
+		if seeded := countRows(t, s.db, table, "historical_seed"); seeded != 1 {
+			t.Fatalf("expected only the new %s row to be marked as seed data, got %d", table, seeded)
+		}
+	}
+
+	latest, err := s.GetLatestMetric(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == nil || !latest.Timestamp.Equal(at) || latest.TotalProduction != 100 || latest.WeatherData.Temperature != 5 {
+		t.Fatalf("expected the seed to leave the live metric alone, got %+v", latest)
+	}
+}
+
+func TestSQLiteAggregatesEnergyReadings(t *testing.T) {
+	s := sqliteForTest(t)
+	ctx := context.Background()
+	at := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// without weather to pair with there is no metric
+	if err := s.PostLatestData(ctx, energyForTest(at.Add(-2*time.Hour), 100), nil); err != nil {
+		t.Fatal(err)
+	}
+	if latest, err := s.GetLatestMetric(ctx); err != nil || latest != nil {
+		t.Fatalf("expected no metric without weather, got %+v and %v", latest, err)
+	}
+
+	energy := []model.LatestEnergeyResponse{*energyForTest(at.Add(-time.Hour), 200)}
+	weather := []model.WeatherResponse{*weatherForTest(at.Add(-time.Hour), 4)}
+	if err := s.SeedHistoricalData(ctx, &energy, &weather); err != nil {
+		t.Fatal(err)
+	}
+
+	// the weather for the live reading comes in a later post, so it is paired with the last hour's
+	reading := energyForTest(at, 300)
+	reading.PowerConsumptionTotal = 350
+	if err := s.PostLatestData(ctx, reading, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := s.GetMetricsInRange(ctx, MetricsRangeQuery{From: at.Add(-24 * time.Hour), To: at})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Metrics) != 2 {
+		t.Fatalf("expected a metric for each reading with weather, got %d", len(page.Metrics))
+	}
+	if !page.Metrics[0].HistoricalSeed || page.Metrics[1].HistoricalSeed {
+		t.Fatalf("expected only the seeded reading's metric to be marked as seed data, got %+v", page.Metrics)
+	}
+
+	latest := page.Metrics[1]
+	if !latest.Timestamp.Equal(at) || latest.Type == nil || *latest.Type != model.AGGREGATED_TYPE {
+		t.Fatalf("expected an aggregated metric at %v, got %+v", at, latest)
+	}
+	if latest.TotalProduction != 300 || latest.TotalConsumption != 350 || latest.NetBalance != -50 {
+		t.Fatalf("expected totals of 300 and 350 with a balance of -50, got %+v", latest)
+	}
+	if latest.WeatherData.Temperature != 4 {
+		t.Fatalf("expected the latest weather before the reading, got a temperature of %v", latest.WeatherData.Temperature)
+	}
+	if latest.PowerProductionData.Wind == nil || *latest.PowerProductionData.Wind != 300 {
+		t.Fatalf("expected the production breakdown of the reading, got %+v", latest.PowerProductionData)
+	}
+}
+
+func TestSQLiteMetricsRangePaging(t *testing.T) {
+	s := sqliteForTest(t)
+	ctx := context.Background()
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	seedHoursForTest(t, s, start, 7)
+
+	// the first and last hour fall outside the range
+	from := start.Add(time.Hour)
+	to := start.Add(5 * time.Hour)
+
+	for _, descending := range []bool{false, true} {
+		query := MetricsRangeQuery{From: from, To: to, Descending: descending, Limit: 2}
+		seen := []time.Time{}
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatal("paging didn't finish")
+			}
+
+			page, err := s.GetMetricsInRange(ctx, query)
+			if err != nil {
+				t.Fatalf("GetMetricsInRange: %v", err)
+			}
+			if page.TotalCount != 5 {
+				t.Fatalf("expected a total count of 5, got %d", page.TotalCount)
+			}
+			if len(page.Metrics) > 2 {
+				t.Fatalf("expected at most 2 metrics per page, got %d", len(page.Metrics))
+			}
+			for _, metric := range page.Metrics {
+				seen = append(seen, *metric.Timestamp)
+			}
+
+			if page.NextCursor == nil {
+				break
+			}
+			query.StartAt = page.NextCursor
+		}
+
+		expected := []time.Time{}
+		for i := 1; i <= 5; i++ {
+			expected = append(expected, start.Add(time.Duration(i)*time.Hour))
+		}
+		if descending {
+			for i, j := 0, len(expected)-1; i < j; i, j = i+1, j-1 {
+				expected[i], expected[j] = expected[j], expected[i]
+			}
+		}
+		if len(seen) != len(expected) {
+			t.Fatalf("descending %v: expected %d metrics over every page, got %d", descending, len(expected), len(seen))
+		}
+		for i := range expected {
+			if !seen[i].Equal(expected[i]) {
+				t.Fatalf("descending %v: expected %v at %d, got %v", descending, expected[i], i, seen[i])
+			}
+		}
+	}
+
+	// without a limit the whole range comes back at once
+	page, err := s.GetMetricsInRange(ctx, MetricsRangeQuery{From: from, To: to})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Metrics) != 5 || page.NextCursor != nil {
+		t.Fatalf("expected every metric on one page, got %d and cursor %v", len(page.Metrics), page.NextCursor)
+	}
+
+	latest, err := s.GetLatestMetric(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == nil || !latest.Timestamp.Equal(start.Add(6*time.Hour)) || latest.TotalProduction != 6 {
+		t.Fatalf("expected the metric at hour 6 as the latest, got %+v", latest)
+	}
+}
+
+// private
+
+func sqliteForTest(t *testing.T) *SQLiteDataService {
+	t.Helper()
+
+	s, err := NewSQLiteDataService(filepath.Join(t.TempDir(), "zendo.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteDataService: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func userVersionForTest(t *testing.T, db *sql.DB) int {
+	t.Helper()
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+// insertRowForTest writes a row the way the first schema did, without an id
+func insertRowForTest(t *testing.T, db *sql.DB, table string, at *time.Time, doc any) {
+	t.Helper()
+
+	docBytes, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO "+table+" (timestamp, doc) VALUES (?, ?)", at.UnixNano(), string(docBytes)); err != nil {
+		t.Fatalf("inserting into %s: %v", table, err)
+	}
+}
+
+func idsForTest(t *testing.T, db *sql.DB, table string) []string {
+	t.Helper()
+
+	rows, err := db.Query("SELECT id FROM " + table + " ORDER BY timestamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
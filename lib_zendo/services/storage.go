@@ -0,0 +1,62 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"time"
+	"zendo/lib_zendo/model"
+	"zendo/lib_zendo/utils"
+)
+
+const (
+	COUCHDB_STORAGE  string = "couchdb"
+	SQLITE_STORAGE   string = "sqlite"
+	POSTGRES_STORAGE string = "postgres"
+	MEMORY_STORAGE   string = "memory"
+
+	defaultSQLitePath string = "zendo.db"
+
+	// storageTimeout bounds every call to the SQL backends, CouchDB calls are bounded by the http client timeout
+	storageTimeout time.Duration = 30 * time.Second
+)
+
+// NewDataService builds the IDataService for the given storage backend.
+// When storage is empty the backend is read from ZENDO_STORAGE and defaults to CouchDB.
+func NewDataService(storage string, http utils.IHttpClient) (IDataService, error) {
+	switch ResolveStorage(storage) {
+	case COUCHDB_STORAGE:
+		return &CouchDBDataService{
+			Http: http,
+		}, nil
+	case SQLITE_STORAGE:
+		path := os.Getenv("SQLITE_PATH")
+		if len(path) == 0 {
+			path = defaultSQLitePath
+		}
+		return NewSQLiteDataService(path)
+	case POSTGRES_STORAGE:
+		return NewPostgresDataService(os.Getenv("POSTGRES_URL"))
+	case MEMORY_STORAGE:
+		return NewMemoryDataService(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", ResolveStorage(storage))
+	}
+}
+
+// ResolveStorage applies the ZENDO_STORAGE and CouchDB defaults to an unset storage backend
+func ResolveStorage(storage string) string {
+	if len(storage) == 0 {
+		storage = os.Getenv("ZENDO_STORAGE")
+	}
+	if len(storage) == 0 {
+		storage = COUCHDB_STORAGE
+	}
+	return storage
+}
+
+// documentTables maps each raw document type to its table in the SQL backends
+var documentTables = map[string]string{
+	model.ENERGY_TYPE:     "energy",
+	model.WEATHER_TYPE:    "weather",
+	model.AGGREGATED_TYPE: "metrics",
+}
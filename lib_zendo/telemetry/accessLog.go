@@ -0,0 +1,48 @@
+package telemetry
+
+import (
+	"net/http"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// AccessLog logs every request once it is answered, and gives each one an id taken from X-Request-ID or generated.
+// The id is sent back on the response, set on outbound HttpClient calls and added to lines logged through Logger.
+// Successful requests to the quiet routes, e.g. probes and scrapes, are logged at debug so they don't drown the rest.
+func AccessLog(quiet ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+
+			id := requestId(req.Header.Get(REQUEST_ID_HEADER))
+			req = req.WithContext(WithRequestId(req.Context(), id))
+			resp.Header().Set(REQUEST_ID_HEADER, id)
+
+			recorder := &statusRecorder{ResponseWriter: resp}
+			next.ServeHTTP(recorder, req)
+
+			// the query is left out as it can carry cursors and filters that aren't worth the space
+			pattern := route(req)
+			status := recorder.code()
+			level := zapcore.InfoLevel
+			switch {
+			case status >= 500:
+				level = zapcore.WarnLevel
+			case status < 400 && slices.Contains(quiet, pattern):
+				level = zapcore.DebugLevel
+			}
+
+			Logger(req.Context()).Log(level, "Request",
+				zap.String("method", req.Method),
+				zap.String("path", req.URL.Path),
+				zap.String("route", pattern),
+				zap.Int("status", status),
+				zap.Int("bytes", recorder.bytes),
+				zap.Duration("latency", time.Since(start)),
+			)
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package telemetry
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"zendo/lib_zendo/server"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// COUCHDB_REQUEST_ERROR is a call that got no response, the reason is timeout or unreachable
+	COUCHDB_REQUEST_ERROR string = "request"
+	// COUCHDB_STATUS_ERROR is an error response, the reason is the status code
+	COUCHDB_STATUS_ERROR string = "status"
+	// COUCHDB_DOCUMENT_ERROR is a document rejected by a bulk write, the reason is CouchDB's error e.g. forbidden
+	COUCHDB_DOCUMENT_ERROR string = "document"
+)
+
+const (
+	FETCH_UPDATED   string = "updated"
+	FETCH_UNCHANGED string = "unchanged"
+	FETCH_FAILED    string = "failed"
+)
+
+// kinds of data the fetcher updates, for TrackUpdates
+const (
+	ENERGY_UPDATES  string = "energy"
+	WEATHER_UPDATES string = "weather"
+)
+
+// Handler serves every registered series in the Prometheus exposition format for /metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// MetricsServerFromEnv serves Handler on /metrics at METRICS_ADDR, falling back to fallback when it is unset.
+// It is a listener of its own so the telemetry can be scraped from inside the network without being published
+// next to the public routes.
+func MetricsServerFromEnv(fallback string, timeouts server.Timeouts) *server.Server {
+	addr := os.Getenv("METRICS_ADDR")
+	if len(addr) == 0 {
+		addr = fallback
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", Handler())
+	return &server.Server{
+		Addr:     addr,
+		Handler:  mux,
+		Timeouts: timeouts,
+	}
+}
+
+// ObserveHttpCall records an outbound call, status is the response code or "error" when there was no response
+func ObserveHttpCall(host string, method string, status string, duration time.Duration) {
+	httpClientDuration.WithLabelValues(host, method, status).Observe(duration.Seconds())
+}
+
+// CountCouchDBError counts a failed call to CouchDB, kind is one of the COUCHDB_*_ERROR constants
+func CountCouchDBError(kind string, reason string) {
+	couchDBErrors.WithLabelValues(kind, reason).Inc()
+}
+
+// CountFetch counts a call to an upstream provider by its outcome, one of the FETCH_* constants
+func CountFetch(provider string, outcome string) {
+	fetches.WithLabelValues(provider, outcome).Inc()
+}
+
+// TrackUpdates publishes the seconds since each kind of data was last updated.
+// Until the first update the age counts from when this was called, so a fetcher that never succeeds still goes stale.
+func TrackUpdates(kinds ...string) {
+	updatesMu.Lock()
+	defer updatesMu.Unlock()
+
+	now := time.Now()
+	for _, kind := range kinds {
+		if _, ok := updatedAt[kind]; ok {
+			continue
+		}
+		updatedAt[kind] = now
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "zendo_seconds_since_last_update",
+			Help:        "Seconds since new data of this kind was last stored.",
+			ConstLabels: prometheus.Labels{"kind": kind},
+		}, func() float64 {
+			return time.Since(lastUpdate(kind)).Seconds()
+		})
+	}
+}
+
+// Updated marks kind as just updated, kinds not passed to TrackUpdates are ignored
+func Updated(kind string) {
+	updatesMu.Lock()
+	defer updatesMu.Unlock()
+
+	if _, ok := updatedAt[kind]; ok {
+		updatedAt[kind] = time.Now()
+	}
+}
+
+// private
+
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "zendo_http_request_duration_seconds",
+		Help:    "Time taken to answer requests by route pattern, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	httpClientDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "zendo_http_client_request_duration_seconds",
+		Help:    "Time taken by outbound calls until the response headers arrive, by host, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"host", "method", "code"})
+
+	couchDBErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "zendo_couchdb_errors_total",
+		Help: "Failed calls to CouchDB by kind and reason.",
+	}, []string{"kind", "reason"})
+
+	fetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "zendo_fetches_total",
+		Help: "Calls to upstream data providers by provider and outcome.",
+	}, []string{"provider", "outcome"})
+)
+
+var (
+	updatesMu sync.Mutex
+	updatedAt = map[string]time.Time{}
+)
+
+func lastUpdate(kind string) time.Time {
+	updatesMu.Lock()
+	defer updatesMu.Unlock()
+	return updatedAt[kind]
+}
+
+func observeRequest(route string, method string, code int, duration time.Duration) {
+	requestDuration.WithLabelValues(route, method, strconv.Itoa(code)).Observe(duration.Seconds())
+}
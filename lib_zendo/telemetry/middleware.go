@@ -0,0 +1,105 @@
+package telemetry
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// UNMATCHED_ROUTE labels requests no pattern matched, so scanners can't add a series per path
+const UNMATCHED_ROUTE string = "unmatched"
+
+// Instrument times every request through mux, labelled by the pattern that matched rather than the raw path
+func Instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: resp}
+
+		mux.ServeHTTP(recorder, req)
+
+		observeRequest(route(req), method(req.Method), recorder.code(), time.Since(start))
+	})
+}
+
+// private
+
+// route is the pattern the mux matched without its method, the mux sets it on the request it was given
+func route(req *http.Request) string {
+	if len(req.Pattern) == 0 {
+		return UNMATCHED_ROUTE
+	}
+	if _, path, ok := strings.Cut(req.Pattern, " "); ok {
+		return path
+	}
+	return req.Pattern
+}
+
+var methods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// method keeps the label to the standard methods, anything else a client sends is "other"
+func method(m string) string {
+	if methods[m] {
+		return m
+	}
+	return "other"
+}
+
+// statusRecorder remembers the status and how many body bytes were written. Streams flush and websockets hijack through it,
+// so both are passed on, and Unwrap lets http.ResponseController reach the rest.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 && status >= 200 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil && r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) code() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
@@ -0,0 +1,65 @@
+package telemetry
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"go.uber.org/zap"
+)
+
+// REQUEST_ID_HEADER carries the request id in from clients and proxies, back in the response and out to other services
+const REQUEST_ID_HEADER string = "X-Request-ID"
+
+// MAX_REQUEST_ID_LENGTH bounds an id taken from a client, a longer one is replaced
+const MAX_REQUEST_ID_LENGTH int = 128
+
+// WithRequestId scopes ctx to a request, Logger(ctx) then tags every line with the id
+func WithRequestId(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, requestIdKey{}, id)
+	return context.WithValue(ctx, loggerKey{}, zap.L().With(zap.String("requestId", id)))
+}
+
+// RequestIdFrom returns the id of the request ctx belongs to, empty outside a request
+func RequestIdFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// Logger returns the logger for ctx, which includes the request id within a request and is the global logger otherwise
+func Logger(ctx context.Context) *zap.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*zap.Logger); ok {
+		return logger
+	}
+	return zap.L()
+}
+
+// private
+
+type requestIdKey struct{}
+
+type loggerKey struct{}
+
+// requestId keeps the id the client sent so its logs line up with ours, unless it isn't safe to log and send on
+func requestId(sent string) string {
+	if validRequestId(sent) {
+		return sent
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func validRequestId(id string) bool {
+	if len(id) == 0 || len(id) > MAX_REQUEST_ID_LENGTH {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		// printable ascii without spaces
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -2,20 +2,31 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+	"zendo/lib_zendo/telemetry"
 
 	"go.uber.org/zap"
 )
 
 type IHttpClient interface {
-	Get(url string, responseBody any, opts ...*HttpOptions) (*HttpResponse, error)
-	Post(url string, body any, responseBody any, opts ...*HttpOptions) (*HttpResponse, error)
+	Get(ctx context.Context, url string, responseBody any, opts ...*HttpOptions) (*HttpResponse, error)
+	Post(ctx context.Context, url string, body any, responseBody any, opts ...*HttpOptions) (*HttpResponse, error)
+	Put(ctx context.Context, url string, body any, responseBody any, opts ...*HttpOptions) (*HttpResponse, error)
+	Stream(ctx context.Context, url string, opts ...*HttpOptions) (*http.Response, error)
 }
 
-type HttpClient struct{}
+// HttpClient gives every request a deadline of Timeout, or DEFAULT_HTTP_TIMEOUT when unset, on top of any deadline already on ctx
+type HttpClient struct {
+	Timeout time.Duration
+}
+
+const DEFAULT_HTTP_TIMEOUT time.Duration = 30 * time.Second
 
 type HttpResponse struct {
 	StatusCode         int
@@ -27,15 +38,20 @@ type HttpResponse struct {
 
 type HttpOptions struct {
 	Headers *map[string]string
+	// Timeout overrides the client timeout for this call
+	Timeout time.Duration
 }
 
-func (h *HttpClient) Get(url string, responseBody any, opts ...*HttpOptions) (*HttpResponse, error) {
+func (h *HttpClient) Get(ctx context.Context, url string, responseBody any, opts ...*HttpOptions) (*HttpResponse, error) {
 	options := HttpOptions{}
 	if len(opts) > 0 {
 		options = *opts[0]
 	}
 
-	req, err := http.NewRequest("GET", url, nil)
+	ctx, cancel := context.WithTimeout(ctx, h.timeout(options))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -46,7 +62,7 @@ func (h *HttpClient) Get(url string, responseBody any, opts ...*HttpOptions) (*H
 		}
 	}
 
-	response, err := http.DefaultClient.Do(req)
+	response, err := h.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -64,7 +80,7 @@ func (h *HttpClient) Get(url string, responseBody any, opts ...*HttpOptions) (*H
 		}
 
 		if response.StatusCode > 299 {
-			zap.L().Warn("Got error code with response from http request", zap.String("response", string(bodyBytes)))
+			telemetry.Logger(ctx).Warn("Got error code with response from http request", zap.String("response", string(bodyBytes)))
 			return &HttpResponse{
 				StatusCode: response.StatusCode,
 			}, nil
@@ -95,7 +111,7 @@ func (h *HttpClient) Get(url string, responseBody any, opts ...*HttpOptions) (*H
 			responseBody = &s
 			break
 		default:
-			zap.L().Warn("Unsupported response type, not decoding", zap.String("type", contentType))
+			telemetry.Logger(ctx).Warn("Unsupported response type, not decoding", zap.String("type", contentType))
 			break
 		}
 	}
@@ -103,26 +119,86 @@ func (h *HttpClient) Get(url string, responseBody any, opts ...*HttpOptions) (*H
 	return &r, nil
 }
 
-func (h *HttpClient) Post(url string, body any, responseBody any, opts ...*HttpOptions) (*HttpResponse, error) {
-	return h.performRequestWithBody("POST", url, body, responseBody, opts...)
+func (h *HttpClient) Post(ctx context.Context, url string, body any, responseBody any, opts ...*HttpOptions) (*HttpResponse, error) {
+	return h.performRequestWithBody(ctx, "POST", url, body, responseBody, opts...)
 }
 
-// private
+func (h *HttpClient) Put(ctx context.Context, url string, body any, responseBody any, opts ...*HttpOptions) (*HttpResponse, error) {
+	return h.performRequestWithBody(ctx, "PUT", url, body, responseBody, opts...)
+}
 
-func (h *HttpClient) performRequestWithBody(verb string, url string, body any, responseBody any, opts ...*HttpOptions) (*HttpResponse, error) {
+// Stream sends a GET and hands back the response as it arrives, the caller reads and closes the body.
+// Only ctx bounds the request as a feed is held open for as long as it is followed, the timeouts don't apply.
+func (h *HttpClient) Stream(ctx context.Context, url string, opts ...*HttpOptions) (*http.Response, error) {
 	options := HttpOptions{}
 	if len(opts) > 0 {
 		options = *opts[0]
 	}
 
-	var reader io.Reader
-	jsonBytes, err := json.Marshal(body)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
-	reader = bytes.NewBuffer(jsonBytes)
 
-	req, err := http.NewRequest(verb, url, reader)
+	if options.Headers != nil {
+		for key, value := range *options.Headers {
+			req.Header.Set(key, value)
+		}
+	}
+
+	return h.do(req)
+}
+
+// private
+
+func (h *HttpClient) timeout(options HttpOptions) time.Duration {
+	if options.Timeout > 0 {
+		return options.Timeout
+	}
+	if h.Timeout > 0 {
+		return h.Timeout
+	}
+	return DEFAULT_HTTP_TIMEOUT
+}
+
+// do sends req and records the call against its host, the host never includes credentials from the url.
+// Within a request the request id is passed on so the other service's logs can be matched up.
+func (h *HttpClient) do(req *http.Request) (*http.Response, error) {
+	if id := telemetry.RequestIdFrom(req.Context()); len(id) > 0 && len(req.Header.Get(telemetry.REQUEST_ID_HEADER)) == 0 {
+		req.Header.Set(telemetry.REQUEST_ID_HEADER, id)
+	}
+
+	start := time.Now()
+	response, err := http.DefaultClient.Do(req)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(response.StatusCode)
+	}
+	telemetry.ObserveHttpCall(req.URL.Host, req.Method, status, time.Since(start))
+
+	return response, err
+}
+
+func (h *HttpClient) performRequestWithBody(ctx context.Context, verb string, url string, body any, responseBody any, opts ...*HttpOptions) (*HttpResponse, error) {
+	options := HttpOptions{}
+	if len(opts) > 0 {
+		options = *opts[0]
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout(options))
+	defer cancel()
+
+	var reader io.Reader
+	if body != nil {
+		jsonBytes, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewBuffer(jsonBytes)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, verb, url, reader)
 	if err != nil {
 		return nil, err
 	}
@@ -135,7 +211,7 @@ func (h *HttpClient) performRequestWithBody(verb string, url string, body any, r
 		}
 	}
 
-	response, err := http.DefaultClient.Do(req)
+	response, err := h.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -153,7 +229,7 @@ func (h *HttpClient) performRequestWithBody(verb string, url string, body any, r
 		}
 
 		if response.StatusCode > 299 {
-			zap.L().Warn("Got error code with response from http request", zap.String("response", string(bodyBytes)))
+			telemetry.Logger(ctx).Warn("Got error code with response from http request", zap.String("response", string(bodyBytes)))
 			return &HttpResponse{
 				StatusCode: response.StatusCode,
 			}, nil
@@ -184,7 +260,7 @@ func (h *HttpClient) performRequestWithBody(verb string, url string, body any, r
 			responseBody = &s
 			break
 		default:
-			zap.L().Warn("Unsupported response type, not decoding", zap.String("type", contentType))
+			telemetry.Logger(ctx).Warn("Unsupported response type, not decoding", zap.String("type", contentType))
 			break
 		}
 	}
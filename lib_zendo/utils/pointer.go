@@ -1,5 +1,11 @@
 package utils
 
+import "time"
+
 func StringPointer(val string) *string {
 	return &val
 }
+
+func TimePointer(val time.Time) *time.Time {
+	return &val
+}
@@ -2,9 +2,16 @@ const apiUrl = import.meta.env.VITE_API_URL;
 
 import { Metric, type HttpResponse } from '../model';
 
+export type TimeRange = {
+  from?: Date;
+  to?: Date;
+  order?: 'asc' | 'desc';
+  limit?: number;
+};
+
 interface IDataService {
   getLatestMetric(): Promise<HttpResponse<Metric>>;
-  getTimeSeriesData(): Promise<HttpResponse<Metric[]>>;
+  getTimeSeriesData(range?: TimeRange): Promise<HttpResponse<Metric[]>>;
 }
 
 export const DataService: IDataService = {
@@ -41,8 +48,16 @@ async function getLatestMetric(): Promise<HttpResponse<Metric>> {
   }
 }
 
-async function getTimeSeriesData(): Promise<HttpResponse<Metric[]>> {
-  const url = `${apiUrl}/historical-data`;
+async function getTimeSeriesData(range?: TimeRange): Promise<HttpResponse<Metric[]>> {
+  // without a range the api returns the last 24 hours
+  const params = new URLSearchParams();
+  if (range?.from) params.set('from', range.from.toISOString());
+  if (range?.to) params.set('to', range.to.toISOString());
+  if (range?.order) params.set('order', range.order);
+  if (range?.limit) params.set('limit', range.limit.toString());
+
+  const query = params.toString();
+  const url = `${apiUrl}/historical-data${query ? `?${query}` : ''}`;
 
   try {
     const response = await fetch(url, {